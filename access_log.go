@@ -0,0 +1,343 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat string
+
+const (
+	AccessLogCommon = AccessLogFormat("common")
+	AccessLogJSON   = AccessLogFormat("json")
+	AccessLogLogfmt = AccessLogFormat("logfmt")
+)
+
+// How a request was routed to its service.
+const (
+	RoutingByVhost = "vhost"
+	RoutingByPort  = "port"
+)
+
+// AccessLogEntry describes a single request served by a router.
+type AccessLogEntry struct {
+	Time            time.Time     `json:"time"`
+	RemoteAddr      string        `json:"remote_addr"`
+	Method          string        `json:"method"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	Host            string        `json:"host"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	Duration        time.Duration `json:"-"`
+	UpstreamLatency time.Duration `json:"-"`
+	Referer         string        `json:"referer,omitempty"`
+	UserAgent       string        `json:"user_agent,omitempty"`
+	Routing         string        `json:"routing"`
+	ServiceId       string        `json:"service,omitempty"`
+	BackendId       string        `json:"backend,omitempty"`
+	Upstream        string        `json:"upstream,omitempty"`
+	Retries         int           `json:"retries"`
+}
+
+// AccessLog writes access log entries in the configured format to a file,
+// or to stdout if the path is "-", or nowhere if the path is empty.
+type AccessLog struct {
+	Path       string
+	Format     AccessLogFormat
+	SampleRate float64 // fraction of requests to log (server errors are always logged)
+	mutex      sync.Mutex
+	file       *os.File
+	writer     io.Writer
+}
+
+func NewAccessLog(path string, format AccessLogFormat, sampleRate float64) (*AccessLog, error) {
+	l := &AccessLog{}
+
+	if err := l.Reconfigure(path, format, sampleRate); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reconfigure switches to the given file, format and sample rate, leaving
+// the access log untouched if the file cannot be opened. An empty path
+// disables the access log.
+func (l *AccessLog) Reconfigure(path string, format AccessLogFormat, sampleRate float64) error {
+	switch format {
+	case AccessLogCommon, AccessLogJSON, AccessLogLogfmt:
+	default:
+		return fmt.Errorf("Unknown access log format %q.", format)
+	}
+
+	file, writer, err := openAccessLog(path)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.Path = path
+	l.Format = format
+	l.SampleRate = sampleRate
+	l.file = file
+	l.writer = writer
+
+	return nil
+}
+
+// Reopen reopens the access log file, such as after it has been rotated.
+func (l *AccessLog) Reopen() error {
+	l.mutex.Lock()
+	path := l.Path
+	l.mutex.Unlock()
+
+	file, writer, err := openAccessLog(path)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.writer = writer
+	l.mutex.Unlock()
+
+	return nil
+}
+
+// openAccessLog opens the given access log file for appending, returning
+// stdout for "-", and neither for an empty path.
+func openAccessLog(path string) (*os.File, io.Writer, error) {
+	switch path {
+	case "":
+		return nil, nil, nil
+	case "-":
+		return nil, os.Stdout, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, file, nil
+}
+
+// Enabled tests whether the access log is being written anywhere.
+func (l *AccessLog) Enabled() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.writer != nil
+}
+
+func (l *AccessLog) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	l.writer = nil
+}
+
+// Log writes the given entry, unless it is sampled out.
+func (l *AccessLog) Log(entry *AccessLogEntry) {
+	l.mutex.Lock()
+	format, sampleRate := l.Format, l.SampleRate
+	l.mutex.Unlock()
+
+	if entry.Status < 500 && sampleRate < 1 && rand.Float64() >= sampleRate {
+		return
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case AccessLogJSON:
+		writeAccessLogJSON(&buf, entry)
+	case AccessLogLogfmt:
+		writeAccessLogLogfmt(&buf, entry)
+	default:
+		writeAccessLogCommon(&buf, entry)
+	}
+
+	l.mutex.Lock()
+	if l.writer != nil {
+		l.writer.Write(buf.Bytes())
+	}
+	l.mutex.Unlock()
+}
+
+// writeAccessLogCommon writes the entry in the Common Log Format, extended
+// by the referer and user agent (as in the Combined Log Format), followed
+// by the routing details.
+func writeAccessLogCommon(buf *bytes.Buffer, entry *AccessLogEntry) {
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+
+	fmt.Fprintf(buf, "%v - - [%v] %q %v %v %q %q %v %v %v %v %v %v\n",
+		host,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.URI+" "+entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		orDash(entry.Referer),
+		orDash(entry.UserAgent),
+		orDash(entry.Routing),
+		orDash(entry.ServiceId),
+		orDash(entry.BackendId),
+		orDash(entry.Upstream),
+		formatMillis(entry.UpstreamLatency),
+		entry.Retries)
+}
+
+func writeAccessLogJSON(buf *bytes.Buffer, entry *AccessLogEntry) {
+	json.NewEncoder(buf).Encode(struct {
+		*AccessLogEntry
+		Duration        float64 `json:"duration_ms"`
+		UpstreamLatency float64 `json:"upstream_latency_ms"`
+	}{
+		entry,
+		toMillis(entry.Duration),
+		toMillis(entry.UpstreamLatency),
+	})
+}
+
+func writeAccessLogLogfmt(buf *bytes.Buffer, entry *AccessLogEntry) {
+	fields := []string{
+		"time", entry.Time.Format(time.RFC3339Nano),
+		"remote_addr", entry.RemoteAddr,
+		"method", entry.Method,
+		"uri", entry.URI,
+		"proto", entry.Proto,
+		"host", entry.Host,
+		"status", strconv.Itoa(entry.Status),
+		"bytes", strconv.FormatInt(entry.Bytes, 10),
+		"duration_ms", formatMillis(entry.Duration),
+		"upstream_latency_ms", formatMillis(entry.UpstreamLatency),
+		"referer", entry.Referer,
+		"user_agent", entry.UserAgent,
+		"routing", entry.Routing,
+		"service", entry.ServiceId,
+		"backend", entry.BackendId,
+		"upstream", entry.Upstream,
+		"retries", strconv.Itoa(entry.Retries),
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fields[i])
+		buf.WriteByte('=')
+		buf.WriteString(quoteLogfmt(fields[i+1]))
+	}
+	buf.WriteByte('\n')
+}
+
+func quoteLogfmt(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, isControl) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(toMillis(d), 'f', 3, 64)
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response writer does not support hijacking.")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+// Status returns the response status, as far as it is known.
+func (w *accessLogWriter) Status() int {
+	switch {
+	case w.status != 0:
+		return w.status
+	case w.hijacked:
+		return http.StatusSwitchingProtocols
+	default:
+		return http.StatusOK
+	}
+}
@@ -0,0 +1,573 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API is served on the debug port below /v1:
+//
+//	GET  /v1/services
+//	GET  /v1/services/{serviceId}
+//	GET  /v1/services/{serviceId}/backends
+//	GET  /v1/services/{serviceId}/backends/{backendId}
+//	POST /v1/services/{serviceId}/backends/{backendId}/drain
+//	POST /v1/services/{serviceId}/backends/{backendId}/disable
+//	POST /v1/services/{serviceId}/backends/{backendId}/enable
+//	GET  /v1/routers
+//	GET  /v1/listeners
+//	GET  /v1/discoveries
+//	GET  /v1/events?since={eventId}&wait={duration}
+//	GET  /v1/events (Accept: text/event-stream)
+//
+// Service IDs start with a slash, such as "/app-0", which is not repeated
+// in the path. TCP services are listed along with the HTTP services, with
+// their protocol set to "tcp", but their backends cannot be drained,
+// disabled or enabled. Backends removed by service discovery are listed with
+// "removed" set until they finished their requests or sessions. Reads are
+// served from a snapshot taken within the event processing, and writes are
+// sent through the event stream, serializing them with the updates from
+// service discovery.
+const adminApiPrefix = "/v1"
+
+// maxEventsWait is the longest time a client may wait for new events.
+const maxEventsWait = 5 * time.Minute
+
+type ServiceView struct {
+	Id           string              `json:"id"`
+	Protocol     string              `json:"protocol"` // "http"
+	Scheduler    SchedulingAlgorithm `json:"scheduler"`
+	Hosts        []string            `json:"hosts"`
+	HashKey      HashKey             `json:"hashKey"`
+	StickyCookie string              `json:"stickyCookie,omitempty"`
+	DrainTimeout string              `json:"drainTimeout"`
+	SlowStart    string              `json:"slowStart,omitempty"`
+	Backends     []*BackendView      `json:"backends"`
+}
+
+type BackendView struct {
+	Id          string         `json:"id"`
+	Address     string         `json:"address"`
+	Weight      int            `json:"weight"`
+	Capacity    int            `json:"capacity"`
+	Load        int            `json:"load"`
+	Alive       bool           `json:"alive"`
+	Available   bool           `json:"available"`
+	Ejected     bool           `json:"ejected"`
+	Removed     bool           `json:"removed"` // removed by service discovery, still draining
+	AdminState  AdminState     `json:"adminState"`
+	Admin       *AdminOverride `json:"admin,omitempty"`
+	ServedTotal uint64         `json:"servedTotal"`
+	Latency     string         `json:"latency"`
+}
+
+type TcpServiceView struct {
+	Id            string              `json:"id"`
+	Protocol      string              `json:"protocol"` // "tcp"
+	Scheduler     SchedulingAlgorithm `json:"scheduler"`
+	ProxyProtocol int                 `json:"proxyProtocol,omitempty"`
+	DrainTimeout  string              `json:"drainTimeout"`
+	SlowStart     string              `json:"slowStart,omitempty"`
+	Backends      []*TcpBackendView   `json:"backends"`
+}
+
+type TcpBackendView struct {
+	Id        string `json:"id"`
+	Address   string `json:"address"`
+	Capacity  int    `json:"capacity"`
+	Load      int    `json:"load"`
+	Alive     bool   `json:"alive"`
+	Available bool   `json:"available"`
+	Removed   bool   `json:"removed"` // removed by service discovery, still draining
+}
+
+type RouterView struct {
+	Id       string `json:"id"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Routing  string `json:"routing,omitempty"`
+}
+
+// EventsView is the response of the journal of state changes.
+type EventsView struct {
+	LastEventId uint64         `json:"lastEventId"`
+	Complete    bool           `json:"complete"` // false if events since the requested one were lost
+	Events      []JournalEntry `json:"events"`
+}
+
+// AdminStateRequest is the optional body of the backend state requests.
+type AdminStateRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // such as "15m", forever if empty
+}
+
+func newServiceView(service *HttpService) *ServiceView {
+	view := &ServiceView{
+		Id:           service.ServiceId,
+		Protocol:     "http",
+		Scheduler:    service.Scheduler,
+		Hosts:        service.Hosts,
+		HashKey:      service.HashKey,
+		StickyCookie: service.StickyCookie,
+		DrainTimeout: service.DrainTimeout.String(),
+		Backends:     make([]*BackendView, 0),
+	}
+
+	if service.SlowStart != 0 {
+		view.SlowStart = service.SlowStart.String()
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for _, backend := range service.Backends {
+		view.Backends = append(view.Backends, newBackendView(backend, false))
+	}
+	for _, backend := range service.Draining {
+		view.Backends = append(view.Backends, newBackendView(backend, true))
+	}
+
+	return view
+}
+
+func newBackendView(backend *HttpBackend, removed bool) *BackendView {
+	return &BackendView{
+		Id:          backend.Id,
+		Address:     backend.String(),
+		Weight:      backend.Weight,
+		Capacity:    backend.Capacity,
+		Load:        backend.GetCurrentLoad(),
+		Alive:       backend.Alive,
+		Available:   backend.IsAvailable(),
+		Ejected:     backend.IsEjected(),
+		Removed:     removed,
+		AdminState:  backend.getAdminState(),
+		Admin:       backend.GetAdminOverride(),
+		ServedTotal: atomic.LoadUint64(&backend.ServedTotal),
+		Latency:     backend.Latency.Value().String(),
+	}
+}
+
+func newTcpServiceView(service *TcpService) *TcpServiceView {
+	view := &TcpServiceView{
+		Id:            service.ServiceId,
+		Protocol:      "tcp",
+		Scheduler:     service.Scheduler,
+		ProxyProtocol: service.ProxyProtocol,
+		DrainTimeout:  service.DrainTimeout.String(),
+		Backends:      make([]*TcpBackendView, 0),
+	}
+
+	if service.SlowStart != 0 {
+		view.SlowStart = service.SlowStart.String()
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for _, backend := range service.Backends {
+		view.Backends = append(view.Backends, newTcpBackendView(backend, false))
+	}
+	for _, backend := range service.Draining {
+		view.Backends = append(view.Backends, newTcpBackendView(backend, true))
+	}
+
+	return view
+}
+
+func newTcpBackendView(backend *TcpBackend, removed bool) *TcpBackendView {
+	return &TcpBackendView{
+		Id:        backend.Id,
+		Address:   backend.proxy.String(),
+		Capacity:  backend.Capacity,
+		Load:      backend.GetCurrentLoad(),
+		Alive:     backend.Alive,
+		Available: backend.IsAvailable(),
+		Removed:   removed,
+	}
+}
+
+// AdminHandler serves the admin API.
+func (sag *ServiceApplicationGateway) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, adminApiPrefix)
+
+	switch {
+	case path == "/services":
+		sag.getServices(w, r)
+	case strings.HasPrefix(path, "/services/"):
+		sag.serveService(w, r, strings.TrimPrefix(path, "/services"))
+	case path == "/routers":
+		sag.getRouters(w, r)
+	case path == "/listeners":
+		if requireMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, GetListenerAddrs())
+		}
+	case path == "/discoveries":
+		sag.getDiscoveries(w, r)
+	case path == "/events" && acceptsEventStream(r):
+		if requireMethod(w, r, http.MethodGet) {
+			sag.streamEvents(w, r)
+		}
+	case path == "/events":
+		sag.getEvents(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+// serveService serves the requests on a single service, whose ID may be
+// followed by "/backends", "/backends/{backendId}", or
+// "/backends/{backendId}/{action}".
+func (sag *ServiceApplicationGateway) serveService(w http.ResponseWriter, r *http.Request, path string) {
+	serviceId := path
+	var args []string
+	if i := strings.LastIndex(path, "/backends"); i > 0 {
+		if rest := path[i+len("/backends"):]; len(rest) == 0 || rest[0] == '/' {
+			serviceId = path[:i]
+			args = strings.Split(strings.Trim(rest, "/"), "/")
+		}
+	}
+
+	switch {
+	case args == nil:
+		sag.getService(w, r, serviceId)
+	case len(args) == 1 && len(args[0]) == 0:
+		sag.getBackends(w, r, serviceId)
+	case len(args) == 1:
+		sag.getBackend(w, r, serviceId, args[0])
+	case len(args) == 2:
+		sag.setBackendAdminState(w, r, serviceId, args[0], args[1])
+	default:
+		writeError(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+func (sag *ServiceApplicationGateway) getServices(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	views := make([]interface{}, 0)
+	if !sag.inspect(func() {
+		for _, serviceId := range sag.getHttpServiceIds() {
+			views = append(views, newServiceView(sag.HttpServices[serviceId]))
+		}
+		for _, serviceId := range sag.getTcpServiceIds() {
+			views = append(views, newTcpServiceView(sag.TcpServices[serviceId]))
+		}
+	}) {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+// findServiceView returns the view of the given service, or writes an
+// error response and returns nil.
+func (sag *ServiceApplicationGateway) findServiceView(w http.ResponseWriter, serviceId string) *ServiceView {
+	var view *ServiceView
+	if !sag.inspect(func() {
+		if service := sag.FindHttpServiceById(serviceId); service != nil {
+			view = newServiceView(service)
+		}
+	}) {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return nil
+	}
+
+	if view == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Service %v not found.", serviceId))
+	}
+
+	return view
+}
+
+// findTcpServiceView returns the view of the given TCP service, or nil if
+// there is none. It returns false if events are not processed anymore.
+func (sag *ServiceApplicationGateway) findTcpServiceView(serviceId string) (*TcpServiceView, bool) {
+	var view *TcpServiceView
+	ok := sag.inspect(func() {
+		if service, found := sag.TcpServices[serviceId]; found {
+			view = newTcpServiceView(service)
+		}
+	})
+	return view, ok
+}
+
+func (sag *ServiceApplicationGateway) getService(w http.ResponseWriter, r *http.Request, serviceId string) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if view, ok := sag.findTcpServiceView(serviceId); !ok {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+	} else if view != nil {
+		writeJSON(w, http.StatusOK, view)
+	} else if view := sag.findServiceView(w, serviceId); view != nil {
+		writeJSON(w, http.StatusOK, view)
+	}
+}
+
+func (sag *ServiceApplicationGateway) getBackends(w http.ResponseWriter, r *http.Request, serviceId string) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if view, ok := sag.findTcpServiceView(serviceId); !ok {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+	} else if view != nil {
+		writeJSON(w, http.StatusOK, view.Backends)
+	} else if view := sag.findServiceView(w, serviceId); view != nil {
+		writeJSON(w, http.StatusOK, view.Backends)
+	}
+}
+
+func (sag *ServiceApplicationGateway) getBackend(w http.ResponseWriter, r *http.Request, serviceId, backendId string) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	view, ok := sag.findTcpServiceView(serviceId)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return
+	}
+	if view == nil {
+		sag.writeBackend(w, serviceId, backendId)
+		return
+	}
+
+	for _, backend := range view.Backends {
+		if backend.Id == backendId {
+			writeJSON(w, http.StatusOK, backend)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Backend %v not found in service %v.", backendId, serviceId))
+}
+
+func (sag *ServiceApplicationGateway) writeBackend(w http.ResponseWriter, serviceId, backendId string) {
+	view := sag.findServiceView(w, serviceId)
+	if view == nil {
+		return
+	}
+
+	for _, backend := range view.Backends {
+		if backend.Id == backendId {
+			writeJSON(w, http.StatusOK, backend)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, fmt.Sprintf("Backend %v not found in service %v.", backendId, serviceId))
+}
+
+func (sag *ServiceApplicationGateway) setBackendAdminState(w http.ResponseWriter, r *http.Request, serviceId, backendId, action string) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var state AdminState
+	switch action {
+	case "drain":
+		state = AdminDraining
+	case "disable":
+		state = AdminDisabled
+	case "enable":
+		state = AdminEnabled
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown backend action %q.", action))
+		return
+	}
+
+	var request AdminStateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body. %v", err))
+			return
+		}
+	}
+
+	var duration time.Duration
+	if len(request.Duration) != 0 {
+		d, err := time.ParseDuration(request.Duration)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid duration %q.", request.Duration))
+			return
+		}
+		duration = d
+	}
+
+	result := make(chan error, 1)
+	select {
+	case sag.eventStream <- SetBackendAdminStateEvent{
+		ServiceId: serviceId,
+		BackendId: backendId,
+		State:     state,
+		Reason:    request.Reason,
+		Duration:  duration,
+		Result:    result,
+	}:
+	case <-sag.quit:
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return
+	}
+
+	if err := <-result; err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	sag.writeBackend(w, serviceId, backendId)
+}
+
+func (sag *ServiceApplicationGateway) getRouters(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	views := make([]*RouterView, 0)
+	if !sag.inspect(func() {
+		for _, router := range sag.HttpRouters {
+			views = append(views, &RouterView{
+				Id:       router.Id,
+				Protocol: router.Protocol(),
+				Address:  router.Address(),
+				Routing:  router.Routing,
+			})
+		}
+		for _, router := range sag.TcpRouters {
+			views = append(views, &RouterView{
+				Id:       router.ListenAddr,
+				Protocol: "tcp",
+				Address:  router.ListenAddr,
+			})
+		}
+	}) {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (sag *ServiceApplicationGateway) getDiscoveries(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var discoveries []Discovery
+	if !sag.inspect(func() { discoveries = sag.Discoveries }) {
+		writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+		return
+	}
+
+	statuses := make([]DiscoveryStatus, 0, len(discoveries))
+	for _, sd := range discoveries {
+		statuses = append(statuses, sd.Status())
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// getEvents serves the state changes after the given event ID, waiting for
+// up to the given duration for new ones if there are none yet.
+func (sag *ServiceApplicationGateway) getEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var since uint64
+	if value := r.FormValue("since"); len(value) != 0 {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid event ID %q.", value))
+			return
+		}
+		since = id
+	}
+
+	var wait time.Duration
+	if value := r.FormValue("wait"); len(value) != 0 {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > maxEventsWait {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid wait duration %q.", value))
+			return
+		}
+		wait = d
+	}
+
+	changed := sag.Journal.Changed()
+	events, complete := sag.Journal.Since(since)
+
+	if len(events) == 0 && complete && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+		events, complete = sag.Journal.Since(since)
+	}
+
+	lastId := since
+	if n := len(events); n != 0 {
+		lastId = events[n-1].Id
+	} else if !complete {
+		// the client is ahead of us, such as after sag was restarted
+		lastId = sag.Journal.LastId()
+	}
+
+	if events == nil {
+		events = make([]JournalEntry, 0)
+	}
+
+	writeJSON(w, http.StatusOK, &EventsView{
+		LastEventId: lastId,
+		Complete:    complete,
+		Events:      events,
+	})
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %v not allowed.", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+	w.Write([]byte("\n"))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
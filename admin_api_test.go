@@ -0,0 +1,70 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminApiListsTcpServices(t *testing.T) {
+	sag := &ServiceApplicationGateway{
+		eventStream:  make(chan interface{}),
+		quit:         make(chan struct{}),
+		HttpServices: make(map[string]*HttpService),
+		TcpServices:  make(map[string]*TcpService),
+		Journal:      NewEventJournal(16),
+	}
+	go sag.ProcessEvents()
+	defer sag.Quit()
+
+	web := NewHttpService("/web", SchedulerRoundRobin, []string{"example.com"})
+	web.AddBackend("web.1", "127.0.0.1", 10000, 0, 1, true)
+	db := NewTcpService("/db", SchedulerLeastLoad, ProxyProtocolV2)
+	db.DrainTimeout = time.Minute
+	db.AddBackend("db.1", "127.0.0.1", 5432, 10, true)
+	sag.inspect(func() {
+		sag.HttpServices[web.ServiceId] = web
+		sag.TcpServices[db.ServiceId] = db
+	})
+
+	get := func(path string, v interface{}) {
+		w := httptest.NewRecorder()
+		sag.AdminHandler(w, httptest.NewRequest("GET", adminApiPrefix+path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %v: unexpected status %v. %v", path, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var services []map[string]interface{}
+	get("/services", &services)
+	if len(services) != 2 || services[0]["id"] != "/web" || services[0]["protocol"] != "http" ||
+		services[1]["id"] != "/db" || services[1]["protocol"] != "tcp" {
+		t.Fatalf("Unexpected services %+v.", services)
+	}
+
+	var service TcpServiceView
+	get("/services/db", &service)
+	if service.Scheduler != SchedulerLeastLoad || service.ProxyProtocol != ProxyProtocolV2 ||
+		service.DrainTimeout != "1m0s" || len(service.Backends) != 1 {
+		t.Fatalf("Unexpected TCP service %+v.", service)
+	}
+
+	var backend TcpBackendView
+	get("/services/db/backends/db.1", &backend)
+	if backend.Address != "127.0.0.1:5432" || backend.Capacity != 10 || !backend.Available {
+		t.Fatalf("Unexpected TCP backend %+v.", backend)
+	}
+}
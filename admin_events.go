@@ -0,0 +1,153 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// eventStreamKeepAlive is the interval at which comments are sent to
+	// idle event stream clients, keeping proxies from closing the stream.
+	eventStreamKeepAlive = 15 * time.Second
+
+	// eventStreamRetry is the reconnect delay suggested to clients.
+	eventStreamRetry = 3 * time.Second
+
+	// SnapshotEventType is the type of the event carrying the full state,
+	// sent first to newly connected clients that cannot resume.
+	SnapshotEventType = "snapshot"
+)
+
+// SnapshotView is the full routing state at the time of a journal entry.
+type SnapshotView struct {
+	LastEventId uint64         `json:"lastEventId"`
+	Services    []*ServiceView `json:"services"`
+}
+
+// acceptsEventStream tests whether the client asks for Server-Sent Events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEvents re-publishes the gateway's state changes as Server-Sent Events.
+//
+// Clients resuming with a Last-Event-ID still in the journal receive the
+// missed state changes. Any other client first receives a snapshot of the
+// whole state, followed by all state changes after it.
+func (sag *ServiceApplicationGateway) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported.")
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if len(lastEventId) == 0 {
+		lastEventId = r.FormValue("lastEventId")
+	}
+
+	var snapshot *SnapshotView
+	var since uint64
+	resumed := false
+
+	if id, err := strconv.ParseUint(lastEventId, 10, 64); err == nil {
+		if _, complete := sag.Journal.Since(id); complete {
+			since = id
+			resumed = true
+		}
+	}
+
+	if !resumed {
+		snapshot = &SnapshotView{Services: make([]*ServiceView, 0)}
+		if !sag.inspect(func() {
+			for _, serviceId := range sag.getHttpServiceIds() {
+				snapshot.Services = append(snapshot.Services, newServiceView(sag.HttpServices[serviceId]))
+			}
+			// no state changes can be journaled while being inspected
+			snapshot.LastEventId = sag.Journal.LastId()
+		}) {
+			writeError(w, http.StatusServiceUnavailable, "Shutting down.")
+			return
+		}
+		since = snapshot.LastEventId
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %v\n\n", int64(eventStreamRetry/time.Millisecond))
+
+	if snapshot != nil {
+		if err := writeServerSentEvent(w, since, SnapshotEventType, snapshot); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		changed := sag.Journal.Changed()
+		entries, complete := sag.Journal.Since(since)
+
+		if !complete {
+			// the client fell too far behind to catch up
+			return
+		}
+
+		for i := range entries {
+			if err := writeServerSentEvent(w, entries[i].Id, entries[i].Type, &entries[i]); err != nil {
+				return
+			}
+			since = entries[i].Id
+		}
+		if len(entries) != 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-sag.quit:
+			return
+		}
+	}
+}
+
+// writeServerSentEvent writes a single event with the given value as JSON.
+func writeServerSentEvent(w http.ResponseWriter, id uint64, eventType string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", id, eventType, data)
+	return err
+}
@@ -0,0 +1,102 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type AdminState string
+
+const (
+	// AdminEnabled leaves the backend's availability up to its health.
+	AdminEnabled = AdminState("enabled")
+
+	// AdminDraining keeps the backend from receiving new requests, except
+	// those of clients bound to it via sticky sessions.
+	AdminDraining = AdminState("draining")
+
+	// AdminDisabled keeps the backend from receiving any new requests.
+	AdminDisabled = AdminState("disabled")
+)
+
+func ParseAdminState(s string) (AdminState, error) {
+	switch state := AdminState(s); state {
+	case AdminEnabled, AdminDraining, AdminDisabled:
+		return state, nil
+	default:
+		return "", fmt.Errorf("Unknown admin state %q.", s)
+	}
+}
+
+// AdminOverride is a backend state manually set by an operator, overriding
+// the state reported by service discovery until it expires.
+type AdminOverride struct {
+	State  AdminState `json:"state"`
+	Reason string     `json:"reason,omitempty"`
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+func (o *AdminOverride) isExpired(now time.Time) bool {
+	return o.Until != nil && now.After(*o.Until)
+}
+
+// GetAdminOverride returns the backend's active admin override, if any.
+func (backend *HttpBackend) GetAdminOverride() *AdminOverride {
+	override, _ := backend.adminOverride.Load().(*AdminOverride)
+	if override == nil || override.isExpired(time.Now()) {
+		return nil
+	}
+	return override
+}
+
+// SetAdminState overrides the backend's state for the given duration
+// (forever if 0). Enabling the backend clears any override.
+func (backend *HttpBackend) SetAdminState(state AdminState, reason string, duration time.Duration) {
+	if state == AdminEnabled {
+		backend.adminOverride.Store((*AdminOverride)(nil))
+		log.Printf("Backend %v is enabled. %v", backend, reason)
+		return
+	}
+
+	override := &AdminOverride{
+		State:  state,
+		Reason: reason,
+		Since:  time.Now(),
+	}
+	if duration > 0 {
+		until := override.Since.Add(duration)
+		override.Until = &until
+	}
+
+	backend.adminOverride.Store(override)
+
+	if override.Until != nil {
+		log.Printf("Backend %v is %v until %v. %v", backend, state, override.Until.Format(time.RFC3339), reason)
+	} else {
+		log.Printf("Backend %v is %v. %v", backend, state, reason)
+	}
+}
+
+// getAdminState returns the backend's effective admin state.
+func (backend *HttpBackend) getAdminState() AdminState {
+	if override := backend.GetAdminOverride(); override != nil {
+		return override.State
+	}
+	return AdminEnabled
+}
+
+// acceptsSticky tests whether the backend can take another request of a
+// client bound to it via sticky sessions.
+func (backend *HttpBackend) acceptsSticky() bool {
+	return backend.getAdminState() != AdminDisabled && backend.canServe()
+}
@@ -0,0 +1,516 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+// sagctl is the command line client to sag's admin API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+const usage = `Usage: sagctl <command> [flags] [arguments]
+
+Commands:
+  services                       List all services
+  backends <service>             List the backends of a service
+  drain <service> <backend>      Stop sending new requests to a backend, except sticky ones
+  disable <service> <backend>    Stop sending any new requests to a backend
+  enable <service> <backend>     Revert a backend's drain or disable
+  routes                         List all routers
+  listeners                      List all listening sockets
+  discoveries                    List all service discoveries
+  events                         List recent state changes (--follow to keep watching)
+
+Run "sagctl <command> --help" for the command's flags.
+`
+
+// Client talks to sag's admin API.
+type Client struct {
+	BaseURL string
+	Http    *http.Client
+}
+
+// Error is a failed admin API request.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%v (HTTP %v)", err.Message, err.StatusCode)
+}
+
+func (client *Client) Do(method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonBlob, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsonBlob)
+	}
+
+	request, err := http.NewRequest(method, client.BaseURL+"/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.Http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	output, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(output, &message) != nil || len(message.Message) == 0 {
+			message.Message = strings.TrimSpace(string(output))
+		}
+		return &Error{StatusCode: response.StatusCode, Message: message.Message}
+	}
+
+	if result != nil {
+		if err = json.Unmarshal(output, result); err != nil {
+			return fmt.Errorf("Could not unmarshal JSON response. %v", err)
+		}
+	}
+
+	return nil
+}
+
+type Service struct {
+	Id        string     `json:"id"`
+	Scheduler string     `json:"scheduler"`
+	Hosts     []string   `json:"hosts"`
+	Backends  []*Backend `json:"backends"`
+}
+
+type Backend struct {
+	Id          string `json:"id"`
+	Address     string `json:"address"`
+	Weight      int    `json:"weight"`
+	Load        int    `json:"load"`
+	Alive       bool   `json:"alive"`
+	Available   bool   `json:"available"`
+	Ejected     bool   `json:"ejected"`
+	Removed     bool   `json:"removed"`
+	AdminState  string `json:"adminState"`
+	ServedTotal uint64 `json:"servedTotal"`
+	Latency     string `json:"latency"`
+	Admin       *struct {
+		Reason string     `json:"reason"`
+		Until  *time.Time `json:"until"`
+	} `json:"admin,omitempty"`
+}
+
+type Router struct {
+	Id       string `json:"id"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Routing  string `json:"routing"`
+}
+
+type Discovery struct {
+	Type        string     `json:"type"`
+	Source      string     `json:"source"`
+	Connected   bool       `json:"connected"`
+	LastEventId string     `json:"lastEventId"`
+	LastEventAt *time.Time `json:"lastEventAt"`
+	Reconnects  uint64     `json:"reconnects"`
+}
+
+type Event struct {
+	Id        uint64          `json:"id"`
+	Time      time.Time       `json:"time"`
+	Type      string          `json:"type"`
+	ServiceId string          `json:"serviceId"`
+	BackendId string          `json:"backendId"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type Events struct {
+	LastEventId uint64   `json:"lastEventId"`
+	Complete    bool     `json:"complete"`
+	Events      []*Event `json:"events"`
+}
+
+// Command is a sagctl subcommand.
+type Command struct {
+	Flags   *flag.FlagSet
+	Client  *Client
+	JSON    bool
+	Out     io.Writer
+	Args    []string
+	MinArgs int
+	MaxArgs int
+	Run     func(cmd *Command) error
+}
+
+// table writes the given rows as an aligned table.
+func (cmd *Command) table(header string, rows [][]interface{}) {
+	w := tabwriter.NewWriter(cmd.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = fmt.Sprint(cell)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+}
+
+func (cmd *Command) printJSON(v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Out, "%s\n", bytes)
+	return nil
+}
+
+// serviceIdArg returns the given service ID, as in "/app-0" or "app-0".
+func serviceIdArg(arg string) string {
+	return "/" + strings.TrimPrefix(arg, "/")
+}
+
+func runServices(cmd *Command) error {
+	var services []*Service
+	if err := cmd.Client.Do("GET", "/services", nil, &services); err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return cmd.printJSON(services)
+	}
+
+	rows := make([][]interface{}, 0, len(services))
+	for _, s := range services {
+		available := 0
+		for _, b := range s.Backends {
+			if b.Available {
+				available++
+			}
+		}
+		rows = append(rows, []interface{}{
+			s.Id, s.Scheduler, orDash(strings.Join(s.Hosts, ",")),
+			fmt.Sprintf("%v/%v", available, len(s.Backends)),
+		})
+	}
+	cmd.table("SERVICE\tSCHEDULER\tHOSTS\tAVAILABLE", rows)
+	return nil
+}
+
+func runBackends(cmd *Command) error {
+	var backends []*Backend
+	if err := cmd.Client.Do("GET", "/services"+serviceIdArg(cmd.Args[0])+"/backends", nil, &backends); err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return cmd.printJSON(backends)
+	}
+
+	rows := make([][]interface{}, 0, len(backends))
+	for _, b := range backends {
+		rows = append(rows, []interface{}{
+			b.Id, b.Address, b.Weight, b.Load, backendState(b), b.AdminState, adminReason(b), b.ServedTotal, b.Latency,
+		})
+	}
+	cmd.table("BACKEND\tADDRESS\tWEIGHT\tLOAD\tSTATE\tADMIN\tREASON\tSERVED\tLATENCY", rows)
+	return nil
+}
+
+func backendState(b *Backend) string {
+	switch {
+	case b.Removed:
+		return "removed"
+	case !b.Alive:
+		return "down"
+	case b.Ejected:
+		return "ejected"
+	case b.Available:
+		return "up"
+	default:
+		return "unavailable"
+	}
+}
+
+func adminReason(b *Backend) string {
+	if b.Admin == nil {
+		return "-"
+	}
+
+	reason := orDash(b.Admin.Reason)
+	if b.Admin.Until != nil {
+		reason += fmt.Sprintf(" (until %v)", b.Admin.Until.Local().Format(time.RFC3339))
+	}
+	return reason
+}
+
+// newAdminStateCommand creates the command to drain, disable or enable
+// a backend.
+func newAdminStateCommand(action string, reason, duration *string) func(cmd *Command) error {
+	return func(cmd *Command) error {
+		body := map[string]string{"reason": *reason, "duration": *duration}
+		path := fmt.Sprintf("/services%v/backends/%v/%v", serviceIdArg(cmd.Args[0]), cmd.Args[1], action)
+
+		var backend Backend
+		if err := cmd.Client.Do("POST", path, body, &backend); err != nil {
+			return err
+		}
+
+		if cmd.JSON {
+			return cmd.printJSON(&backend)
+		}
+
+		fmt.Fprintf(cmd.Out, "Backend %v of %v is %v.\n", backend.Id, serviceIdArg(cmd.Args[0]), backend.AdminState)
+		return nil
+	}
+}
+
+func runRoutes(cmd *Command) error {
+	var routers []*Router
+	if err := cmd.Client.Do("GET", "/routers", nil, &routers); err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return cmd.printJSON(routers)
+	}
+
+	rows := make([][]interface{}, 0, len(routers))
+	for _, r := range routers {
+		rows = append(rows, []interface{}{r.Id, r.Protocol, r.Address, orDash(r.Routing)})
+	}
+	cmd.table("ROUTER\tPROTOCOL\tADDRESS\tROUTING", rows)
+	return nil
+}
+
+func runListeners(cmd *Command) error {
+	var listeners []string
+	if err := cmd.Client.Do("GET", "/listeners", nil, &listeners); err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return cmd.printJSON(listeners)
+	}
+
+	rows := make([][]interface{}, 0, len(listeners))
+	for _, l := range listeners {
+		rows = append(rows, []interface{}{l})
+	}
+	cmd.table("ADDRESS", rows)
+	return nil
+}
+
+func runDiscoveries(cmd *Command) error {
+	var discoveries []*Discovery
+	if err := cmd.Client.Do("GET", "/discoveries", nil, &discoveries); err != nil {
+		return err
+	}
+
+	if cmd.JSON {
+		return cmd.printJSON(discoveries)
+	}
+
+	rows := make([][]interface{}, 0, len(discoveries))
+	for _, d := range discoveries {
+		lastEvent := "-"
+		if d.LastEventAt != nil {
+			lastEvent = d.LastEventAt.Local().Format(time.RFC3339)
+		}
+		rows = append(rows, []interface{}{d.Type, d.Source, d.Connected, d.Reconnects, lastEvent})
+	}
+	cmd.table("TYPE\tSOURCE\tCONNECTED\tRECONNECTS\tLAST EVENT", rows)
+	return nil
+}
+
+// newEventsCommand creates the command listing the recent state changes,
+// and optionally keeps following them.
+func newEventsCommand(follow *bool) func(cmd *Command) error {
+	return func(cmd *Command) error {
+		var since uint64
+		for {
+			path := fmt.Sprintf("/events?since=%v", since)
+			if *follow {
+				path += "&wait=60s"
+			}
+
+			var events Events
+			if err := cmd.Client.Do("GET", path, nil, &events); err != nil {
+				return err
+			}
+
+			if !events.Complete && since != 0 {
+				fmt.Fprintf(os.Stderr, "sagctl: some events were missed\n")
+			}
+
+			for _, event := range events.Events {
+				cmd.printEvent(event)
+			}
+
+			if !*follow {
+				return nil
+			}
+
+			since = events.LastEventId
+		}
+	}
+}
+
+func (cmd *Command) printEvent(event *Event) {
+	if cmd.JSON {
+		bytes, _ := json.Marshal(event)
+		fmt.Fprintf(cmd.Out, "%s\n", bytes)
+		return
+	}
+
+	var data bytes.Buffer
+	if len(event.Data) != 0 && string(event.Data) != "null" {
+		json.Compact(&data, event.Data)
+	}
+
+	fmt.Fprintf(cmd.Out, "%v %v %v %v %v %v\n",
+		event.Id, event.Time.Local().Format(time.RFC3339), event.Type,
+		event.ServiceId, orDash(event.BackendId), data.String())
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func newCommand(name string, minArgs, maxArgs int) *Command {
+	return &Command{
+		Flags:   flag.NewFlagSet(name, flag.ContinueOnError),
+		Out:     os.Stdout,
+		MinArgs: minArgs,
+		MaxArgs: maxArgs,
+	}
+}
+
+func makeCommand(name string) *Command {
+	switch name {
+	case "services":
+		cmd := newCommand(name, 0, 0)
+		cmd.Run = runServices
+		return cmd
+	case "backends":
+		cmd := newCommand(name, 1, 1)
+		cmd.Run = runBackends
+		return cmd
+	case "drain", "disable", "enable":
+		cmd := newCommand(name, 2, 2)
+		reason := cmd.Flags.String("reason", "", "Reason to record for the change")
+		duration := cmd.Flags.String("for", "", "Duration after which the change expires, such as 15m (forever if empty)")
+		cmd.Run = newAdminStateCommand(name, reason, duration)
+		return cmd
+	case "routes", "routers":
+		cmd := newCommand(name, 0, 0)
+		cmd.Run = runRoutes
+		return cmd
+	case "listeners":
+		cmd := newCommand(name, 0, 0)
+		cmd.Run = runListeners
+		return cmd
+	case "discoveries":
+		cmd := newCommand(name, 0, 0)
+		cmd.Run = runDiscoveries
+		return cmd
+	case "events":
+		cmd := newCommand(name, 0, 0)
+		follow := cmd.Flags.Bool("follow", false, "Keep watching for new events")
+		cmd.Run = newEventsCommand(follow)
+		return cmd
+	default:
+		return nil
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "--help" || os.Args[1] == "-h" {
+		fmt.Fprint(os.Stderr, usage)
+		if len(os.Args) < 2 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	cmd := makeCommand(os.Args[1])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "sagctl: unknown command %q\n\n%v", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	defaultAddr := os.Getenv("SAG_ADMIN_URL")
+	if len(defaultAddr) == 0 {
+		defaultAddr = "http://127.0.0.1:8081"
+	}
+	addr := cmd.Flags.String("addr", defaultAddr, "URL of sag's debug port (or $SAG_ADMIN_URL)")
+	output := cmd.Flags.String("output", "table", "Output format (table, json)")
+	timeout := cmd.Flags.Duration("timeout", 10*time.Second, "Timeout of each request (not applied to events)")
+
+	if err := cmd.Flags.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	cmd.Args = cmd.Flags.Args()
+	if len(cmd.Args) < cmd.MinArgs || len(cmd.Args) > cmd.MaxArgs {
+		fmt.Fprintf(os.Stderr, "sagctl: wrong number of arguments for %v\n\n%v", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	switch *output {
+	case "table":
+	case "json":
+		cmd.JSON = true
+	default:
+		fmt.Fprintf(os.Stderr, "sagctl: unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+
+	httpClient := &http.Client{Timeout: *timeout}
+	if os.Args[1] == "events" {
+		httpClient.Timeout = 0
+	}
+	cmd.Client = &Client{
+		BaseURL: strings.TrimSuffix(*addr, "/"),
+		Http:    httpClient,
+	}
+
+	if err := cmd.Run(cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "sagctl: %v\n", err)
+		os.Exit(1)
+	}
+}
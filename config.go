@@ -0,0 +1,413 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	flag "github.com/ogier/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DiscoveryTypeMarathon is the type of the Marathon service discovery.
+	DiscoveryTypeMarathon = "marathon"
+
+	// envPrefix prefixes the environment variables overriding command line
+	// options, such as SAG_HTTP_VHOST_PORT for --http-vhost-port.
+	envPrefix = "SAG_"
+
+	// AllServices keys the header rules applying to all services.
+	AllServices = "*"
+)
+
+// Config is the declarative configuration of sag, as read from its
+// configuration file.
+type Config struct {
+	Listeners     []ListenerConfig             `yaml:"listeners"`
+	ServiceIP     string                       `yaml:"service_ip"` // IP to bind service ports to
+	Discoveries   []DiscoveryConfig            `yaml:"discoveries"`
+	Scheduler     SchedulingAlgorithm          `yaml:"scheduler"` // default scheduler of services
+	StickySecret  string                       `yaml:"sticky_secret,omitempty"`
+	ProxyProtocol ProxyProtocolConfig          `yaml:"proxy_protocol"`
+	Forwarding    ForwardingConfig             `yaml:"forwarding"`
+	HeaderRules   map[string]map[string]string `yaml:"header_rules"` // by service ID, or "*" for all services
+	Timeouts      TimeoutsConfig               `yaml:"timeouts"`
+	Logging       LoggingConfig                `yaml:"logging"`
+	Admin         AdminConfig                  `yaml:"admin"`
+}
+
+// ListenerConfig configures an HTTP vhost router.
+type ListenerConfig struct {
+	Address     string     `yaml:"address"` // such as 0.0.0.0:8080
+	TLS         *TLSConfig `yaml:"tls,omitempty"`
+	AcceptProxy bool       `yaml:"accept_proxy"` // expect PROXY protocol headers from trusted sources
+}
+
+// TLSConfig configures TLS termination on a listener.
+type TLSConfig struct {
+	Certificates []CertificateConfig `yaml:"certificates"`
+}
+
+// CertificateConfig refers to a PEM encoded certificate and its key.
+type CertificateConfig struct {
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+}
+
+// DiscoveryConfig configures a service discovery source.
+type DiscoveryConfig struct {
+	Type           string   `yaml:"type"`
+	Address        string   `yaml:"address"` // such as 127.0.0.1:8080
+	ReconnectDelay Duration `yaml:"reconnect_delay"`
+}
+
+// ProxyProtocolConfig configures accepting PROXY protocol headers on the
+// listeners and service ports where enabled.
+type ProxyProtocolConfig struct {
+	TrustedSources []string `yaml:"trusted_sources"` // IPs or CIDRs, no source if empty
+	ReadTimeout    Duration `yaml:"read_timeout"`
+}
+
+// Policy returns the policy for accepting PROXY protocol headers.
+func (c *ProxyProtocolConfig) Policy() (*ProxyProtocolPolicy, error) {
+	return NewProxyProtocolPolicy(c.TrustedSources, time.Duration(c.ReadTimeout))
+}
+
+// ForwardingConfig configures the forwarding headers passed on to the
+// HTTP backends.
+type ForwardingConfig struct {
+	Mode           ForwardingMode `yaml:"mode"`            // append or replace
+	TrustedProxies []string       `yaml:"trusted_proxies"` // IPs or CIDRs whose forwarding headers are kept
+	Forwarded      bool           `yaml:"forwarded"`       // emit the RFC 7239 Forwarded header
+}
+
+// Policy returns the policy for passing on forwarding headers.
+func (c *ForwardingConfig) Policy() (*ForwardingPolicy, error) {
+	return NewForwardingPolicy(c.Mode, c.TrustedProxies, c.Forwarded)
+}
+
+type TimeoutsConfig struct {
+	Drain    Duration `yaml:"drain"`    // default time to let removed backends finish
+	Shutdown Duration `yaml:"shutdown"` // time to let active sessions finish upon shutdown
+}
+
+type LoggingConfig struct {
+	AccessLog       string          `yaml:"access_log"` // "-" for stdout, disabled if empty
+	AccessLogFormat AccessLogFormat `yaml:"access_log_format"`
+	AccessLogSample float64         `yaml:"access_log_sample"`
+}
+
+type AdminConfig struct {
+	Address string `yaml:"address"` // such as :8081, disabled if empty
+}
+
+// Duration is a time.Duration written as string, such as "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(value)
+	return nil
+}
+
+// DefaultConfig returns the configuration being used without any
+// configuration file, environment variables or command line options.
+func DefaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{
+			{Address: "0.0.0.0:8080"},
+		},
+		ServiceIP: "0.0.0.0",
+		Discoveries: []DiscoveryConfig{
+			{Type: DiscoveryTypeMarathon, Address: "127.0.0.1:8080", ReconnectDelay: Duration(time.Second)},
+		},
+		Scheduler: SchedulerLeastLoad,
+		ProxyProtocol: ProxyProtocolConfig{
+			ReadTimeout: Duration(5 * time.Second),
+		},
+		Forwarding: ForwardingConfig{
+			Mode:      ForwardingAppend,
+			Forwarded: true,
+		},
+		Timeouts: TimeoutsConfig{
+			Drain:    Duration(30 * time.Second),
+			Shutdown: Duration(30 * time.Second),
+		},
+		Logging: LoggingConfig{
+			AccessLogFormat: AccessLogCommon,
+			AccessLogSample: 1.0,
+		},
+	}
+}
+
+// LoadConfig reads the given configuration file on top of the defaults.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse %v. %v", path, err)
+	}
+
+	for i := range cfg.Discoveries {
+		if cfg.Discoveries[i].ReconnectDelay == 0 {
+			cfg.Discoveries[i].ReconnectDelay = Duration(time.Second)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration for errors, including whether or not
+// the TLS certificates can be loaded.
+func (cfg *Config) Validate() error {
+	seen := make(map[string]bool)
+	for _, listener := range cfg.Listeners {
+		if err := validateAddress(listener.Address); err != nil {
+			return fmt.Errorf("Invalid listener address %q. %v", listener.Address, err)
+		}
+		address := canonicalAddress(listener.Address)
+		if seen[address] {
+			return fmt.Errorf("Duplicate listener address %q.", listener.Address)
+		}
+		seen[address] = true
+
+		if listener.AcceptProxy && len(cfg.ProxyProtocol.TrustedSources) == 0 {
+			return fmt.Errorf("Listener %v accepts PROXY protocol headers without any trusted sources.", listener.Address)
+		}
+
+		if listener.TLS != nil {
+			if _, err := listener.TLS.Load(); err != nil {
+				return fmt.Errorf("Invalid TLS configuration for listener %v. %v", listener.Address, err)
+			}
+		}
+	}
+
+	if net.ParseIP(cfg.ServiceIP) == nil {
+		return fmt.Errorf("Invalid service IP %q.", cfg.ServiceIP)
+	}
+
+	discoveries := make(map[DiscoveryConfig]bool)
+	for _, discovery := range cfg.Discoveries {
+		if discoveries[discovery] {
+			return fmt.Errorf("Duplicate %v discovery %q.", discovery.Type, discovery.Address)
+		}
+		discoveries[discovery] = true
+
+		if discovery.Type != DiscoveryTypeMarathon {
+			return fmt.Errorf("Unknown discovery type %q.", discovery.Type)
+		}
+		if err := validateAddress(discovery.Address); err != nil {
+			return fmt.Errorf("Invalid %v discovery address %q. %v", discovery.Type, discovery.Address, err)
+		}
+		if discovery.ReconnectDelay < 0 {
+			return fmt.Errorf("Invalid reconnect delay %v.", time.Duration(discovery.ReconnectDelay))
+		}
+	}
+
+	switch cfg.Scheduler {
+	case SchedulerRoundRobin, SchedulerLeastLoad, SchedulerChance, SchedulerWeightedRoundRobin,
+		SchedulerP2C, SchedulerPeakEwma, SchedulerHash:
+	default:
+		return fmt.Errorf("Unknown scheduler %q.", cfg.Scheduler)
+	}
+
+	if _, err := cfg.ProxyProtocol.Policy(); err != nil {
+		return err
+	}
+
+	if _, err := cfg.Forwarding.Policy(); err != nil {
+		return err
+	}
+
+	for serviceId, labels := range cfg.HeaderRules {
+		if _, err := ParseHeaderRules(labels); err != nil {
+			return fmt.Errorf("Invalid header rules for %v. %v", serviceId, err)
+		}
+	}
+
+	if cfg.Timeouts.Drain < 0 || cfg.Timeouts.Shutdown < 0 || cfg.ProxyProtocol.ReadTimeout < 0 {
+		return fmt.Errorf("Timeouts must not be negative.")
+	}
+
+	switch cfg.Logging.AccessLogFormat {
+	case AccessLogCommon, AccessLogJSON, AccessLogLogfmt:
+	default:
+		return fmt.Errorf("Unknown access log format %q.", cfg.Logging.AccessLogFormat)
+	}
+
+	if cfg.Logging.AccessLogSample < 0 || cfg.Logging.AccessLogSample > 1 {
+		return fmt.Errorf("Access log sample rate must be between 0 and 1.")
+	}
+
+	if len(cfg.Admin.Address) != 0 {
+		if err := validateAddress(cfg.Admin.Address); err != nil {
+			return fmt.Errorf("Invalid admin address %q. %v", cfg.Admin.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// Load loads all certificates into a TLS server configuration.
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	if len(c.Certificates) == 0 {
+		return nil, fmt.Errorf("No certificates configured.")
+	}
+
+	config := &tls.Config{}
+	for _, cert := range c.Certificates {
+		keyPair, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, keyPair)
+	}
+	config.BuildNameToCertificate()
+
+	return config, nil
+}
+
+// String returns the configuration as YAML, hiding any secrets.
+func (cfg *Config) String() string {
+	redacted := *cfg
+	if len(redacted.StickySecret) != 0 {
+		redacted.StickySecret = "(redacted)"
+	}
+
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(data)
+}
+
+// setHttpVhostAddress replaces the host or port of the first listener,
+// adding one if there is none.
+func (cfg *Config) setHttpVhostAddress(host, port string) {
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []ListenerConfig{{Address: "0.0.0.0:8080"}}
+	}
+	cfg.Listeners[0].Address = replaceHostPort(cfg.Listeners[0].Address, host, port)
+}
+
+// setMarathonAddress replaces the host or port of the first Marathon
+// discovery, adding one if there is none.
+func (cfg *Config) setMarathonAddress(host, port string) {
+	for i := range cfg.Discoveries {
+		if cfg.Discoveries[i].Type == DiscoveryTypeMarathon {
+			cfg.Discoveries[i].Address = replaceHostPort(cfg.Discoveries[i].Address, host, port)
+			return
+		}
+	}
+
+	cfg.Discoveries = append(cfg.Discoveries, DiscoveryConfig{
+		Type:           DiscoveryTypeMarathon,
+		Address:        replaceHostPort("127.0.0.1:8080", host, port),
+		ReconnectDelay: Duration(time.Second),
+	})
+}
+
+// replaceHostPort replaces the non-empty parts of the given address.
+func replaceHostPort(address, host, port string) string {
+	h, p, err := net.SplitHostPort(address)
+	if err != nil {
+		h, p = address, ""
+	}
+	if len(host) != 0 {
+		h = host
+	}
+	if len(port) != 0 {
+		p = port
+	}
+
+	return net.JoinHostPort(h, p)
+}
+
+// canonicalAddress returns the given listener address as listened on,
+// such as 0.0.0.0:8080 for :8080.
+func canonicalAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if len(host) != 0 && net.ParseIP(host) == nil {
+		return fmt.Errorf("Invalid IP %q.", host)
+	}
+
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("Invalid port %q.", port)
+	}
+
+	return nil
+}
+
+// applyEnvironment sets all command line options not given on the command
+// line from their environment variables, such as SAG_DEBUG_PORT for
+// --debug-port.
+func applyEnvironment() error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if e := flag.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("Invalid value %q for %v. %v", value, name, e)
+			}
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,217 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net/http"
+)
+
+// DashboardHandler serves the web dashboard, a single page rendering the
+// routing state from the admin API. It refreshes periodically, computing
+// request rates from the backends' served totals, and upon any state change
+// published on the admin API's event stream, at most twice a second.
+func (sag *ServiceApplicationGateway) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(dashboardHtml))
+}
+
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>sag dashboard</title>
+<style>
+  body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; color: #222; }
+  h1 { font-size: 20px; }
+  h2 { font-size: 16px; margin-top: 1.5em; }
+  table { border-collapse: collapse; margin-bottom: 1em; }
+  th, td { text-align: left; padding: 3px 10px; border-bottom: 1px solid #ddd; }
+  th { background: #f4f4f4; }
+  td.num { text-align: right; font-variant-numeric: tabular-nums; }
+  .service { font-weight: bold; background: #fafafa; }
+  .up { color: #080; }
+  .down, .ejected { color: #c00; }
+  .draining, .disabled, .removed { color: #c60; }
+  #status { color: #888; }
+  button { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>sag dashboard <span id="status"></span></h1>
+
+<h2>Services</h2>
+<table>
+  <thead>
+    <tr><th>Service / Backend</th><th>Address</th><th>Vhosts / State</th><th>Admin</th>
+        <th>Weight</th><th>Load</th><th>Req/s</th><th>Latency</th><th></th></tr>
+  </thead>
+  <tbody id="services"></tbody>
+</table>
+
+<h2>Listeners</h2>
+<table>
+  <thead><tr><th>Address</th><th>Router</th><th>Protocol</th><th>Routing</th></tr></thead>
+  <tbody id="listeners"></tbody>
+</table>
+
+<h2>Service Discovery</h2>
+<table>
+  <thead><tr><th>Type</th><th>Source</th><th>Connected</th><th>Reconnects</th><th>Last Event</th></tr></thead>
+  <tbody id="discoveries"></tbody>
+</table>
+
+<script>
+var api = "/v1";
+var refreshInterval = 2000;
+var minEventRefreshDelay = 500; // bursts of state changes refresh once
+var eventRefreshTimer = null;
+var lastEventRefresh = 0;
+var lastServed = {};   // served totals by backend, for computing rates
+var lastRefresh = 0;
+
+function esc(s) {
+  return String(s === undefined || s === null ? "" : s)
+    .replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+    .replace(/"/g, "&quot;").replace(/'/g, "&#39;");
+}
+
+function getJSON(path) {
+  return fetch(api + path, {headers: {"Accept": "application/json"}}).then(function(r) {
+    if (!r.ok) throw new Error(path + ": HTTP " + r.status);
+    return r.json();
+  });
+}
+
+function backendState(b) {
+  if (b.removed) return "removed";
+  if (!b.alive) return "down";
+  if (b.ejected) return "ejected";
+  if (b.adminState && b.adminState !== "enabled") return b.adminState;
+  return b.available ? "up" : "busy";
+}
+
+function renderServices(services, elapsed) {
+  var rows = [];
+  var served = {};
+  services.forEach(function(s) {
+    rows.push("<tr class='service'><td>" + esc(s.id) + "</td><td>" + esc(s.scheduler) +
+      "</td><td colspan='7'>" + esc((s.hosts || []).join(", ")) + "</td></tr>");
+    s.backends.forEach(function(b) {
+      var key = s.id + " " + b.id;
+      served[key] = b.servedTotal;
+      var rate = "";
+      if (elapsed > 0 && key in lastServed && b.servedTotal !== undefined) {
+        rate = ((b.servedTotal - lastServed[key]) / elapsed).toFixed(1);
+      }
+      var state = backendState(b);
+      var admin = b.admin ? b.admin.state + (b.admin.reason ? ": " + b.admin.reason : "") : "";
+      var action = b.adminState === "enabled"
+        ? "<button data-action='drain'>drain</button>"
+        : "<button data-action='enable'>enable</button>";
+      rows.push("<tr data-service='" + esc(s.id) + "' data-backend='" + esc(b.id) + "'>" +
+        "<td>&nbsp;&nbsp;" + esc(b.id) + "</td><td>" + esc(b.address) + "</td>" +
+        "<td class='" + state + "'>" + state + "</td><td>" + esc(admin) + "</td>" +
+        "<td class='num'>" + esc(b.weight) + "</td><td class='num'>" + b.load + "</td>" +
+        "<td class='num'>" + rate + "</td><td class='num'>" + esc(b.latency) + "</td>" +
+        "<td>" + (b.removed || s.protocol === "tcp" ? "" : action) + "</td></tr>");
+    });
+  });
+  lastServed = served;
+  document.getElementById("services").innerHTML = rows.join("");
+}
+
+function renderListeners(listeners, routers) {
+  var byAddress = {};
+  routers.forEach(function(r) { byAddress[r.address] = r; });
+  document.getElementById("listeners").innerHTML = listeners.map(function(addr) {
+    var r = byAddress[addr] || {};
+    return "<tr><td>" + esc(addr) + "</td><td>" + esc(r.id) + "</td><td>" + esc(r.protocol) +
+      "</td><td>" + esc(r.routing) + "</td></tr>";
+  }).join("");
+}
+
+function renderDiscoveries(discoveries) {
+  document.getElementById("discoveries").innerHTML = discoveries.map(function(d) {
+    return "<tr><td>" + esc(d.type) + "</td><td>" + esc(d.source) + "</td>" +
+      "<td class='" + (d.connected ? "up" : "down") + "'>" + (d.connected ? "yes" : "no") + "</td>" +
+      "<td class='num'>" + d.reconnects + "</td><td>" + esc(d.lastEventAt || "") + "</td></tr>";
+  }).join("");
+}
+
+function refresh() {
+  return Promise.all([getJSON("/services"), getJSON("/listeners"), getJSON("/routers"), getJSON("/discoveries")])
+    .then(function(results) {
+      var now = Date.now();
+      var elapsed = lastRefresh ? (now - lastRefresh) / 1000 : 0;
+      lastRefresh = now;
+      renderServices(results[0], elapsed);
+      renderListeners(results[1], results[2]);
+      renderDiscoveries(results[3]);
+      document.getElementById("status").textContent = "updated " + new Date(now).toLocaleTimeString();
+    })
+    .catch(function(err) {
+      document.getElementById("status").textContent = "error: " + err.message;
+    });
+}
+
+// scheduleRefresh refreshes upon a state change, at most once per
+// minEventRefreshDelay, so that a burst of events, such as of a
+// deployment, does not flood the admin API with requests.
+function scheduleRefresh() {
+  if (eventRefreshTimer) return;
+  var delay = Math.max(0, lastEventRefresh + minEventRefreshDelay - Date.now());
+  eventRefreshTimer = setTimeout(function() {
+    eventRefreshTimer = null;
+    lastEventRefresh = Date.now();
+    refresh();
+  }, delay);
+}
+
+document.getElementById("services").addEventListener("click", function(e) {
+  var action = e.target.getAttribute("data-action");
+  if (!action) return;
+  var row = e.target.closest("tr");
+  var body = {};
+  if (action === "drain") {
+    var reason = prompt("Reason for draining " + row.getAttribute("data-backend") + ":", "");
+    if (reason === null) return;
+    body.reason = reason;
+  }
+  var path = api + "/services" + row.getAttribute("data-service") + "/backends/" +
+    encodeURIComponent(row.getAttribute("data-backend")) + "/" + action;
+  fetch(path, {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(body)})
+    .then(function(r) {
+      if (!r.ok) return r.json().then(function(e) { alert(e.message); });
+    })
+    .then(refresh);
+});
+
+// refresh upon any state change
+if (window.EventSource) {
+  var events = new EventSource(api + "/events");
+  events.onmessage = scheduleRefresh;
+  ["snapshot", "service_added", "service_removed", "backend_added", "backend_removed",
+   "backend_drained", "backend_health_changed", "backend_weight_changed",
+   "backend_admin_state_changed"].forEach(function(type) {
+    events.addEventListener(type, scheduleRefresh);
+  });
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
+</script>
+</body>
+</html>
+`
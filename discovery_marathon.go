@@ -9,12 +9,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/christianparpart/sag/marathon"
@@ -27,36 +29,86 @@ const (
 	LB_VHOST_DEFAULT_HTTP  = "lb-vhost-default"
 	LB_VHOST_HTTPS         = "lb-vhost-ssl"
 	LB_VHOST_DEFAULT_HTTPS = "lb-vhost-default-ssl"
+	LB_VHOST_ALIAS         = "lb-vhost-alias"
+	LB_REDIRECT_HTTPS      = "lb-redirect-https"
+	LB_REDIRECT_STATUS     = "lb-redirect-status"
 	LB_CAPACITY            = "lb-capacity"
+	LB_WEIGHT              = "lb-weight"
 	LB_SCHEDULER           = "lb-scheduler"
+	LB_HASH_KEY            = "lb-hash-key"
+	LB_STICKY_COOKIE       = "lb-sticky-cookie"
+	LB_DRAIN_TIMEOUT       = "lb-drain-timeout"
+	LB_SLOW_START          = "lb-slow-start"
+	LB_SLOW_START_CURVE    = "lb-slow-start-curve"
+	LB_READINESS           = "lb-readiness"
+	LB_MAX_RETRIES         = "lb-max-retries"
+	LB_EJECTION_THRESHOLD  = "lb-ejection-threshold"
+	LB_EJECTION_TIME       = "lb-ejection-time"
 )
 
 type Discovery interface {
 	Run()
 	Shutdown()
+	Status() DiscoveryStatus
 }
 
+// DiscoveryStatus describes the state of a service discovery.
+type DiscoveryStatus struct {
+	Type        string      `json:"type"`
+	Source      string      `json:"source"`
+	Connected   bool        `json:"connected"`
+	LastEventId string      `json:"lastEventId,omitempty"`
+	LastEventAt *time.Time  `json:"lastEventAt,omitempty"`
+	Reconnects  uint64      `json:"reconnects"`
+	Details     interface{} `json:"details,omitempty"`
+}
+
+const (
+	// refreshMinBackoff is the initial time to wait before retrying to fetch
+	// all apps, doubling with each failed attempt up to refreshMaxBackoff.
+	refreshMinBackoff = 500 * time.Millisecond
+	refreshMaxBackoff = 30 * time.Second
+)
+
 type DiscoveryMarathon struct {
-	DefaultScheduler SchedulingAlgorithm
+	AppCache         *MarathonAppCache
+	readiness        *ReadinessGate
 	marathonIP       net.IP
 	marathonPort     uint
+	marathon         *marathon.Service
+	ctx              context.Context
+	cancel           context.CancelFunc
 	portsMapCache    map[string]int
 	sse              *EventSource
 	eventStream      chan<- interface{}
+	defaultScheduler atomic.Value // SchedulingAlgorithm of apps without lb-scheduler label
 }
 
-func NewDiscoveryMarathon(host net.IP, port uint, reconnectDelay time.Duration, eventStream chan<- interface{}) *DiscoveryMarathon {
+func NewDiscoveryMarathon(host net.IP, port uint, reconnectDelay time.Duration, eventStream chan<- interface{}) (*DiscoveryMarathon, error) {
+	m, err := marathon.NewService(host, port)
+	if err != nil {
+		return nil, err
+	}
+
 	url := fmt.Sprintf("http://%v:%v/v2/events", host, port)
 	sse := NewEventSource(url, reconnectDelay)
+	m.OnRequest = observeMarathonRequest
+	ctx, cancel := context.WithCancel(context.Background())
 
 	sd := &DiscoveryMarathon{
-		marathonIP:       host,
-		marathonPort:     port,
-		portsMapCache:    make(map[string]int),
-		sse:              sse,
-		eventStream:      eventStream,
-		DefaultScheduler: SchedulerLeastLoad,
+		marathonIP:    host,
+		marathonPort:  port,
+		marathon:      m,
+		ctx:           ctx,
+		cancel:        cancel,
+		portsMapCache: make(map[string]int),
+		sse:           sse,
+		eventStream:   eventStream,
 	}
+	sd.defaultScheduler.Store(SchedulerLeastLoad)
+
+	sd.AppCache = NewMarathonAppCache(sd.getMarathonApp)
+	sd.readiness = NewReadinessGate(ctx, m, sd.onTaskReady)
 
 	sse.OnOpen = sd.onOpen
 	sse.OnError = sd.onError
@@ -76,7 +128,7 @@ func NewDiscoveryMarathon(host net.IP, port uint, reconnectDelay time.Duration,
 		sse.AddEventListener("instance_health_changed_event", ignore_event)
 	}
 
-	sse.AddEventListener("app_terminated_event", ignore_event) // sd.app_terminated_event)
+	sse.AddEventListener("app_terminated_event", sd.app_terminated_event)
 	sse.AddEventListener("deployment_info", ignore_event)
 	sse.AddEventListener("deployment_step_success", ignore_event)
 	sse.AddEventListener("deployment_success", ignore_event)
@@ -85,16 +137,25 @@ func NewDiscoveryMarathon(host net.IP, port uint, reconnectDelay time.Duration,
 	sse.AddEventListener("group_change_failed", ignore_event)
 	sse.AddEventListener("event_stream_attached", ignore_event)
 	sse.AddEventListener("event_stream_detached", ignore_event)
-	sse.AddEventListener("api_post_event", ignore_event)
+	sse.AddEventListener("api_post_event", sd.api_post_event)
 	sse.AddEventListener("add_health_check_event", ignore_event)
 	sse.AddEventListener("remove_health_check_event", ignore_event)
 	sse.AddEventListener("failed_health_check_event", ignore_event)
 	sse.OnMessage = func(event, data string) {
 		//log.Printf("SSE: unhandled event %v", data)
-		fmt.Printf("%v\n", data)
 	}
 
-	return sd
+	return sd, nil
+}
+
+// SetDefaultScheduler sets the scheduler of services discovered from now
+// on, unless overridden by the lb-scheduler label.
+func (sd *DiscoveryMarathon) SetDefaultScheduler(scheduler SchedulingAlgorithm) {
+	sd.defaultScheduler.Store(scheduler)
+}
+
+func (sd *DiscoveryMarathon) getDefaultScheduler() SchedulingAlgorithm {
+	return sd.defaultScheduler.Load().(SchedulingAlgorithm)
 }
 
 func (sd *DiscoveryMarathon) String() string {
@@ -107,21 +168,58 @@ func (sd *DiscoveryMarathon) Run() {
 }
 
 func (sd *DiscoveryMarathon) Shutdown() {
+	sd.cancel()
 	sd.sse.Close()
 }
 
+func (sd *DiscoveryMarathon) Status() DiscoveryStatus {
+	status := DiscoveryStatus{
+		Type:        "marathon",
+		Source:      sd.sse.Url,
+		Connected:   sd.sse.ReadyState() == OPEN,
+		LastEventId: sd.sse.LastEventID(),
+		Reconnects:  atomic.LoadUint64(&sd.sse.Reconnects),
+		Details:     map[string]interface{}{"appCache": sd.AppCache},
+	}
+
+	if t := sd.sse.LastEventAt(); !t.IsZero() {
+		status.LastEventAt = &t
+	}
+
+	return status
+}
+
+// RefreshAllApps fetches all apps from Marathon and propagates their
+// services and backends. Failed fetches are retried with an exponential
+// backoff until the discovery is shut down.
 func (sd *DiscoveryMarathon) RefreshAllApps() {
 	var apps []*marathon.App
 	var err error
+	backoff := refreshMinBackoff
 	for {
 		apps, err = sd.getAllMarathonApps()
-		if err != nil {
-			log.Printf("Failed to load all apps. %v", err.Error())
-		} else {
+		if err == nil {
 			break
 		}
+
+		if sd.ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Failed to load all apps. Retrying in %v. %v", backoff, err.Error())
+		select {
+		case <-sd.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > refreshMaxBackoff {
+			backoff = refreshMaxBackoff
+		}
 	}
 
+	sd.AppCache.Reset(apps)
+
 	sd.eventStream <- RestoreFromSnapshotEvent{}
 
 	for _, app := range apps {
@@ -129,15 +227,18 @@ func (sd *DiscoveryMarathon) RefreshAllApps() {
 	}
 
 	for _, app := range apps {
-		for portIndex, _ := range app.PortDefinitions {
-			serviceId := makeServiceId(app.Id, portIndex)
-			for _, task := range app.Tasks {
+		for i := range app.Tasks {
+			task := &app.Tasks[i]
+			alive := task.IsAlive() && sd.readiness.Admits(app, task)
+			for portIndex, portDef := range app.PortDefinitions {
 				sd.eventStream <- AddBackendEvent{
-					ServiceId: serviceId,
+					ServiceId: makeServiceId(app.Id, portIndex),
 					BackendId: task.Id,
 					Hostname:  task.Host,
 					Port:      task.Ports[portIndex],
-					Alive:     task.IsAlive(),
+					Capacity:  Atoi(portDef.Labels[LB_CAPACITY], 0),
+					Weight:    getBackendWeight(app, portIndex),
+					Alive:     alive,
 				}
 			}
 		}
@@ -163,9 +264,20 @@ func (sd *DiscoveryMarathon) status_update_event(data string) {
 
 	switch event.TaskStatus {
 	case marathon.TaskRunning:
+		status := event.TaskStatus
+		version, _ := time.Parse(time.RFC3339Nano, event.Version)
+		sd.AppCache.PutTask(event.AppId, marathon.Task{
+			Id:      event.TaskId,
+			Host:    event.Host,
+			Ports:   event.Ports,
+			AppId:   event.AppId,
+			State:   &status,
+			Version: version,
+		})
 		sd.addBackend(event.AppId, event.TaskId)
 	case marathon.TaskFinished, marathon.TaskFailed, marathon.TaskKilling, marathon.TaskKilled, marathon.TaskLost:
 		sd.removeBackend(event.AppId, event.TaskId)
+		sd.AppCache.RemoveTask(event.AppId, event.TaskId)
 	}
 }
 
@@ -177,12 +289,19 @@ func (sd *DiscoveryMarathon) health_status_changed_event(data string) {
 		return
 	}
 
+	sd.AppCache.SetTaskAlive(event.AppId, event.Deprecated_TaskId, bool(event.Alive), event.Timestamp)
+
+	alive := bool(event.Alive)
+	if app, task, err := sd.AppCache.GetTask(event.AppId, event.Deprecated_TaskId); err == nil && task != nil {
+		alive = alive && sd.readiness.Admits(app, task)
+	}
+
 	if maxPorts, ok := sd.portsMapCache[event.AppId]; ok {
 		for portIndex := 0; portIndex < maxPorts; portIndex++ {
 			sd.eventStream <- HealthStatusChangedEvent{
 				ServiceId: makeServiceId(event.AppId, portIndex),
 				BackendId: event.Deprecated_TaskId,
-				Alive:     bool(event.Alive),
+				Alive:     alive,
 			}
 		}
 	}
@@ -201,6 +320,7 @@ func (sd *DiscoveryMarathon) instance_changed_event(data string) {
 		sd.addBackend(event.RunSpecId, instanceToTaskId(event.InstanceId))
 	case marathon.ConditionFailed, marathon.ConditionKilling, marathon.ConditionKilled, marathon.ConditionFinished:
 		sd.removeBackend(event.RunSpecId, instanceToTaskId(event.InstanceId))
+		sd.AppCache.RemoveTask(event.RunSpecId, instanceToTaskId(event.InstanceId))
 	case marathon.ConditionCreated:
 		// ignored
 	default:
@@ -216,30 +336,33 @@ func (sd *DiscoveryMarathon) instance_health_changed_event(data string) {
 		return
 	}
 
-	app, err := sd.getMarathonApp(event.RunSpecId)
+	app, task, err := sd.AppCache.GetTask(event.RunSpecId, event.InstanceId)
 	if err != nil {
 		log.Printf("instance_health_changed_event: Failed to get app. %v", err)
 		return
 	}
-	task := app.GetTaskByInstanceId(event.InstanceId)
 	if task == nil {
 		log.Printf("instance_health_changed_event: couldn't find task by instanceId %v for app %v",
 			event.InstanceId, app.Id)
 		return
 	}
 
-	if task.HealthCheckResults[0].LastFailure == nil {
+	sd.AppCache.SetTaskAlive(app.Id, task.Id, event.Healthy, event.Timestamp)
+
+	if len(task.HealthCheckResults) == 0 {
 		// we haven't been adding the backend yet, as we can't infer the taskId
 		// from the instanceId before the first health check passed.
 		sd.addBackend(app.Id, task.Id)
 	}
 
+	alive := event.Healthy && sd.readiness.Admits(app, task)
+
 	if maxPorts, ok := sd.portsMapCache[event.RunSpecId]; ok {
 		for portIndex := 0; portIndex < maxPorts; portIndex++ {
 			sd.eventStream <- HealthStatusChangedEvent{
 				ServiceId: makeServiceId(event.RunSpecId, portIndex),
 				BackendId: task.Id,
-				Alive:     event.Healthy,
+				Alive:     alive,
 			}
 		}
 	}
@@ -254,19 +377,49 @@ func (sd *DiscoveryMarathon) app_terminated_event(data string) {
 	}
 
 	log.Printf("Application terminated. %v", event.AppId)
+	sd.AppCache.Remove(event.AppId)
 }
 
-func (sd *DiscoveryMarathon) getMarathonApp(appID string) (*marathon.App, error) {
-	m, err := marathon.NewService(sd.marathonIP, sd.marathonPort)
+func (sd *DiscoveryMarathon) api_post_event(data string) {
+	var event marathon.ApiPostEvent
+	err := json.Unmarshal([]byte(data), &event)
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to unmarshal api_post_event. %v\n", err)
+		return
 	}
 
-	return m.GetApp(appID)
+	if len(event.AppDefinition.Id) != 0 {
+		sd.AppCache.UpdateApp(event.AppDefinition)
+		sd.propagateWeights(event.AppDefinition.Id)
+	}
+}
+
+// propagateWeights updates the weights of all backends of the given app,
+// such as after its labels have been changed.
+func (sd *DiscoveryMarathon) propagateWeights(appId string) {
+	app, err := sd.AppCache.Get(appId)
+	if err != nil {
+		log.Printf("Failed to update backend weights. %v", err)
+		return
+	}
+
+	for _, task := range app.Tasks {
+		for portIndex := range app.PortDefinitions {
+			sd.eventStream <- BackendWeightChangedEvent{
+				ServiceId: makeServiceId(app.Id, portIndex),
+				BackendId: task.Id,
+				Weight:    getBackendWeight(app, portIndex),
+			}
+		}
+	}
+}
+
+func (sd *DiscoveryMarathon) getMarathonApp(appID string) (*marathon.App, error) {
+	return sd.marathon.GetApp(sd.ctx, appID)
 }
 
 func (sd *DiscoveryMarathon) addBackend(appId, taskId string) {
-	app, err := sd.getMarathonApp(appId)
+	app, task, err := sd.AppCache.GetTask(appId, taskId)
 	if err != nil {
 		log.Printf("Failed to add backend. %v", err)
 		return
@@ -274,14 +427,12 @@ func (sd *DiscoveryMarathon) addBackend(appId, taskId string) {
 
 	sd.ensureAppIsPropagated(app)
 
-	task := app.GetTaskById(taskId)
 	if task == nil {
 		log.Printf("Failed to add backend. Task %v not found in app %v", taskId, appId)
 		return
 	}
 
-	alive := len(app.HealthChecks) == 0 ||
-		(len(task.HealthCheckResults) != 0 && task.IsAlive())
+	alive := isTaskHealthy(app, task) && sd.readiness.Admits(app, task)
 
 	for portIndex, portDef := range app.PortDefinitions {
 		serviceId := makeServiceId(appId, portIndex)
@@ -291,12 +442,35 @@ func (sd *DiscoveryMarathon) addBackend(appId, taskId string) {
 			Hostname:  task.Host,
 			Port:      task.Ports[portIndex],
 			Capacity:  Atoi(portDef.Labels[LB_CAPACITY], 0),
+			Weight:    getBackendWeight(app, portIndex),
 			Alive:     alive,
 		}
 		// XXX we consider the backend already alive when there are no
 		// health-checks defined but ports defined.
 		// If there are health checks defined, Alive is initially set to false, and
 		// a health_status_changed_event to enable itwill follow up to enable it.
+		// Tasks with pending readiness checks are enabled once they are ready.
+	}
+}
+
+// onTaskReady is invoked once the given task passed its readiness checks.
+func (sd *DiscoveryMarathon) onTaskReady(appId, taskId string) {
+	app, task, err := sd.AppCache.GetTask(appId, taskId)
+	if err != nil {
+		log.Printf("Failed to enable ready task %v. %v", taskId, err)
+		return
+	}
+	if task == nil || !isTaskHealthy(app, task) {
+		// either gone already, or a health status change will enable it later
+		return
+	}
+
+	for portIndex := range app.PortDefinitions {
+		sd.eventStream <- HealthStatusChangedEvent{
+			ServiceId: makeServiceId(appId, portIndex),
+			BackendId: task.Id,
+			Alive:     true,
+		}
 	}
 }
 
@@ -309,6 +483,8 @@ func makeSchedulingAlgorithm(val string, dfl SchedulingAlgorithm) SchedulingAlgo
 }
 
 func (sd *DiscoveryMarathon) removeBackend(appId, taskId string) {
+	sd.readiness.Forget(taskId)
+
 	if maxPorts, ok := sd.portsMapCache[appId]; ok {
 		for portIndex := 0; portIndex < maxPorts; portIndex++ {
 			sd.eventStream <- RemoveBackendEvent{
@@ -328,24 +504,41 @@ func (sd *DiscoveryMarathon) ensureAppIsPropagated(app *marathon.App) {
 		switch proto {
 		case "http":
 			sd.eventStream <- AddHttpServiceEvent{
-				ServiceId:   serviceId,
-				ServicePort: portDef.Port,
-				Scheduler:   makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.DefaultScheduler),
-				Hosts:       makeStringArray(portDef.Labels[LB_VHOST_HTTP]),
+				ServiceId:         serviceId,
+				ServicePort:       portDef.Port,
+				Scheduler:         makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.getDefaultScheduler()),
+				HashKey:           portDef.Labels[LB_HASH_KEY],
+				StickyCookie:      portDef.Labels[LB_STICKY_COOKIE],
+				DrainTimeout:      MakeDuration(portDef.Labels[LB_DRAIN_TIMEOUT], 0),
+				SlowStart:         MakeDuration(getPortLabel(app, portIndex, LB_SLOW_START), 0),
+				SlowStartCurve:    MakeFloat(getPortLabel(app, portIndex, LB_SLOW_START_CURVE), 1.0),
+				MaxRetries:        Atoi(portDef.Labels[LB_MAX_RETRIES], defaultMaxRetries),
+				EjectionThreshold: Atoi(portDef.Labels[LB_EJECTION_THRESHOLD], 0),
+				EjectionTime:      MakeDuration(portDef.Labels[LB_EJECTION_TIME], 0),
+				AcceptProxy:       MakeBool(portDef.Labels[LB_ACCEPT_PROXY]),
+				Hosts:             makeStringArray(portDef.Labels[LB_VHOST_HTTP]),
+				SslHosts:          makeStringArray(portDef.Labels[LB_VHOST_HTTPS]),
+				Aliases:           makeStringArray(portDef.Labels[LB_VHOST_ALIAS]),
+				RedirectHttps:     MakeBool(portDef.Labels[LB_REDIRECT_HTTPS]),
+				RedirectStatus:    Atoi(portDef.Labels[LB_REDIRECT_STATUS], 0),
+				HeaderRules:       getHeaderRuleLabels(app, portIndex),
 			}
 		case "tcp":
 			sd.eventStream <- AddTcpServiceEvent{
-				ServiceId:     serviceId,
-				ServicePort:   portDef.Port,
-				Scheduler:     makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.DefaultScheduler),
-				ProxyProtocol: Atoi(portDef.Labels[LB_PROXY_PROTOCOL], 0),
-				AcceptProxy:   MakeBool(portDef.Labels[LB_ACCEPT_PROXY]),
+				ServiceId:      serviceId,
+				ServicePort:    portDef.Port,
+				Scheduler:      makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.getDefaultScheduler()),
+				ProxyProtocol:  Atoi(portDef.Labels[LB_PROXY_PROTOCOL], 0),
+				AcceptProxy:    MakeBool(portDef.Labels[LB_ACCEPT_PROXY]),
+				DrainTimeout:   MakeDuration(portDef.Labels[LB_DRAIN_TIMEOUT], 0),
+				SlowStart:      MakeDuration(getPortLabel(app, portIndex, LB_SLOW_START), 0),
+				SlowStartCurve: MakeFloat(getPortLabel(app, portIndex, LB_SLOW_START_CURVE), 1.0),
 			}
 		case "udp":
 			sd.eventStream <- AddUdpServiceEvent{
 				ServiceId:   serviceId,
 				ServicePort: portDef.Port,
-				Scheduler:   makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.DefaultScheduler),
+				Scheduler:   makeSchedulingAlgorithm(portDef.Labels[LB_SCHEDULER], sd.getDefaultScheduler()),
 			}
 		default:
 			log.Printf("Unhandled protocol: %q", proto)
@@ -360,6 +553,48 @@ func makeServiceId(appId string, portIndex int) string {
 	return fmt.Sprintf("%v-%v", appId, portIndex)
 }
 
+// getPortLabel returns the value of the given label of the port definition,
+// falling back to the app's labels.
+func getPortLabel(app *marathon.App, portIndex int, name string) string {
+	if portIndex < len(app.PortDefinitions) {
+		if value, ok := app.PortDefinitions[portIndex].Labels[name]; ok {
+			return value
+		}
+	}
+
+	return app.Labels[name]
+}
+
+// getHeaderRuleLabels returns the header rule labels of the port
+// definition, falling back to the app's labels.
+func getHeaderRuleLabels(app *marathon.App, portIndex int) map[string]string {
+	labels := make(map[string]string)
+	for name, value := range app.Labels {
+		if IsHeaderRuleLabel(name) {
+			labels[name] = value
+		}
+	}
+
+	if portIndex < len(app.PortDefinitions) {
+		for name, value := range app.PortDefinitions[portIndex].Labels {
+			if IsHeaderRuleLabel(name) {
+				labels[name] = value
+			}
+		}
+	}
+
+	return labels
+}
+
+func getBackendWeight(app *marathon.App, portIndex int) int {
+	return Atoi(getPortLabel(app, portIndex, LB_WEIGHT), 1)
+}
+
+func isTaskHealthy(app *marathon.App, task *marathon.Task) bool {
+	return len(app.HealthChecks) == 0 ||
+		(len(task.HealthCheckResults) != 0 && task.IsAlive())
+}
+
 func getApplicationProtocol(app *marathon.App, portIndex int) string {
 	if proto := getHealthCheckProtocol(app, portIndex); len(proto) != 0 {
 		return proto
@@ -391,7 +626,7 @@ func getTransportProtocol(app *marathon.App, portIndex int) string {
 		return app.PortDefinitions[portIndex].Protocol // already lower-case
 	}
 
-	if app.Container.Docker != nil && portIndex < len(app.Container.Docker.PortMappings) {
+	if app.Container != nil && app.Container.Docker != nil && portIndex < len(app.Container.Docker.PortMappings) {
 		return strings.ToLower(app.Container.Docker.PortMappings[portIndex].Protocol)
 	}
 
@@ -403,12 +638,7 @@ func getTransportProtocol(app *marathon.App, portIndex int) string {
 }
 
 func (sd *DiscoveryMarathon) getAllMarathonApps() ([]*marathon.App, error) {
-	m, err := marathon.NewService(sd.marathonIP, sd.marathonPort)
-	if err != nil {
-		return nil, fmt.Errorf("Could not create new marathon service. %v", err)
-	}
-
-	apps, err := m.GetApps()
+	apps, err := sd.marathon.GetApps(sd.ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Could not get apps. %v", err)
 	}
@@ -0,0 +1,248 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/christianparpart/sag/marathon"
+	"golang.org/x/sync/singleflight"
+)
+
+// MarathonAppCache is a local copy of all Marathon apps, including their tasks.
+//
+// It is built from the initial snapshot and updated incrementally from the
+// event stream payloads, so that not every event causes a REST round trip.
+// Apps that are unknown to the cache are fetched lazily, and concurrent
+// fetches of the same app are coalesced into a single request.
+//
+// Cached apps are never modified in place. Any update replaces the app
+// with a modified copy, so callers may keep the returned pointers around.
+type MarathonAppCache struct {
+	Hits    uint64 // number of lookups served from the cache
+	Misses  uint64 // number of lookups that required a fetch
+	Fetches uint64 // number of actual requests sent to Marathon
+	mutex   sync.RWMutex
+	apps    map[string]*marathon.App
+	fetch   func(appId string) (*marathon.App, error)
+	group   singleflight.Group
+}
+
+func NewMarathonAppCache(fetch func(appId string) (*marathon.App, error)) *MarathonAppCache {
+	return &MarathonAppCache{
+		apps:  make(map[string]*marathon.App),
+		fetch: fetch,
+	}
+}
+
+// Reset replaces the whole cache with the given snapshot.
+func (cache *MarathonAppCache) Reset(apps []*marathon.App) {
+	m := make(map[string]*marathon.App, len(apps))
+	for _, app := range apps {
+		m[app.Id] = app
+	}
+
+	cache.mutex.Lock()
+	cache.apps = m
+	cache.mutex.Unlock()
+}
+
+// Get returns the app by the given ID, fetching it from Marathon if not cached.
+func (cache *MarathonAppCache) Get(appId string) (*marathon.App, error) {
+	cache.mutex.RLock()
+	app, ok := cache.apps[appId]
+	cache.mutex.RUnlock()
+
+	if ok {
+		atomic.AddUint64(&cache.Hits, 1)
+		return app, nil
+	}
+
+	atomic.AddUint64(&cache.Misses, 1)
+	return cache.Fetch(appId)
+}
+
+// GetTask returns the app and the task by the given task (or instance) ID.
+//
+// The app is re-fetched once if the task is not known to the cached copy,
+// as the task might have been started after the app got cached.
+func (cache *MarathonAppCache) GetTask(appId, taskId string) (*marathon.App, *marathon.Task, error) {
+	app, err := cache.Get(appId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if task := app.GetTaskById(taskId); task != nil {
+		return app, task, nil
+	}
+
+	atomic.AddUint64(&cache.Misses, 1)
+	app, err = cache.Fetch(appId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return app, app.GetTaskById(taskId), nil
+}
+
+// Fetch unconditionally (re-)fetches the given app from Marathon and
+// updates the cache. Concurrent fetches for the same app are coalesced.
+func (cache *MarathonAppCache) Fetch(appId string) (*marathon.App, error) {
+	v, err, _ := cache.group.Do(appId, func() (interface{}, error) {
+		atomic.AddUint64(&cache.Fetches, 1)
+		app, err := cache.fetch(appId)
+		if err != nil {
+			return nil, err
+		}
+		cache.Put(app)
+		return app, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*marathon.App), nil
+}
+
+// Put adds or replaces the given app in the cache.
+func (cache *MarathonAppCache) Put(app *marathon.App) {
+	cache.mutex.Lock()
+	cache.apps[app.Id] = app
+	cache.mutex.Unlock()
+}
+
+// Remove drops the given app from the cache.
+func (cache *MarathonAppCache) Remove(appId string) {
+	cache.mutex.Lock()
+	delete(cache.apps, appId)
+	cache.mutex.Unlock()
+}
+
+// UpdateApp replaces the app definition of a cached app, keeping its tasks.
+// The app is not added if it is not cached yet, as its tasks would be missing.
+func (cache *MarathonAppCache) UpdateApp(definition marathon.App) {
+	cache.modify(definition.Id, func(app *marathon.App) {
+		tasks := app.Tasks
+		*app = definition
+		app.Tasks = tasks
+	})
+}
+
+// PutTask adds or replaces the given task of an already cached app.
+func (cache *MarathonAppCache) PutTask(appId string, task marathon.Task) {
+	cache.modify(appId, func(app *marathon.App) {
+		tasks := make([]marathon.Task, 0, len(app.Tasks)+1)
+		for _, t := range app.Tasks {
+			if t.Id != task.Id {
+				tasks = append(tasks, t)
+			}
+		}
+		app.Tasks = append(tasks, task)
+	})
+}
+
+// RemoveTask removes the given task (or instance) from a cached app.
+func (cache *MarathonAppCache) RemoveTask(appId, taskId string) {
+	cache.modify(appId, func(app *marathon.App) {
+		task := app.GetTaskById(taskId)
+		if task == nil {
+			return
+		}
+		tasks := make([]marathon.Task, 0, len(app.Tasks))
+		for _, t := range app.Tasks {
+			if t.Id != task.Id {
+				tasks = append(tasks, t)
+			}
+		}
+		app.Tasks = tasks
+	})
+}
+
+// SetTaskAlive records the outcome of a health check of a cached task.
+//
+// Tasks that have been cached before their first health check get a
+// health check result added, so that they are known to be healthy later on.
+func (cache *MarathonAppCache) SetTaskAlive(appId, taskId string, alive bool, at time.Time) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	cache.modify(appId, func(app *marathon.App) {
+		task := app.GetTaskById(taskId)
+		if task == nil {
+			return
+		}
+		tasks := make([]marathon.Task, len(app.Tasks))
+		copy(tasks, app.Tasks)
+		for i := range tasks {
+			if tasks[i].Id != task.Id {
+				continue
+			}
+			results := make([]marathon.HealthCheckResult, len(tasks[i].HealthCheckResults))
+			copy(results, tasks[i].HealthCheckResults)
+			if len(results) == 0 {
+				results = append(results, marathon.HealthCheckResult{})
+			}
+			for k := range results {
+				updateHealthCheckResult(&results[k], alive, at)
+			}
+			tasks[i].HealthCheckResults = results
+		}
+		app.Tasks = tasks
+	})
+}
+
+func updateHealthCheckResult(result *marathon.HealthCheckResult, alive bool, at time.Time) {
+	result.Alive = alive
+	if alive {
+		if result.FirstSuccess == nil {
+			result.FirstSuccess = &at
+		}
+		result.LastSuccess = &at
+		result.ConsecutiveFailures = 0
+	} else {
+		result.LastFailure = &at
+		result.ConsecutiveFailures++
+	}
+}
+
+// modify applies fn to a copy of the cached app and replaces the cached app
+// with that copy. Nothing is done if the app is not cached.
+func (cache *MarathonAppCache) modify(appId string, fn func(app *marathon.App)) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if app, ok := cache.apps[appId]; ok {
+		clone := *app
+		fn(&clone)
+		cache.apps[appId] = &clone
+	}
+}
+
+func (cache *MarathonAppCache) MarshalJSON() ([]byte, error) {
+	cache.mutex.RLock()
+	apps := len(cache.apps)
+	cache.mutex.RUnlock()
+
+	return json.Marshal(struct {
+		Apps    int
+		Hits    uint64
+		Misses  uint64
+		Fetches uint64
+	}{
+		Apps:    apps,
+		Hits:    atomic.LoadUint64(&cache.Hits),
+		Misses:  atomic.LoadUint64(&cache.Misses),
+		Fetches: atomic.LoadUint64(&cache.Fetches),
+	})
+}
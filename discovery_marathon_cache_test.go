@@ -0,0 +1,106 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/christianparpart/sag/marathon"
+)
+
+func newTestAppCache() *MarathonAppCache {
+	return NewMarathonAppCache(func(appId string) (*marathon.App, error) {
+		return nil, fmt.Errorf("Unexpected fetch of app %v.", appId)
+	})
+}
+
+func TestMarathonAppCacheReset(t *testing.T) {
+	cache := newTestAppCache()
+	cache.Reset([]*marathon.App{{Id: "/a"}, {Id: "/b"}})
+	cache.Reset([]*marathon.App{{Id: "/b"}})
+
+	if _, err := cache.Get("/b"); err != nil {
+		t.Errorf("Expected /b to be cached. %v", err)
+	}
+	if _, err := cache.Get("/a"); err == nil {
+		t.Error("Expected /a to be dropped by the reset.")
+	}
+}
+
+func TestMarathonAppCachePutTask(t *testing.T) {
+	cache := newTestAppCache()
+	cache.Reset([]*marathon.App{{Id: "/a", Tasks: []marathon.Task{{Id: "a.1", Host: "old"}}}})
+	before, _ := cache.Get("/a")
+
+	cache.PutTask("/a", marathon.Task{Id: "a.1", Host: "new"})
+	cache.PutTask("/a", marathon.Task{Id: "a.2"})
+	cache.PutTask("/unknown", marathon.Task{Id: "unknown.1"})
+
+	app, _ := cache.Get("/a")
+	if len(app.Tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %v.", len(app.Tasks))
+	}
+	if task := app.GetTaskById("a.1"); task == nil || task.Host != "new" {
+		t.Errorf("Expected task a.1 to be replaced, got %+v.", task)
+	}
+	if before.Tasks[0].Host != "old" {
+		t.Error("Expected previously returned apps to be left untouched.")
+	}
+}
+
+func TestMarathonAppCacheRemoveTask(t *testing.T) {
+	cache := newTestAppCache()
+	cache.Reset([]*marathon.App{{Id: "/a", Tasks: []marathon.Task{{Id: "a.1"}, {Id: "a.2"}}}})
+
+	cache.RemoveTask("/a", "a.1")
+	cache.RemoveTask("/a", "a.3")
+
+	app, _ := cache.Get("/a")
+	if len(app.Tasks) != 1 || app.Tasks[0].Id != "a.2" {
+		t.Errorf("Expected only task a.2 to be left, got %+v.", app.Tasks)
+	}
+}
+
+func TestMarathonAppCacheSetTaskAlive(t *testing.T) {
+	cache := newTestAppCache()
+	cache.Reset([]*marathon.App{{
+		Id:           "/a",
+		HealthChecks: []marathon.HealthCheck{{Protocol: "HTTP"}},
+	}})
+	cache.PutTask("/a", marathon.Task{Id: "a.1"})
+
+	app, _ := cache.Get("/a")
+	if isTaskHealthy(app, app.GetTaskById("a.1")) {
+		t.Fatal("Expected task without health check results to be unhealthy.")
+	}
+
+	healthyAt := time.Date(2017, 4, 1, 10, 0, 0, 0, time.UTC)
+	cache.SetTaskAlive("/a", "a.1", true, healthyAt)
+
+	app, _ = cache.Get("/a")
+	task := app.GetTaskById("a.1")
+	if !isTaskHealthy(app, task) {
+		t.Fatalf("Expected task to be healthy, got %+v.", task.HealthCheckResults)
+	}
+	if len(task.HealthCheckResults) != 1 || !task.HealthCheckResults[0].LastSuccess.Equal(healthyAt) {
+		t.Errorf("Expected a single result with its last success recorded, got %+v.", task.HealthCheckResults)
+	}
+
+	failedAt := healthyAt.Add(time.Minute)
+	cache.SetTaskAlive("/a", "a.1", false, failedAt)
+
+	app, _ = cache.Get("/a")
+	result := app.GetTaskById("a.1").HealthCheckResults[0]
+	if result.Alive || result.LastFailure == nil || !result.LastFailure.Equal(failedAt) ||
+		result.ConsecutiveFailures != 1 || !result.LastSuccess.Equal(healthyAt) {
+		t.Errorf("Expected the failure to be recorded, got %+v.", result)
+	}
+}
@@ -0,0 +1,353 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/christianparpart/sag/marathon"
+	"golang.org/x/sync/singleflight"
+)
+
+type ReadinessMode string
+
+const (
+	// ReadinessOff does not gate tasks by their readiness checks at all.
+	ReadinessOff = ReadinessMode("off")
+
+	// ReadinessMarathon waits for the readiness check results as reported by
+	// Marathon's deployments. Marathon only performs readiness checks on the
+	// tasks started by a deployment in progress, so any other task is
+	// considered ready.
+	ReadinessMarathon = ReadinessMode("marathon")
+
+	// ReadinessProbe probes the app's readiness check paths from sag itself.
+	ReadinessProbe = ReadinessMode("probe")
+)
+
+const (
+	readinessPollInterval      = time.Second
+	readinessFetchTimeout      = 5 * time.Second
+	defaultReadinessInterval   = 30 * time.Second
+	defaultReadinessTimeout    = 10 * time.Second
+	defaultReadinessStatusCode = http.StatusOK
+)
+
+// getReadinessMode returns the readiness gating mode for the given app, as
+// configured via the lb-readiness app label. The gating defaults to
+// ReadinessMarathon if the app has readiness checks defined.
+func getReadinessMode(app *marathon.App) ReadinessMode {
+	switch value := strings.ToLower(app.Labels[LB_READINESS]); value {
+	case string(ReadinessMarathon), string(ReadinessProbe):
+		return ReadinessMode(value)
+	case "", "true", "1", "yes":
+		if len(app.ReadinessChecks) != 0 {
+			return ReadinessMarathon
+		}
+		return ReadinessOff
+	default:
+		return ReadinessOff
+	}
+}
+
+// ReadinessGate keeps track of tasks that must pass their readiness checks
+// before they may receive any traffic.
+type ReadinessGate struct {
+	ctx         context.Context
+	marathon    *marathon.Service
+	onReady     func(appId, taskId string)
+	mutex       sync.Mutex
+	pending     map[string]chan struct{} // tasks waiting to become ready
+	ready       map[string]bool          // tasks that passed their readiness checks
+	deployments []*marathon.Deployment
+	fetchedAt   time.Time
+	fetch       singleflight.Group // coalesces concurrent deployment fetches
+}
+
+func NewReadinessGate(ctx context.Context, m *marathon.Service, onReady func(appId, taskId string)) *ReadinessGate {
+	return &ReadinessGate{
+		ctx:      ctx,
+		marathon: m,
+		onReady:  onReady,
+		pending:  make(map[string]chan struct{}),
+		ready:    make(map[string]bool),
+	}
+}
+
+// Admits tests whether the given task may receive traffic with respect to its
+// readiness checks, and starts watching the task's readiness if not.
+//
+// With ReadinessMarathon, tasks not covered by any deployment in progress are
+// admitted right away, without waiting for the watch to kick in.
+func (gate *ReadinessGate) Admits(app *marathon.App, task *marathon.Task) bool {
+	mode := getReadinessMode(app)
+	if mode == ReadinessOff {
+		return true
+	}
+
+	gate.mutex.Lock()
+	ready := gate.ready[task.Id]
+	gate.mutex.Unlock()
+
+	if ready {
+		return true
+	}
+
+	if mode == ReadinessMarathon {
+		ready, err := gate.checkMarathon(app.Id, task)
+		if err != nil {
+			log.Printf("Readiness check for task %v failed. %v", task.Id, err)
+		}
+		if ready {
+			gate.mutex.Lock()
+			gate.ready[task.Id] = true
+			gate.mutex.Unlock()
+			return true
+		}
+	}
+
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	if gate.ready[task.Id] {
+		return true
+	}
+
+	if _, ok := gate.pending[task.Id]; !ok {
+		cancel := make(chan struct{})
+		gate.pending[task.Id] = cancel
+		go gate.watch(mode, app, *task, cancel)
+	}
+
+	return false
+}
+
+// Forget stops watching the given task and drops its readiness state.
+func (gate *ReadinessGate) Forget(taskId string) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	if cancel, ok := gate.pending[taskId]; ok {
+		close(cancel)
+		delete(gate.pending, taskId)
+	}
+	delete(gate.ready, taskId)
+}
+
+func (gate *ReadinessGate) watch(mode ReadinessMode, app *marathon.App, task marathon.Task, cancel chan struct{}) {
+	interval := readinessPollInterval
+	if mode == ReadinessProbe {
+		interval = getReadinessInterval(app)
+	}
+
+	for {
+		var ready bool
+		var err error
+		switch mode {
+		case ReadinessMarathon:
+			ready, err = gate.checkMarathon(app.Id, &task)
+		case ReadinessProbe:
+			ready, err = probeReadiness(app, &task)
+		}
+
+		if err != nil {
+			log.Printf("Readiness check for task %v failed. %v", task.Id, err)
+		}
+
+		if ready {
+			gate.mutex.Lock()
+			_, stillPending := gate.pending[task.Id]
+			if stillPending {
+				delete(gate.pending, task.Id)
+				gate.ready[task.Id] = true
+			}
+			gate.mutex.Unlock()
+
+			if stillPending {
+				log.Printf("Task %v of app %v is ready.", task.Id, app.Id)
+				gate.onReady(app.Id, task.Id)
+			}
+			return
+		}
+
+		select {
+		case <-cancel:
+			return
+		case <-gate.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkMarathon tests the task's readiness by inspecting the readiness check
+// results of all deployments currently in progress.
+//
+// Only tasks covered by a deployment's readiness checks are gated, that is,
+// tasks reported in its readiness check results or started for the version
+// being deployed. Tasks of previous versions keep serving while their app
+// is being deployed.
+func (gate *ReadinessGate) checkMarathon(appId string, task *marathon.Task) (bool, error) {
+	deployments, err := gate.getDeployments()
+	if err != nil {
+		return false, err
+	}
+
+	covered := false
+	reported := false
+	for _, deployment := range deployments {
+		affected := deployment.IsAffectingApp(appId)
+		for _, action := range deployment.CurrentActions {
+			if action.App != appId {
+				continue
+			}
+			affected = true
+			for _, result := range action.ReadinessCheckResults {
+				if result.TaskId == task.Id {
+					if !result.Ready {
+						return false, nil
+					}
+					reported = true
+				}
+			}
+		}
+		if affected && !task.Version.IsZero() && !task.Version.Before(deployment.Version) {
+			covered = true
+		}
+	}
+
+	// A task of the version being deployed is ready once all of its
+	// readiness check results have been reported as ready.
+	return !covered || reported, nil
+}
+
+// getDeployments returns the deployments in progress, shared across all
+// watched tasks for up to readinessPollInterval.
+//
+// The deployments are fetched without holding the gate's lock, and
+// concurrent fetches are coalesced into a single request.
+func (gate *ReadinessGate) getDeployments() ([]*marathon.Deployment, error) {
+	gate.mutex.Lock()
+	if time.Since(gate.fetchedAt) < readinessPollInterval {
+		deployments := gate.deployments
+		gate.mutex.Unlock()
+		return deployments, nil
+	}
+	gate.mutex.Unlock()
+
+	result, err, _ := gate.fetch.Do("deployments", func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(gate.ctx, readinessFetchTimeout)
+		defer cancel()
+
+		deployments, err := gate.marathon.GetDeployments(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		gate.mutex.Lock()
+		gate.deployments = deployments
+		gate.fetchedAt = time.Now()
+		gate.mutex.Unlock()
+
+		return deployments, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]*marathon.Deployment), nil
+}
+
+// probeReadiness performs all readiness checks of the given app against the
+// task, and tests whether all of them passed.
+func probeReadiness(app *marathon.App, task *marathon.Task) (bool, error) {
+	for _, check := range app.ReadinessChecks {
+		portIndex := getPortIndexByName(app, check.PortName)
+		if portIndex < 0 || portIndex >= len(task.Ports) {
+			return false, fmt.Errorf("No port named %q in app %v", check.PortName, app.Id)
+		}
+
+		scheme := "http"
+		if strings.ToUpper(check.Protocol) == "HTTPS" {
+			scheme = "https"
+		}
+
+		timeout := defaultReadinessTimeout
+		if check.TimeoutSeconds != 0 {
+			timeout = time.Duration(check.TimeoutSeconds) * time.Second
+		}
+
+		url := fmt.Sprintf("%v://%v:%v%v", scheme, task.Host, task.Ports[portIndex], check.Path)
+		client := &http.Client{Timeout: timeout}
+		response, err := client.Get(url)
+		if err != nil {
+			return false, err
+		}
+		response.Body.Close()
+
+		if !isReadyStatusCode(check, response.StatusCode) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func isReadyStatusCode(check marathon.ReadinessCheck, statusCode int) bool {
+	if len(check.HttpStatusCodesForReady) == 0 {
+		return statusCode == defaultReadinessStatusCode
+	}
+
+	for _, code := range check.HttpStatusCodesForReady {
+		if int(code) == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getReadinessInterval(app *marathon.App) time.Duration {
+	interval := defaultReadinessInterval
+	for _, check := range app.ReadinessChecks {
+		if check.IntervalSeconds != 0 && time.Duration(check.IntervalSeconds)*time.Second < interval {
+			interval = time.Duration(check.IntervalSeconds) * time.Second
+		}
+	}
+
+	return interval
+}
+
+func getPortIndexByName(app *marathon.App, name string) int {
+	if len(name) == 0 {
+		return 0
+	}
+
+	for i, portDef := range app.PortDefinitions {
+		if portDef.Name == name {
+			return i
+		}
+	}
+
+	if app.Container != nil && app.Container.Docker != nil {
+		for i, portMapping := range app.Container.Docker.PortMappings {
+			if portMapping.Name == name {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
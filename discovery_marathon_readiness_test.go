@@ -0,0 +1,88 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/christianparpart/sag/marathon"
+)
+
+func TestReadinessGateAdmitsTasksOutsideDeployments(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":"d1","version":"2017-04-01T10:00:00Z","affectedApps":["/deploying"],"currentActions":[{"action":"ScaleApplication",
+			"app":"/deploying","readinessCheckResults":[{"taskId":"deploying.1","ready":false}]}]}]`))
+	}))
+	defer server.Close()
+
+	m, _ := marathon.NewServiceWithURL(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gate := NewReadinessGate(ctx, m, func(appId, taskId string) {})
+	labels := map[string]string{LB_READINESS: string(ReadinessMarathon)}
+
+	idle := &marathon.App{Id: "/idle", Labels: labels}
+	if !gate.Admits(idle, &marathon.Task{Id: "idle.1"}) {
+		t.Error("Expected task outside of any deployment to be admitted.")
+	}
+
+	deploying := &marathon.App{Id: "/deploying", Labels: labels}
+	deploymentVersion := time.Date(2017, 4, 1, 10, 0, 0, 0, time.UTC)
+	if gate.Admits(deploying, &marathon.Task{Id: "deploying.1", Version: deploymentVersion}) {
+		t.Error("Expected task of a deployment to wait for its readiness checks.")
+	}
+	gate.Forget("deploying.1")
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Expected deployments to be fetched once, got %v.", n)
+	}
+}
+
+func TestReadinessGateAdmitsExistingTasksDuringDeployment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":"d1","version":"2017-04-01T10:00:00Z","affectedApps":["/app"],"currentActions":[{"action":"RestartApplication",
+			"app":"/app","readinessCheckResults":[{"taskId":"app.new","ready":false}]}]}]`))
+	}))
+	defer server.Close()
+
+	m, _ := marathon.NewServiceWithURL(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gate := NewReadinessGate(ctx, m, func(appId, taskId string) {})
+	app := &marathon.App{Id: "/app", Labels: map[string]string{LB_READINESS: string(ReadinessMarathon)}}
+	deploymentVersion := time.Date(2017, 4, 1, 10, 0, 0, 0, time.UTC)
+
+	old := &marathon.Task{Id: "app.old", Version: deploymentVersion.Add(-time.Hour)}
+	if !gate.Admits(app, old) {
+		t.Error("Expected task of the previous version to keep serving during the deployment.")
+	}
+
+	started := &marathon.Task{Id: "app.started", Version: deploymentVersion}
+	if gate.Admits(app, started) {
+		t.Error("Expected task of the deployed version to wait for its readiness checks.")
+	}
+	gate.Forget("app.started")
+
+	reported := &marathon.Task{Id: "app.new"}
+	if gate.Admits(app, reported) {
+		t.Error("Expected task reported as not ready to wait for its readiness checks.")
+	}
+	gate.Forget("app.new")
+}
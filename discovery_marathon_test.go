@@ -0,0 +1,52 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshAllAppsStopsOnShutdown(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	sd, err := NewDiscoveryMarathon(addr.IP, uint(addr.Port), time.Second, make(chan interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sd.RefreshAllApps()
+		close(done)
+	}()
+
+	time.Sleep(refreshMinBackoff * 2)
+	sd.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the refresh to stop upon shutdown.")
+	}
+
+	if n := atomic.LoadInt32(&fetches); n < 1 || n > 3 {
+		t.Errorf("Expected the failed fetches to be backed off, got %v fetches.", n)
+	}
+}
@@ -0,0 +1,126 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of journal entries, describing the state changes of the gateway.
+const (
+	JournalServiceAdded      = "service_added"
+	JournalServiceRemoved    = "service_removed"
+	JournalBackendAdded      = "backend_added"
+	JournalBackendRemoved    = "backend_removed"
+	JournalBackendDrained    = "backend_drained"
+	JournalBackendHealth     = "backend_health_changed"
+	JournalBackendWeight     = "backend_weight_changed"
+	JournalBackendAdminState = "backend_admin_state_changed"
+)
+
+// journalCapacity is the number of most recent entries kept in the journal.
+const journalCapacity = 1024
+
+// JournalEntry is a single state change, as processed by the gateway.
+type JournalEntry struct {
+	Id        uint64      `json:"id"`
+	Time      time.Time   `json:"time"`
+	Type      string      `json:"type"`
+	ServiceId string      `json:"serviceId"`
+	BackendId string      `json:"backendId,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// EventJournal keeps the most recent state changes of the gateway, for
+// clients to follow them.
+type EventJournal struct {
+	mutex    sync.Mutex
+	entries  []JournalEntry // ring buffer
+	first    int            // index of the oldest entry
+	lastId   uint64
+	capacity int
+	changed  chan struct{} // closed (and replaced) upon any append
+}
+
+func NewEventJournal(capacity int) *EventJournal {
+	return &EventJournal{
+		entries:  make([]JournalEntry, 0, capacity),
+		capacity: capacity,
+		changed:  make(chan struct{}),
+	}
+}
+
+// Append adds a new entry and wakes up anyone waiting for it.
+func (journal *EventJournal) Append(kind, serviceId, backendId string, data interface{}) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	journal.lastId++
+	entry := JournalEntry{
+		Id:        journal.lastId,
+		Time:      time.Now(),
+		Type:      kind,
+		ServiceId: serviceId,
+		BackendId: backendId,
+		Data:      data,
+	}
+
+	if len(journal.entries) < journal.capacity {
+		journal.entries = append(journal.entries, entry)
+	} else {
+		journal.entries[journal.first] = entry
+		journal.first = (journal.first + 1) % journal.capacity
+	}
+
+	close(journal.changed)
+	journal.changed = make(chan struct{})
+}
+
+// Since returns all entries after the given ID, and whether or not the
+// entries right after the given ID were still available.
+func (journal *EventJournal) Since(id uint64) ([]JournalEntry, bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	n := len(journal.entries)
+	if id >= journal.lastId || n == 0 {
+		return nil, id <= journal.lastId
+	}
+
+	oldest := journal.lastId - uint64(n) + 1
+	complete := id+1 >= oldest
+	if !complete {
+		id = oldest - 1
+	}
+
+	count := int(journal.lastId - id)
+	result := make([]JournalEntry, 0, count)
+	for i := n - count; i < n; i++ {
+		result = append(result, journal.entries[(journal.first+i)%n])
+	}
+
+	return result, complete
+}
+
+// LastId returns the ID of the most recent entry.
+func (journal *EventJournal) LastId() uint64 {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.lastId
+}
+
+// Changed returns a channel that is closed upon the next append.
+func (journal *EventJournal) Changed() <-chan struct{} {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.changed
+}
@@ -8,17 +8,31 @@
 
 package main
 
+import "time"
+
 type SchedulingAlgorithm string
 
 const (
 	SchedulerRoundRobin = SchedulingAlgorithm("round-robin")
 	SchedulerLeastLoad  = SchedulingAlgorithm("least-load")
 	SchedulerChance     = SchedulingAlgorithm("chance")
+
+	SchedulerWeightedRoundRobin = SchedulingAlgorithm("weighted-round-robin")
+	SchedulerP2C                = SchedulingAlgorithm("p2c")
+	SchedulerPeakEwma           = SchedulingAlgorithm("peak-ewma")
+	SchedulerHash               = SchedulingAlgorithm("hash")
 )
 
 type RestoreFromSnapshotEvent struct {
 }
 
+// InspectEvent runs Inspect within the event processing, where the
+// gateway's state can be safely accessed, and closes Done afterwards.
+type InspectEvent struct {
+	Inspect func()
+	Done    chan struct{}
+}
+
 type AddUdpServiceEvent struct {
 	ServiceId   string
 	ServicePort uint
@@ -26,18 +40,35 @@ type AddUdpServiceEvent struct {
 }
 
 type AddTcpServiceEvent struct {
-	ServiceId     string
-	ServicePort   uint
-	Scheduler     SchedulingAlgorithm
-	ProxyProtocol int  // ProxyProtocol version to pass to upstream (0=disabled, 1=v1, 2=v2)
-	AcceptProxy   bool // AcceptProxy indicates whether or not to parse proxy header from clients
+	ServiceId      string
+	ServicePort    uint
+	Scheduler      SchedulingAlgorithm
+	ProxyProtocol  int           // ProxyProtocol version to pass to upstream (0=disabled, 1=v1, 2=v2)
+	AcceptProxy    bool          // AcceptProxy indicates whether or not to parse proxy header from clients
+	DrainTimeout   time.Duration // time to let removed backends finish their sessions (0=default)
+	SlowStart      time.Duration // time to ramp up new backends' share of sessions (0=disabled)
+	SlowStartCurve float64       // aggression of the slow start ramp (1.0 = linear)
 }
 
 type AddHttpServiceEvent struct {
-	ServiceId   string
-	ServicePort uint
-	Scheduler   SchedulingAlgorithm
-	Hosts       []string
+	ServiceId         string
+	ServicePort       uint
+	Scheduler         SchedulingAlgorithm
+	HashKey           string        // request key for the hash scheduler, such as "header:X-User"
+	StickyCookie      string        // name of the affinity cookie, enabling sticky sessions
+	DrainTimeout      time.Duration // time to let removed backends finish their requests (0=default)
+	SlowStart         time.Duration // time to ramp up new backends' share of traffic (0=disabled)
+	SlowStartCurve    float64       // aggression of the slow start ramp (1.0 = linear)
+	MaxRetries        int           // times to retry idempotent requests on other backends
+	EjectionThreshold int           // consecutive failures after which a backend is ejected (0=default)
+	EjectionTime      time.Duration // time an ejected backend does not receive any requests (0=default)
+	AcceptProxy       bool          // whether or not to parse proxy header from clients on the service port
+	Hosts             []string
+	SslHosts          []string          // hosts to be accessed by HTTPS
+	Aliases           []string          // hosts redirecting to the canonical host, the first of Hosts or SslHosts
+	RedirectHttps     bool              // whether or not to redirect plain HTTP requests to SslHosts to HTTPS
+	RedirectStatus    int               // such as 301 or 308 (0=301)
+	HeaderRules       map[string]string // header rule labels, such as "lb-response-header-set.X-Frame-Options"
 }
 
 type AddBackendEvent struct {
@@ -46,6 +77,7 @@ type AddBackendEvent struct {
 	Hostname  string
 	Port      uint
 	Capacity  int
+	Weight    int
 	Alive     bool
 }
 
@@ -60,6 +92,38 @@ type HealthStatusChangedEvent struct {
 	Alive     bool
 }
 
+// BackendDrainedEvent is emitted once a removed backend has finished
+// all its active requests.
+type BackendDrainedEvent struct {
+	ServiceId string
+	BackendId string
+}
+
+type BackendWeightChangedEvent struct {
+	ServiceId string
+	BackendId string
+	Weight    int
+}
+
+// SetBackendAdminStateEvent manually overrides the state of a backend for
+// the given duration (forever if 0). The outcome is reported on Result,
+// if not nil.
+type SetBackendAdminStateEvent struct {
+	ServiceId string
+	BackendId string
+	State     AdminState
+	Reason    string
+	Duration  time.Duration
+	Result    chan<- error
+}
+
+// ReloadConfigEvent applies the given configuration to the running
+// gateway. The outcome is reported on Result, if not nil.
+type ReloadConfigEvent struct {
+	Config *Config
+	Result chan<- error
+}
+
 type LogEvent struct {
 	Message string
 }
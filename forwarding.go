@@ -0,0 +1,185 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ForwardingMode string
+
+const (
+	ForwardingAppend  ForwardingMode = "append"  // extend inbound values of trusted proxies
+	ForwardingReplace ForwardingMode = "replace" // always discard inbound values
+)
+
+// forwardingHeaders are the headers describing the client side of the
+// requests as seen by the proxies in front of the backends.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"Forwarded",
+}
+
+// ForwardingPolicy decides how the forwarding headers of requests are
+// passed on to the backends.
+//
+// Inbound values are only kept if the client is a trusted proxy and the
+// mode is append, and are discarded otherwise, so that clients cannot
+// fake their address to the backends.
+type ForwardingPolicy struct {
+	Mode           ForwardingMode
+	TrustedProxies []*net.IPNet
+	Forwarded      bool // also emit the RFC 7239 Forwarded header
+}
+
+func NewForwardingPolicy(mode ForwardingMode, trustedProxies []string, forwarded bool) (*ForwardingPolicy, error) {
+	switch mode {
+	case ForwardingAppend, ForwardingReplace:
+	default:
+		return nil, fmt.Errorf("Unknown forwarding mode %q.", mode)
+	}
+
+	policy := &ForwardingPolicy{Mode: mode, Forwarded: forwarded}
+
+	for _, proxy := range trustedProxies {
+		network, err := ParseNetwork(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q. %v", proxy, err)
+		}
+		policy.TrustedProxies = append(policy.TrustedProxies, network)
+	}
+
+	return policy, nil
+}
+
+// Trusts tests whether the forwarding headers of requests from the given
+// client address are passed on.
+func (policy *ForwardingPolicy) Trusts(remoteAddr string) bool {
+	return policy.Mode == ForwardingAppend && policy.isTrustedProxy(remoteAddr)
+}
+
+func (policy *ForwardingPolicy) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ContainsIP(policy.TrustedProxies, ip)
+}
+
+// Scheme returns the scheme of the given request as used by the client.
+//
+// Behind a trusted proxy, such as a TLS terminating load balancer, this is
+// the outermost X-Forwarded-Proto value, regardless of the mode. The header
+// is ignored for any other client. A nil policy trusts no proxy.
+func (policy *ForwardingPolicy) Scheme(r *http.Request) string {
+	if policy != nil && policy.isTrustedProxy(r.RemoteAddr) {
+		proto := strings.SplitN(r.Header.Get("X-Forwarded-Proto"), ",", 2)[0]
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Apply rewrites the forwarding headers of the given request before it is
+// passed on to a backend.
+//
+// X-Forwarded-For is completed with the client address by the backend's
+// reverse proxy, so here it only keeps or discards the inbound value.
+func (policy *ForwardingPolicy) Apply(r *http.Request) {
+	trusted := policy.Trusts(r.RemoteAddr)
+	if !trusted {
+		for _, name := range forwardingHeaders {
+			r.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// keep the values as seen by the outermost trusted proxy
+	setDefaultHeader(r.Header, "X-Forwarded-Proto", proto)
+	setDefaultHeader(r.Header, "X-Forwarded-Host", r.Host)
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			setDefaultHeader(r.Header, "X-Forwarded-Port", port)
+		}
+	}
+
+	if policy.Forwarded {
+		element := "for=" + forwardedNode(r.RemoteAddr)
+		if len(r.Host) != 0 {
+			element += ";host=" + forwardedValue(r.Host)
+		}
+		element += ";proto=" + proto
+		if prior := r.Header["Forwarded"]; len(prior) != 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		r.Header.Set("Forwarded", element)
+	} else {
+		r.Header.Del("Forwarded")
+	}
+}
+
+func setDefaultHeader(header http.Header, name, value string) {
+	if len(header.Get(name)) == 0 {
+		header.Set(name, value)
+	}
+}
+
+// forwardedNode formats the client address as node of the Forwarded
+// header, quoting and bracketing IPv6 addresses as of RFC 7239.
+func forwardedNode(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "unknown"
+	}
+
+	if strings.Contains(host, ":") {
+		return `"[` + host + `]"`
+	}
+
+	return host
+}
+
+// forwardedValue formats the value as token or, if it contains other
+// characters, such as the colon of a port, as quoted string.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}
+}
@@ -0,0 +1,178 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardingPolicyTrusts(t *testing.T) {
+	appendMode, _ := NewForwardingPolicy(ForwardingAppend, []string{"10.0.0.0/8", "2001:db8::/32"}, true)
+	replaceMode, _ := NewForwardingPolicy(ForwardingReplace, []string{"10.0.0.0/8"}, true)
+	noProxies, _ := NewForwardingPolicy(ForwardingAppend, nil, true)
+
+	tests := []struct {
+		policy     *ForwardingPolicy
+		remoteAddr string
+		trusted    bool
+	}{
+		{appendMode, "10.1.2.3:1234", true},
+		{appendMode, "[2001:db8::1]:1234", true},
+		{appendMode, "192.0.2.1:1234", false},
+		{appendMode, "[2001:db9::1]:1234", false},
+		{appendMode, "10.1.2.3", false}, // no port, no address
+		{appendMode, "garbage", false},
+		{replaceMode, "10.1.2.3:1234", false},
+		{noProxies, "10.1.2.3:1234", false},
+	}
+
+	for _, test := range tests {
+		if trusted := test.policy.Trusts(test.remoteAddr); trusted != test.trusted {
+			t.Errorf("%v: expected %v to be trusted: %v, got %v.", test.policy.Mode, test.remoteAddr, test.trusted, trusted)
+		}
+	}
+}
+
+func TestForwardingPolicyApply(t *testing.T) {
+	appendMode, _ := NewForwardingPolicy(ForwardingAppend, []string{"10.0.0.0/8", "2001:db8::/32"}, true)
+	replaceMode, _ := NewForwardingPolicy(ForwardingReplace, []string{"10.0.0.0/8"}, true)
+	noForwarded, _ := NewForwardingPolicy(ForwardingAppend, []string{"10.0.0.0/8"}, false)
+
+	inbound := http.Header{
+		"X-Forwarded-For":   {"192.0.2.9"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"example.com"},
+		"X-Forwarded-Port":  {"443"},
+		"Forwarded":         {"for=192.0.2.9;host=example.com;proto=https"},
+	}
+
+	tests := []struct {
+		name       string
+		policy     *ForwardingPolicy
+		remoteAddr string
+		host       string
+		inbound    http.Header
+		expected   http.Header
+	}{
+		{
+			"append from trusted proxy", appendMode, "10.0.0.1:1234", "app.local", inbound,
+			http.Header{
+				"X-Forwarded-For":   {"192.0.2.9"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Port":  {"443"},
+				"Forwarded":         {"for=192.0.2.9;host=example.com;proto=https, for=10.0.0.1;host=app.local;proto=http"},
+			},
+		},
+		{
+			"append from untrusted client", appendMode, "192.0.2.1:1234", "app.local", inbound,
+			http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"app.local"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=192.0.2.1;host=app.local;proto=http"},
+			},
+		},
+		{
+			"replace from trusted proxy", replaceMode, "10.0.0.1:1234", "app.local", inbound,
+			http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"app.local"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=10.0.0.1;host=app.local;proto=http"},
+			},
+		},
+		{
+			"replace from untrusted client", replaceMode, "192.0.2.1:1234", "app.local", inbound,
+			http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"app.local"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=192.0.2.1;host=app.local;proto=http"},
+			},
+		},
+		{
+			"IPv6 client and host with port", appendMode, "[2001:db9::1]:1234", "app.local:8080", nil,
+			http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"app.local:8080"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {`for="[2001:db9::1]";host="app.local:8080";proto=http`},
+			},
+		},
+		{
+			"IPv6 trusted proxy", appendMode, "[2001:db8::1]:1234", "app.local", http.Header{"Forwarded": {`for="[2001:db8::9]"`}},
+			http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"app.local"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {`for="[2001:db8::9]", for="[2001:db8::1]";host=app.local;proto=http`},
+			},
+		},
+		{
+			"without Forwarded", noForwarded, "10.0.0.1:1234", "app.local", inbound,
+			http.Header{
+				"X-Forwarded-For":   {"192.0.2.9"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Port":  {"443"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey,
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}))
+		for name, values := range test.inbound {
+			r.Header[name] = append([]string(nil), values...)
+		}
+
+		test.policy.Apply(r)
+
+		for _, name := range forwardingHeaders {
+			if actual, expected := r.Header.Get(name), test.expected.Get(name); actual != expected {
+				t.Errorf("%v: expected %v %q, got %q.", test.name, name, expected, actual)
+			}
+		}
+	}
+}
+
+func TestForwardingPolicyScheme(t *testing.T) {
+	policy, _ := NewForwardingPolicy(ForwardingAppend, []string{"10.0.0.0/8"}, true)
+
+	tests := []struct {
+		policy     *ForwardingPolicy
+		remoteAddr string
+		proto      string
+		scheme     string
+	}{
+		{policy, "10.0.0.1:1234", "https", "https"},
+		{policy, "10.0.0.1:1234", " HTTPS , http", "https"},
+		{policy, "10.0.0.1:1234", "gopher", "http"},
+		{policy, "192.0.2.1:1234", "https", "http"},
+		{nil, "10.0.0.1:1234", "https", "http"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://app.local/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-Proto", test.proto)
+
+		if scheme := test.policy.Scheme(r); scheme != test.scheme {
+			t.Errorf("Expected scheme %q for %v with X-Forwarded-Proto %q, got %q.",
+				test.scheme, test.remoteAddr, test.proto, scheme)
+		}
+	}
+}
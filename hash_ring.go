@@ -0,0 +1,181 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// virtualNodesPerWeight is the number of points on the hash ring for each
+// unit of a backend's weight.
+const virtualNodesPerWeight = 160
+
+// maxRingWeight caps the weight of a backend on the hash ring, bounding the
+// size of the ring and the time to build it.
+const maxRingWeight = 100
+
+const (
+	HashByClientIP = "ip"
+	HashByHeader   = "header"
+	HashByCookie   = "cookie"
+	HashByQuery    = "query"
+	HashByPath     = "path"
+)
+
+// HashKey describes what part of a request is hashed by the hash scheduler,
+// such as "ip", "path", "header:X-User", "cookie:session" or "query:user".
+type HashKey struct {
+	Source string
+	Name   string
+}
+
+func ParseHashKey(s string) (HashKey, error) {
+	if len(s) == 0 {
+		return HashKey{Source: HashByClientIP}, nil
+	}
+
+	args := strings.SplitN(s, ":", 2)
+	key := HashKey{Source: strings.ToLower(args[0])}
+	if len(args) == 2 {
+		key.Name = args[1]
+	}
+
+	switch key.Source {
+	case HashByClientIP, HashByPath:
+		if len(key.Name) != 0 {
+			return key, fmt.Errorf("Hash key %q takes no name.", s)
+		}
+	case HashByHeader, HashByCookie, HashByQuery:
+		if len(key.Name) == 0 {
+			return key, fmt.Errorf("Hash key %q requires a name.", s)
+		}
+	default:
+		return key, fmt.Errorf("Unknown hash key source %q.", key.Source)
+	}
+
+	return key, nil
+}
+
+func (key HashKey) String() string {
+	if len(key.Name) != 0 {
+		return key.Source + ":" + key.Name
+	}
+	return key.Source
+}
+
+func (key HashKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(key.String())
+}
+
+// Extract returns the request's value to be hashed.
+func (key HashKey) Extract(r *http.Request) string {
+	switch key.Source {
+	case HashByHeader:
+		return r.Header.Get(key.Name)
+	case HashByCookie:
+		if cookie, err := r.Cookie(key.Name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	case HashByQuery:
+		return r.URL.Query().Get(key.Name)
+	case HashByPath:
+		return r.URL.Path
+	default:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *HttpBackend
+}
+
+// HashRing implements consistent hashing over a set of backends, with
+// each backend being placed on the ring multiple times (virtual nodes)
+// proportional to its weight.
+//
+// Adding or removing a backend only remaps the keys of that backend.
+// Slow start does not apply, as it would break the mapping of keys to
+// backends while they are ramping up.
+type HashRing struct {
+	points []ringPoint
+}
+
+func NewHashRing(backends []*HttpBackend) *HashRing {
+	ring := &HashRing{}
+
+	for _, backend := range backends {
+		weight := backend.Weight
+		if weight > maxRingWeight {
+			weight = maxRingWeight
+		}
+		for i := 0; i < weight*virtualNodesPerWeight; i++ {
+			sum := md5.Sum([]byte(fmt.Sprintf("%v#%v", backend.Id, i)))
+			ring.points = append(ring.points, ringPoint{
+				hash:    binary.BigEndian.Uint64(sum[:8]),
+				backend: backend,
+			})
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+
+	return ring
+}
+
+// Get returns the first available backend at or after the key's position on
+// the ring, not counting the backends tried already, or nil if none is
+// available.
+func (ring *HashRing) Get(key string, tried backendSet) *HttpBackend {
+	n := len(ring.points)
+	if n == 0 {
+		return nil
+	}
+
+	h := hashKey(key)
+	i := sort.Search(n, func(i int) bool { return ring.points[i].hash >= h })
+
+	for k := 0; k < n; k++ {
+		if backend := ring.points[(i+k)%n].backend; isCandidate(backend, tried) {
+			return backend
+		}
+	}
+
+	return nil
+}
+
+// hashKey hashes the given key with FNV-1a, followed by a 64-bit finalizer
+// for a better spread of similar keys across the ring.
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,108 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const ringTestKeys = 10000
+
+func newRingTestBackends(n int) []*HttpBackend {
+	backends := make([]*HttpBackend, n)
+	for i := range backends {
+		backends[i] = NewHttpBackend(fmt.Sprintf("task-%v", i), "127.0.0.1", uint(10000+i), 0, 1, true)
+	}
+	return backends
+}
+
+// mapRingKeys returns the backend of each test key.
+func mapRingKeys(ring *HashRing) []*HttpBackend {
+	mapping := make([]*HttpBackend, ringTestKeys)
+	for i := range mapping {
+		mapping[i] = ring.Get(fmt.Sprintf("key-%v", i), nil)
+	}
+	return mapping
+}
+
+func TestHashRingRemapsOnlyKeysOfChangedBackend(t *testing.T) {
+	const n = 10
+	backends := newRingTestBackends(n + 1)
+	before := mapRingKeys(NewHashRing(backends[:n]))
+	after := mapRingKeys(NewHashRing(backends))
+	added := backends[n]
+
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != added {
+				t.Fatalf("Key %v moved from %v to %v instead of the added backend.", i, before[i].Id, after[i].Id)
+			}
+		}
+	}
+
+	// adding the (n+1)th backend moves about 1/(n+1) of the keys to it
+	expected := float64(ringTestKeys) / (n + 1)
+	if math.Abs(float64(moved)-expected) > expected/3 {
+		t.Errorf("Expected about %.0f keys to move to the added backend, got %v.", expected, moved)
+	}
+
+	// removing it again moves back just the keys it got
+	for i, backend := range mapRingKeys(NewHashRing(backends[:n])) {
+		if backend != before[i] {
+			t.Fatalf("Key %v not mapped back to %v after removing a backend.", i, before[i].Id)
+		}
+	}
+}
+
+func TestHashRingIgnoresSlowStart(t *testing.T) {
+	backends := newRingTestBackends(3)
+	ring := NewHashRing(backends)
+	before := mapRingKeys(ring)
+
+	for _, backend := range backends {
+		backend.AliveSince = time.Now()
+		backend.SetSlowStart(time.Hour, 1.0)
+	}
+
+	for i, backend := range mapRingKeys(ring) {
+		if backend != before[i] {
+			t.Fatalf("Key %v moved from %v to %v while ramping up.", i, before[i].Id, backend.Id)
+		}
+	}
+}
+
+func TestHashRingCapsWeight(t *testing.T) {
+	backends := newRingTestBackends(1)
+	backends[0].Weight = 1000000
+
+	if n := len(NewHashRing(backends).points); n != maxRingWeight*virtualNodesPerWeight {
+		t.Errorf("Expected the ring size to be capped, got %v points.", n)
+	}
+}
+
+func TestHashSchedulerRingFollowsBackends(t *testing.T) {
+	service := NewHttpService("/test", SchedulerHash, nil)
+	service.AddBackend("task-0", "127.0.0.1", 10000, 0, 1, true)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if backend := service.selectBackend(r, nil); backend == nil || backend.Id != "task-0" {
+		t.Fatalf("Unexpected backend %v.", backend)
+	}
+
+	service.RemoveBackend("task-0")
+	if backend := service.selectBackend(r, nil); backend != nil {
+		t.Fatalf("Unexpected backend %v after removing all backends.", backend)
+	}
+}
@@ -0,0 +1,245 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type HeaderAction string
+
+const (
+	HeaderRemove  HeaderAction = "remove"  // removes the header
+	HeaderSet     HeaderAction = "set"     // replaces any values of the header
+	HeaderAdd     HeaderAction = "add"     // adds a value to the header
+	HeaderReplace HeaderAction = "replace" // rewrites the values of the header by regex
+)
+
+// headerActions are the header actions in the order they are applied.
+var headerActions = []HeaderAction{HeaderRemove, HeaderSet, HeaderAdd, HeaderReplace}
+
+const (
+	headerRulePrefix   = "lb-"
+	requestHeaderRule  = "request-header-"
+	responseHeaderRule = "response-header-"
+)
+
+// HeaderRule rewrites a header of requests or responses.
+type HeaderRule struct {
+	Action  HeaderAction
+	Name    string
+	Value   string         // value to set or add, or replacement of matches
+	Pattern *regexp.Regexp // matching the values to replace
+}
+
+// Apply rewrites the given headers as of the rule.
+func (rule *HeaderRule) Apply(header http.Header) {
+	switch rule.Action {
+	case HeaderRemove:
+		header.Del(rule.Name)
+	case HeaderSet:
+		header.Set(rule.Name, rule.Value)
+	case HeaderAdd:
+		header.Add(rule.Name, rule.Value)
+	case HeaderReplace:
+		values := header[http.CanonicalHeaderKey(rule.Name)]
+		for i, value := range values {
+			values[i] = rule.Pattern.ReplaceAllString(value, rule.Value)
+		}
+	}
+}
+
+func (rule HeaderRule) String() string {
+	if rule.Pattern != nil {
+		return fmt.Sprintf("%v %v /%v/%v/", rule.Action, rule.Name, rule.Pattern, rule.Value)
+	}
+	return fmt.Sprintf("%v %v %q", rule.Action, rule.Name, rule.Value)
+}
+
+// HeaderRules are the rules of a service for rewriting the headers of the
+// requests to and the responses from its backends.
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+// ApplyRequest rewrites the headers of a request to a backend.
+func (rules *HeaderRules) ApplyRequest(r *http.Request) {
+	for i := range rules.Request {
+		rules.Request[i].Apply(r.Header)
+	}
+}
+
+// ApplyResponse rewrites the headers of a response from a backend.
+func (rules *HeaderRules) ApplyResponse(rw *http.Response) {
+	for i := range rules.Response {
+		rules.Response[i].Apply(rw.Header)
+	}
+}
+
+// IsEmpty tests whether there are no rules at all.
+func (rules *HeaderRules) IsEmpty() bool {
+	return len(rules.Request) == 0 && len(rules.Response) == 0
+}
+
+// IsHeaderRuleLabel tests whether the given label defines a header rule,
+// such as "lb-response-header-set.X-Frame-Options".
+func IsHeaderRuleLabel(label string) bool {
+	return strings.HasPrefix(label, headerRulePrefix+requestHeaderRule) ||
+		strings.HasPrefix(label, headerRulePrefix+responseHeaderRule)
+}
+
+// ParseHeaderRules parses header rules from labels of the form
+// "lb-<request|response>-header-<action>.<header>", the "lb-" prefix being
+// optional, with the label value being the header value to set or add, or
+// a regex replacement for replace, such as "/^http:/https:/", where the
+// first character is the delimiter.
+//
+// Rules are applied in the order of remove, set, add, and replace, and by
+// header name within each action.
+func ParseHeaderRules(labels map[string]string) (*HeaderRules, error) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a := strings.TrimPrefix(keys[i], headerRulePrefix)
+		b := strings.TrimPrefix(keys[j], headerRulePrefix)
+		if a != b {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	rules := &HeaderRules{}
+	for _, action := range headerActions {
+		for _, key := range keys {
+			label := strings.TrimPrefix(key, headerRulePrefix)
+
+			var target *[]HeaderRule
+			switch {
+			case strings.HasPrefix(label, requestHeaderRule):
+				target = &rules.Request
+				label = strings.TrimPrefix(label, requestHeaderRule)
+			case strings.HasPrefix(label, responseHeaderRule):
+				target = &rules.Response
+				label = strings.TrimPrefix(label, responseHeaderRule)
+			default:
+				return nil, fmt.Errorf("Invalid header rule %q.", key)
+			}
+
+			dot := strings.IndexByte(label, '.')
+			if dot < 0 || len(label[dot+1:]) == 0 {
+				return nil, fmt.Errorf("Invalid header rule %q. Missing header name.", key)
+			}
+			if label[:dot] != string(action) {
+				if !isHeaderAction(label[:dot]) {
+					return nil, fmt.Errorf("Invalid header rule %q. Unknown action %q.", key, label[:dot])
+				}
+				continue
+			}
+
+			rule := HeaderRule{Action: action, Name: label[dot+1:], Value: labels[key]}
+			if !isHeaderName(rule.Name) {
+				return nil, fmt.Errorf("Invalid header rule %q. Invalid header name.", key)
+			}
+			if action == HeaderReplace {
+				pattern, replacement, err := parseReplacement(rule.Value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid header rule %q. %v", key, err)
+				}
+				rule.Pattern = pattern
+				rule.Value = replacement
+			} else if strings.ContainsAny(rule.Value, "\r\n") {
+				return nil, fmt.Errorf("Invalid header rule %q. Invalid header value.", key)
+			}
+
+			*target = append(*target, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// parseReplacement parses a regex replacement of the form
+// "/pattern/replacement/", with the first character being the delimiter.
+func parseReplacement(s string) (*regexp.Regexp, string, error) {
+	if len(s) < 3 {
+		return nil, "", fmt.Errorf("Expected /pattern/replacement/.")
+	}
+
+	delimiter := s[:1]
+	parts := strings.Split(s[1:], delimiter)
+	if len(parts) != 3 || len(parts[2]) != 0 {
+		return nil, "", fmt.Errorf("Expected %vpattern%vreplacement%v.", delimiter, delimiter, delimiter)
+	}
+
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pattern, parts[1], nil
+}
+
+func isHeaderAction(s string) bool {
+	for _, action := range headerActions {
+		if s == string(action) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHeaderName(name string) bool {
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return len(name) != 0
+}
+
+// MergeHeaderRuleLabels merges the given header rule labels, the latter
+// overriding rules of the former for the same header and action.
+func MergeHeaderRuleLabels(labels ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, m := range labels {
+		for key, value := range m {
+			merged[headerRulePrefix+strings.TrimPrefix(key, headerRulePrefix)] = value
+		}
+	}
+	return merged
+}
+
+// applyHeaderRules sets the header rules of the given service as merged
+// from the configuration and the service's labels. Invalid label rules
+// are ignored, keeping only the configured ones.
+func (sag *ServiceApplicationGateway) applyHeaderRules(service *HttpService) error {
+	configured := MergeHeaderRuleLabels(
+		sag.config.HeaderRules[AllServices],
+		sag.config.HeaderRules[service.ServiceId])
+
+	rules, err := ParseHeaderRules(MergeHeaderRuleLabels(configured, service.HeaderRuleLabels))
+	if err != nil {
+		// validated along with the configuration
+		rules, _ = ParseHeaderRules(configured)
+	}
+
+	if rules.IsEmpty() {
+		rules = nil
+	}
+	service.SetHeaderRules(rules)
+
+	return err
+}
@@ -0,0 +1,107 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRulesOrder(t *testing.T) {
+	rules, err := ParseHeaderRules(map[string]string{
+		"lb-request-header-replace.X-Tier": "#^gold$#platinum#",
+		"lb-request-header-add.X-Tier":     "silver",
+		"lb-request-header-set.X-Tier":     "gold",
+		"lb-request-header-remove.X-Tier":  "",
+		"request-header-set.X-B":           "b",
+		"request-header-set.X-A":           "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, rule := range rules.Request {
+		order = append(order, string(rule.Action)+" "+rule.Name)
+	}
+	expected := []string{"remove X-Tier", "set X-A", "set X-B", "set X-Tier", "add X-Tier", "replace X-Tier"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expected rules in order %v, got %v.", expected, order)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tier", "bronze")
+	rules.ApplyRequest(r)
+
+	if values := r.Header["X-Tier"]; !reflect.DeepEqual(values, []string{"platinum", "silver"}) {
+		t.Errorf("Unexpected X-Tier values %q.", values)
+	}
+	if r.Header.Get("X-A") != "a" || r.Header.Get("X-B") != "b" {
+		t.Errorf("Unexpected request headers %v.", r.Header)
+	}
+}
+
+func TestHeaderRulesApplyResponse(t *testing.T) {
+	rules, err := ParseHeaderRules(map[string]string{
+		"lb-response-header-remove.Server":    "",
+		"lb-response-header-replace.Location": "#^http:#https:#",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Request) != 0 {
+		t.Fatalf("Unexpected request rules %v.", rules.Request)
+	}
+
+	response := &http.Response{Header: http.Header{
+		"Server":   {"nginx"},
+		"Location": {"http://example.com/"},
+	}}
+	rules.ApplyResponse(response)
+
+	if _, ok := response.Header["Server"]; ok {
+		t.Error("Expected the Server header to be removed.")
+	}
+	if location := response.Header.Get("Location"); location != "https://example.com/" {
+		t.Errorf("Unexpected Location %q.", location)
+	}
+}
+
+func TestParseHeaderRulesRejectsInvalidRules(t *testing.T) {
+	for _, labels := range []map[string]string{
+		{"lb-request-header-rename.X-A": "X-B"},
+		{"lb-request-header-set.": "a"},
+		{"lb-request-header-set": "a"},
+		{"lb-request-header-set.X A": "a"},
+		{"lb-request-header-set.X-A": "a\r\nX-Injected: 1"},
+		{"lb-response-header-replace.X-A": "#^a#"},
+		{"lb-response-header-replace.X-A": "#(#b#"},
+		{"lb-header-set.X-A": "a"},
+	} {
+		if _, err := ParseHeaderRules(labels); err == nil {
+			t.Errorf("Expected header rules %v to be rejected.", labels)
+		}
+	}
+}
+
+func TestMergeHeaderRuleLabels(t *testing.T) {
+	merged := MergeHeaderRuleLabels(
+		map[string]string{"response-header-set.X-Frame-Options": "DENY", "response-header-remove.Server": ""},
+		map[string]string{"lb-response-header-set.X-Frame-Options": "SAMEORIGIN"})
+
+	expected := map[string]string{
+		"lb-response-header-set.X-Frame-Options": "SAMEORIGIN",
+		"lb-response-header-remove.Server":       "",
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v, got %v.", expected, merged)
+	}
+}
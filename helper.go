@@ -12,6 +12,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var resolveMap = make(map[string]string)
@@ -37,6 +38,22 @@ func Atoi(value string, defaultValue int) int {
 	return defaultValue
 }
 
+func MakeFloat(value string, defaultValue float64) float64 {
+	if result, err := strconv.ParseFloat(value, 64); err == nil {
+		return result
+	}
+
+	return defaultValue
+}
+
+func MakeDuration(value string, defaultValue time.Duration) time.Duration {
+	if result, err := time.ParseDuration(value); err == nil {
+		return result
+	}
+
+	return defaultValue
+}
+
 func makeStringArray(s string) []string {
 	if len(s) == 0 {
 		return []string{}
@@ -53,3 +70,28 @@ func MakeBool(s string) bool {
 		return false
 	}
 }
+
+// ParseNetwork parses an IP address or CIDR, such as 10.0.0.0/8, into a
+// network. Single addresses are taken as networks of only that address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// ContainsIP tests whether any of the given networks contains the IP.
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	wildcardHostPrefix = "*."
+	regexHostPrefix    = "~"
+)
+
+// hostIndexMaxDelay is the longest time an outdated host index is kept
+// while events are still pending.
+const hostIndexMaxDelay = 100 * time.Millisecond
+
+// HostIndex maps request hosts to the HTTP services by their vhosts, which
+// are either exact host names, such as "example.com", leading wildcards,
+// such as "*.apps.example.com", matching any subdomain, or regular
+// expressions prefixed by "~", such as "~^api-[0-9]+\.example\.com$".
+//
+// Exact hosts take precedence over wildcards, of which the longest one
+// matching wins, which in turn take precedence over regular expressions,
+// tried in the order of the services' IDs. Conflicting vhosts belong to
+// the service with the lowest ID.
+//
+// A HostIndex is immutable, and rebuilt after the services changed.
+type HostIndex struct {
+	exact     map[string]*HttpService
+	wildcards map[string]*HttpService // by domain suffix, such as ".apps.example.com"
+	patterns  []hostPattern
+}
+
+type hostPattern struct {
+	regexp  *regexp.Regexp
+	service *HttpService
+}
+
+// NewHostIndex indexes the vhosts of the given services, ignoring invalid
+// ones.
+func NewHostIndex(services map[string]*HttpService) *HostIndex {
+	index := &HostIndex{
+		exact:     make(map[string]*HttpService),
+		wildcards: make(map[string]*HttpService),
+	}
+
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		service := services[id]
+		for _, host := range service.Hosts {
+			index.add(host, service)
+		}
+	}
+
+	return index
+}
+
+func (index *HostIndex) add(host string, service *HttpService) error {
+	switch {
+	case strings.HasPrefix(host, regexHostPrefix):
+		re, err := regexp.Compile(host[len(regexHostPrefix):])
+		if err != nil {
+			return fmt.Errorf("Invalid vhost %q. %v", host, err)
+		}
+		index.patterns = append(index.patterns, hostPattern{re, service})
+	case strings.HasPrefix(host, wildcardHostPrefix):
+		domain, err := NormalizeHost(host[len(wildcardHostPrefix):])
+		if err != nil || len(domain) == 0 {
+			return fmt.Errorf("Invalid vhost %q.", host)
+		}
+		if _, ok := index.wildcards["."+domain]; !ok {
+			index.wildcards["."+domain] = service
+		}
+	default:
+		name, err := normalizeVhost(host)
+		if err != nil {
+			return err
+		}
+		if _, ok := index.exact[name]; !ok {
+			index.exact[name] = service
+		}
+	}
+	return nil
+}
+
+// Lookup returns the service for the given request host, or nil if none.
+func (index *HostIndex) Lookup(host string) *HttpService {
+	name, err := NormalizeHost(host)
+	if err != nil {
+		return nil
+	}
+
+	if service, ok := index.exact[name]; ok {
+		return service
+	}
+
+	// the longest domain suffix comes first
+	for i := 0; i < len(name) && len(index.wildcards) != 0; i++ {
+		if name[i] == '.' {
+			if service, ok := index.wildcards[name[i:]]; ok {
+				return service
+			}
+		}
+	}
+
+	for _, pattern := range index.patterns {
+		if pattern.regexp.MatchString(name) {
+			return pattern.service
+		}
+	}
+
+	return nil
+}
+
+// ValidateVhost tests whether the given vhost can be indexed.
+func ValidateVhost(host string) error {
+	index := &HostIndex{
+		exact:     make(map[string]*HttpService),
+		wildcards: make(map[string]*HttpService),
+	}
+	return index.add(host, nil)
+}
+
+// NormalizeHost normalizes the given host, such as of the Host header, by
+// stripping the port and the trailing dot, lowercasing it, and converting
+// internationalized domain names to ASCII.
+func NormalizeHost(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if isASCII(host) {
+		return strings.ToLower(host), nil
+	}
+
+	return idna.Lookup.ToASCII(host)
+}
+
+func normalizeVhost(host string) (string, error) {
+	name, err := NormalizeHost(host)
+	if err != nil {
+		return "", fmt.Errorf("Invalid vhost %q. %v", host, err)
+	}
+	if len(name) == 0 {
+		return "", fmt.Errorf("Invalid vhost %q.", host)
+	}
+	return name, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
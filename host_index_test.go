@@ -0,0 +1,127 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newHostIndexServices(hosts map[string][]string) map[string]*HttpService {
+	services := make(map[string]*HttpService, len(hosts))
+	for id, h := range hosts {
+		services[id] = &HttpService{ServiceId: id, Hosts: h}
+	}
+	return services
+}
+
+func TestHostIndexLookup(t *testing.T) {
+	index := NewHostIndex(newHostIndexServices(map[string][]string{
+		"/exact":      {"api.example.com", "Bücher.example"},
+		"/conflict":   {"api.example.com"},
+		"/wildcard":   {"*.example.com"},
+		"/longer":     {"*.eu.example.com"},
+		"/regex":      {`~^api-[0-9]+\.internal$`, `~^api-[0-9]+\.eu\.example\.com$`},
+		"/zzz-regex":  {`~^api-.*\.internal$`},
+		"/invalid":    {"~(", "*.", ""},
+		"/trailing":   {"www.example.org."},
+		"/ipv6":       {"[2001:db8::1]"},
+		"/uppercased": {"MIXED.example.NET"},
+	}))
+
+	tests := []struct {
+		host    string
+		service string
+	}{
+		{"api.example.com", "/conflict"},
+		{"API.Example.COM:8080", "/conflict"},
+		{"api.example.com.", "/conflict"},
+		{"www.example.com", "/wildcard"},
+		{"a.b.example.com", "/wildcard"},
+		{"x.eu.example.com", "/longer"},
+		{"api-1.eu.example.com", "/longer"},
+		{"example.com", ""},
+		{"api-1.internal", "/regex"},
+		{"api-x.internal", "/zzz-regex"},
+		{"bücher.example", "/exact"},
+		{"xn--bcher-kva.example", "/exact"},
+		{"www.example.org", "/trailing"},
+		{"[2001:db8::1]:80", "/ipv6"},
+		{"mixed.example.net", "/uppercased"},
+		{"other.net", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		service := index.Lookup(test.host)
+		id := ""
+		if service != nil {
+			id = service.ServiceId
+		}
+		if id != test.service {
+			t.Errorf("Expected host %q to map to %q, got %q.", test.host, test.service, id)
+		}
+	}
+}
+
+func TestValidateVhost(t *testing.T) {
+	for _, host := range []string{"example.com", "*.example.com", `~^a\.example\.com$`, "bücher.example"} {
+		if err := ValidateVhost(host); err != nil {
+			t.Errorf("Expected vhost %q to be valid. %v", host, err)
+		}
+	}
+	for _, host := range []string{"", ".", "*.", "~(", "~[a-"} {
+		if err := ValidateVhost(host); err == nil {
+			t.Errorf("Expected vhost %q to be invalid.", host)
+		}
+	}
+}
+
+// makeBenchmarkServices creates 10k services with mostly exact and wildcard
+// hosts, and a few regular expressions.
+func makeBenchmarkServices() map[string]*HttpService {
+	hosts := make(map[string][]string)
+	for i := 0; i < 10000; i++ {
+		var host string
+		switch {
+		case i%100 == 0:
+			host = fmt.Sprintf(`~^app-%v-[0-9]+\.example\.io$`, i)
+		case i%2 == 0:
+			host = fmt.Sprintf("*.app-%v.example.net", i)
+		default:
+			host = fmt.Sprintf("app-%v.example.com", i)
+		}
+		hosts[fmt.Sprintf("/app-%05d", i)] = []string{host}
+	}
+	return newHostIndexServices(hosts)
+}
+
+func BenchmarkHostIndexBuild(b *testing.B) {
+	services := makeBenchmarkServices()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		NewHostIndex(services)
+	}
+}
+
+func BenchmarkHostIndexLookup(b *testing.B) {
+	index := NewHostIndex(makeBenchmarkServices())
+	hosts := []string{
+		"app-4711.example.com",
+		"www.app-4712.example.net:8080",
+		"app-4700-1.example.io",
+		"unknown.example.org",
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		index.Lookup(hosts[i%len(hosts)])
+	}
+}
@@ -9,24 +9,92 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// latencyDecay is the time it takes for the latency EWMA to forget
+	// about a past latency peak.
+	latencyDecay = 10 * time.Second
+
+	// latencyPenalty is the cost of a backend with outstanding requests
+	// but no latency observed yet.
+	latencyPenalty = float64(time.Second)
+
+	// drainPollInterval is the interval at which draining backends are
+	// checked for still having active requests.
+	drainPollInterval = 100 * time.Millisecond
+
+	// defaultEjectionThreshold is the number of consecutive failures after
+	// which a backend is passively ejected, unless configured otherwise.
+	defaultEjectionThreshold = 3
+
+	// defaultEjectionTime is the time a passively ejected backend does not
+	// receive any requests, unless configured otherwise.
+	defaultEjectionTime = 10 * time.Second
+)
+
+type requestStartKey struct{}
+
+type proxyOutcomeKey struct{}
+
+// proxyOutcome is passed along with a request to a backend via its context,
+// for the service to learn about the response status, and whether or not
+// to retry the request on another backend.
+type proxyOutcome struct {
+	status         int
+	failed         bool // whether the backend failed to respond
+	retryable      bool // whether the response must be left untouched on failure
+	serviceId      string
+	backend        *HttpBackend  // the backend last tried
+	latency        time.Duration // the backend's time to first response byte
+	headerRules    *HeaderRules  // the service's rules for rewriting response headers
+	affinityCookie *http.Cookie  // binds the client to the backend, if not nil
+	retries        int
+}
+
+func getProxyOutcome(r *http.Request) *proxyOutcome {
+	outcome, _ := r.Context().Value(proxyOutcomeKey{}).(*proxyOutcome)
+	return outcome
+}
+
 type HttpBackend struct {
 	Id          string
 	Host        string
 	Port        uint
 	Capacity    int
-	CurrentLoad int
+	Weight      int
+	CurrentLoad int64
 	Alive       bool
 	ServedTotal uint64
+	Requests    StatusCounters
+	Duration    *Histogram // time to first response byte
+	Latency     *PeakEwma
+	Ejections   uint64
+	AliveSince  time.Time
+	SlowStart   time.Duration
 	proxy       *httputil.ReverseProxy
+	abort       chan struct{} // closed to forcefully abort all active requests
+
+	currentWeight       float64 // current weight for the weighted round robin scheduler
+	affinityToken       string  // opaque ID of this backend in affinity cookies
+	slowStartAggression float64
+	failures            int32 // consecutive failures
+	ejectionThreshold   int32 // consecutive failures to be ejected after
+	ejectionTime        int64 // in nanoseconds
+	ejectedUntil        int64 // in unix nanoseconds
+	drainUntil          int64 // in unix nanoseconds, zero unless draining
+	onEject             func()
+	adminOverride       atomic.Value // *AdminOverride
 }
 
-func NewHttpBackend(id string, host string, port uint, capacity int, alive bool) *HttpBackend {
+func NewHttpBackend(id string, host string, port uint, capacity int, weight int, alive bool) *HttpBackend {
 	targetHost := fmt.Sprintf("%v:%v", host, port)
 	director := func(req *http.Request) {
 		req.URL.Scheme = "http"
@@ -35,53 +103,228 @@ func NewHttpBackend(id string, host string, port uint, capacity int, alive bool)
 			req.Header.Set("User-Agent", "") // explicitely disable (avoid defaulting)
 		}
 	}
-	modifyResponse := func(rw *http.Response) error {
-		via := fmt.Sprintf("%v.%v sag", rw.Request.ProtoMajor, rw.Request.ProtoMinor)
-		rw.Header.Add("Via", via)
-		return nil
-	}
-	proxy := &httputil.ReverseProxy{
-		Director:       director,
-		ModifyResponse: modifyResponse,
-	}
 
 	backend := &HttpBackend{
 		Id:          id,
 		Host:        host,
 		Port:        port,
 		Capacity:    capacity,
+		Weight:      weight,
 		CurrentLoad: 0,
 		Alive:       alive,
-		proxy:       proxy,
+		Duration:    NewHistogram(),
+		Latency:     NewPeakEwma(latencyDecay),
+		abort:       make(chan struct{}),
+
+		ejectionThreshold: defaultEjectionThreshold,
+		ejectionTime:      int64(defaultEjectionTime),
+	}
+
+	backend.proxy = &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: backend.modifyResponse,
+		ErrorHandler:   backend.handleError,
+	}
+
+	if alive {
+		backend.AliveSince = time.Now()
 	}
 
 	return backend
 }
 
 func (backend *HttpBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// TODO: adjust alive stat, if failed (for up to N seconds, then reset)
+	atomic.AddUint64(&backend.ServedTotal, 1)
+
+	// abort the request (including upgraded connections) when the backend
+	// is forcefully closed after draining
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-backend.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	backend.ServedTotal++
+	// remember when the request was sent, to measure the time to first byte
+	req = req.WithContext(context.WithValue(ctx, requestStartKey{}, time.Now()))
 
-	backend.CurrentLoad++
+	atomic.AddInt64(&backend.CurrentLoad, 1)
 	backend.proxy.ServeHTTP(rw, req)
-	backend.CurrentLoad--
+	atomic.AddInt64(&backend.CurrentLoad, -1)
+}
+
+func (backend *HttpBackend) modifyResponse(rw *http.Response) error {
+	outcome := getProxyOutcome(rw.Request)
+
+	if start, ok := rw.Request.Context().Value(requestStartKey{}).(time.Time); ok {
+		elapsed := time.Since(start)
+		backend.Latency.Observe(elapsed)
+		backend.Duration.Observe(elapsed)
+		if outcome != nil {
+			outcome.latency = elapsed
+		}
+	}
+
+	backend.Requests.Inc(rw.StatusCode)
+	atomic.StoreInt32(&backend.failures, 0)
+
+	if outcome != nil {
+		outcome.status = rw.StatusCode
+	}
+
+	via := fmt.Sprintf("%v.%v sag", rw.Request.ProtoMajor, rw.Request.ProtoMinor)
+	rw.Header.Add("Via", via)
+
+	if outcome != nil && outcome.headerRules != nil {
+		outcome.headerRules.ApplyResponse(rw)
+	}
+
+	if outcome != nil && outcome.affinityCookie != nil {
+		rw.Header.Add("Set-Cookie", outcome.affinityCookie.String())
+	}
+
+	return nil
+}
+
+// handleError handles the failure to get a response from the backend.
+// The backend is passively ejected after too many consecutive failures.
+func (backend *HttpBackend) handleError(rw http.ResponseWriter, req *http.Request, err error) {
+	outcome := getProxyOutcome(req)
+	backend.Requests.Inc(http.StatusBadGateway)
+
+	// failures due to the client going away or the backend being aborted
+	// after draining are none of the backend's fault
+	if req.Context().Err() == nil {
+		log.Printf("Backend %v failed. %v", backend, err)
+		if atomic.AddInt32(&backend.failures, 1) >= atomic.LoadInt32(&backend.ejectionThreshold) {
+			backend.eject()
+		}
+		if outcome != nil && outcome.retryable {
+			outcome.failed = true
+			return
+		}
+	}
+
+	if outcome != nil {
+		outcome.status = http.StatusBadGateway
+	}
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// SetEjection configures the backend to be passively ejected for the given
+// duration after the given number of consecutive failures. Zero values
+// stand for the defaults.
+func (backend *HttpBackend) SetEjection(threshold int, duration time.Duration) {
+	if threshold <= 0 {
+		threshold = defaultEjectionThreshold
+	}
+	if duration <= 0 {
+		duration = defaultEjectionTime
+	}
+
+	atomic.StoreInt32(&backend.ejectionThreshold, int32(threshold))
+	atomic.StoreInt64(&backend.ejectionTime, int64(duration))
+}
+
+// eject keeps the backend from receiving any requests for its ejection time.
+func (backend *HttpBackend) eject() {
+	threshold := atomic.LoadInt32(&backend.ejectionThreshold)
+	duration := time.Duration(atomic.LoadInt64(&backend.ejectionTime))
+
+	atomic.StoreInt32(&backend.failures, 0)
+	atomic.StoreInt64(&backend.ejectedUntil, time.Now().Add(duration).UnixNano())
+	atomic.AddUint64(&backend.Ejections, 1)
+
+	log.Printf("Backend %v failed %v times in a row. Ejecting for %v.", backend, threshold, duration)
+
+	if backend.onEject != nil {
+		backend.onEject()
+	}
+}
+
+// IsDraining tests whether the backend has been removed and is finishing
+// its active requests.
+func (backend *HttpBackend) IsDraining() bool {
+	return atomic.LoadInt64(&backend.drainUntil) != 0
+}
+
+// IsEjected tests whether the backend is currently passively ejected.
+func (backend *HttpBackend) IsEjected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&backend.ejectedUntil)
+}
+
+func (backend *HttpBackend) GetCurrentLoad() int {
+	return int(atomic.LoadInt64(&backend.CurrentLoad))
+}
+
+// GetLatencyCost returns the expected cost of sending a request to this
+// backend, as its peak EWMA latency weighted by the outstanding requests.
+func (backend *HttpBackend) GetLatencyCost() float64 {
+	rtt := float64(backend.Latency.Value())
+	pending := float64(backend.GetCurrentLoad())
+
+	if rtt == 0 && pending != 0 {
+		return latencyPenalty + pending
+	}
+
+	return rtt * (pending + 1)
 }
 
 func (backend *HttpBackend) IsAvailable() bool {
-	return backend.Alive && (backend.Capacity == 0 || backend.CurrentLoad < backend.Capacity)
+	return backend.getAdminState() == AdminEnabled && backend.canServe()
+}
+
+// canServe tests whether the backend is able to take another request,
+// regardless of its admin state.
+func (backend *HttpBackend) canServe() bool {
+	capacity := backend.GetEffectiveCapacity()
+	return backend.Alive && !backend.IsDraining() && !backend.IsEjected() &&
+		(capacity == 0 || backend.GetCurrentLoad() < capacity)
+}
+
+// Drain lets all active requests finish for up to the given timeout,
+// and then aborts the remaining ones. The backend must not receive any new
+// requests. done is invoked once the backend has no active requests anymore.
+func (backend *HttpBackend) Drain(timeout time.Duration, done func()) {
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt64(&backend.drainUntil, deadline.UnixNano())
+
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+
+		aborted := false
+		for backend.GetCurrentLoad() > 0 {
+			if !aborted && time.Now().After(deadline) {
+				log.Printf("Backend %v did not drain within %v. Aborting %v active requests.",
+					backend, timeout, backend.GetCurrentLoad())
+				close(backend.abort)
+				aborted = true
+			}
+			<-ticker.C
+		}
+
+		done()
+	}()
 }
 
-func (backend *HttpBackend) SetAlive(alive bool) {
+// SetAlive changes the backend's health, returning false if unchanged.
+func (backend *HttpBackend) SetAlive(alive bool) bool {
 	if backend.Alive != alive {
 		backend.Alive = alive
 
 		if alive {
+			backend.AliveSince = time.Now()
 			log.Printf("Backend is alive. %v", backend)
 		} else {
 			log.Printf("Backend is dead. %v", backend)
 		}
+		return true
 	}
+	return false
 }
 
 func (backend *HttpBackend) String() string {
@@ -9,53 +9,204 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type HttpRouter struct {
-	Id         string
-	ListenAddr net.IP
-	ListenPort uint
-	listener   net.Listener
-	getService func(*http.Request) *HttpService
+	Id            string
+	ListenAddr    net.IP
+	ListenPort    uint
+	Routing       string       // how requests are routed to services, such as by vhost
+	AccessLog     *AccessLog   // optional
+	tlsConfig     atomic.Value // *tls.Config, terminating TLS if not nil
+	proxyProtocol atomic.Value // *ProxyProtocolPolicy, accepting PROXY protocol headers if not nil
+	forwarding    atomic.Value // *ForwardingPolicy, passing on forwarding headers as is if nil
+	listener      net.Listener
+	server        *http.Server
+	getService    func(*http.Request) *HttpService
 }
 
-func NewHttpRouter(id string, addr net.IP, port uint, getService func(*http.Request) *HttpService) *HttpRouter {
-	return &HttpRouter{
+func NewHttpRouter(id string, addr net.IP, port uint, routing string, getService func(*http.Request) *HttpService) *HttpRouter {
+	router := &HttpRouter{
 		Id:         id,
 		ListenAddr: addr,
 		ListenPort: port,
-		listener:   nil,
+		Routing:    routing,
 		getService: getService,
 	}
+
+	router.server = &http.Server{Handler: router}
+
+	return router
 }
 
 func (router *HttpRouter) Run() {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%v:%v", router.ListenAddr, router.ListenPort))
-	if err != nil {
+	if err := router.Listen(); err != nil {
 		log.Fatal(err)
 	}
 
-	router.listener = listener
+	router.Serve()
+}
+
+// Address returns the address the router listens on.
+func (router *HttpRouter) Address() string {
+	return net.JoinHostPort(router.ListenAddr.String(), fmt.Sprint(router.ListenPort))
+}
 
-	err = http.Serve(listener, router)
+// Listen opens the router's listening socket, without accepting any
+// connections yet.
+func (router *HttpRouter) Listen() error {
+	listener, err := Listen(router.Address())
 	if err != nil {
+		return err
+	}
+
+	router.listener = &routerListener{Listener: listener, router: router}
+	return nil
+}
+
+// Serve accepts connections on the router's listening socket until the
+// router is shut down.
+func (router *HttpRouter) Serve() {
+	err := router.server.Serve(router.listener)
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
 
+// SetTLSConfig changes the TLS configuration for all new connections,
+// disabling TLS if nil.
+func (router *HttpRouter) SetTLSConfig(config *tls.Config) {
+	router.tlsConfig.Store(config)
+}
+
+func (router *HttpRouter) getTLSConfig() *tls.Config {
+	config, _ := router.tlsConfig.Load().(*tls.Config)
+	return config
+}
+
+// SetProxyProtocol makes new connections accept PROXY protocol headers as
+// of the given policy, or disables it if nil.
+func (router *HttpRouter) SetProxyProtocol(policy *ProxyProtocolPolicy) {
+	router.proxyProtocol.Store(policy)
+}
+
+func (router *HttpRouter) getProxyProtocol() *ProxyProtocolPolicy {
+	policy, _ := router.proxyProtocol.Load().(*ProxyProtocolPolicy)
+	return policy
+}
+
+// SetForwarding sets the policy for passing on the forwarding headers of
+// requests to the backends.
+func (router *HttpRouter) SetForwarding(policy *ForwardingPolicy) {
+	router.forwarding.Store(policy)
+}
+
+func (router *HttpRouter) getForwarding() *ForwardingPolicy {
+	policy, _ := router.forwarding.Load().(*ForwardingPolicy)
+	return policy
+}
+
+// Protocol returns the protocol spoken by the router's clients.
+func (router *HttpRouter) Protocol() string {
+	if router.getTLSConfig() != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Shutdown stops accepting new connections and waits for all active
+// requests to finish, or until the context is done.
+func (router *HttpRouter) Shutdown(ctx context.Context) error {
+	return router.server.Shutdown(ctx)
+}
+
+// Close immediately closes the listener and all active connections.
 func (router *HttpRouter) Close() {
-	router.listener.Close()
+	router.server.Close()
+}
+
+func (router *HttpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router.AccessLog == nil || !router.AccessLog.Enabled() {
+		router.serve(w, r)
+		return
+	}
+
+	start := time.Now()
+	outcome := &proxyOutcome{}
+	r = r.WithContext(context.WithValue(r.Context(), proxyOutcomeKey{}, outcome))
+	lw := &accessLogWriter{ResponseWriter: w}
+
+	router.serve(lw, r)
+
+	entry := &AccessLogEntry{
+		Time:            start,
+		RemoteAddr:      r.RemoteAddr,
+		Method:          r.Method,
+		URI:             r.RequestURI,
+		Proto:           r.Proto,
+		Host:            r.Host,
+		Status:          lw.Status(),
+		Bytes:           lw.bytes,
+		Duration:        time.Since(start),
+		UpstreamLatency: outcome.latency,
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+		Routing:         router.Routing,
+		ServiceId:       outcome.serviceId,
+		Retries:         outcome.retries,
+	}
+	if outcome.backend != nil {
+		entry.BackendId = outcome.backend.Id
+		entry.Upstream = outcome.backend.String()
+	}
+
+	router.AccessLog.Log(entry)
 }
 
-func (router HttpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (router *HttpRouter) serve(w http.ResponseWriter, r *http.Request) {
 	if service := router.getService(r); service != nil {
+		policy := router.getForwarding()
+		if service.Redirect(w, r, policy.Scheme(r)) {
+			return
+		}
+		if policy != nil {
+			policy.Apply(r)
+		}
 		service.ServeHTTP(w, r)
 	} else {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "No service found for request host header %q\n", r.Host)
 	}
 }
+
+// routerListener reads the PROXY protocol header and terminates TLS on the
+// accepted connections as of the router's configuration at the time.
+type routerListener struct {
+	net.Listener
+	router *HttpRouter
+}
+
+func (l *routerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy := l.router.getProxyProtocol(); policy != nil {
+		conn = policy.Wrap(conn)
+	}
+
+	if config := l.router.getTLSConfig(); config != nil {
+		return tls.Server(conn, config), nil
+	}
+
+	return conn, nil
+}
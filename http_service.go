@@ -9,20 +9,74 @@
 package main
 
 import (
+	"context"
 	"log"
+	"math/rand"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/christianparpart/sag/marathon"
 )
 
+// defaultMaxRetries is the number of times a request is retried on another
+// backend if its backend failed to respond, unless configured otherwise.
+const defaultMaxRetries = 2
+
+// backendSet is a set of backends, such as the ones a request has already
+// been tried on. It only ever holds a few backends, hence the slice.
+type backendSet []*HttpBackend
+
+func (set backendSet) contains(backend *HttpBackend) bool {
+	for _, b := range set {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// isCandidate tests whether the backend may serve a request that has
+// already been tried on the given backends.
+func isCandidate(backend *HttpBackend, tried backendSet) bool {
+	return backend.IsAvailable() && !tried.contains(backend)
+}
+
 // HttpService implements Service interface for HTTP services
 type HttpService struct {
-	ServiceId        string
-	Scheduler        SchedulingAlgorithm
-	Hosts            []string
-	Backends         []*HttpBackend
-	lastBackendIndex int
-	selectBackend    func() *HttpBackend
+	ServiceId         string
+	Scheduler         SchedulingAlgorithm
+	Hosts             []string // all hosts routed to the service
+	SslHosts          []string // hosts to be accessed by HTTPS
+	Aliases           []string // hosts redirecting to the canonical host
+	CanonicalHost     string
+	RedirectHttps     bool // whether or not to redirect plain HTTP requests to SslHosts to HTTPS
+	RedirectStatus    int
+	HashKey           HashKey
+	StickyCookie      string // name of the affinity cookie, if sticky sessions are enabled
+	DrainTimeout      time.Duration
+	SlowStart         time.Duration     // time to ramp up new backends' share of traffic
+	SlowStartCurve    float64           // aggression of the slow start ramp (1.0 = linear)
+	MaxRetries        int               // times to retry idempotent requests on other backends
+	EjectionThreshold int               // consecutive failures after which a backend is ejected
+	EjectionTime      time.Duration     // time an ejected backend does not receive any requests
+	HeaderRuleLabels  map[string]string // header rules from service discovery
+	Backends          []*HttpBackend
+	Draining          []*HttpBackend // removed backends still finishing their requests
+	Requests          StatusCounters
+	Duration          *Histogram
+	Retries           uint64
+	Ejections         uint64
+	lastBackendIndex  int
+	affinity          map[string]*HttpBackend // backends by their affinity token
+	ring              *HashRing               // for the hash scheduler, see updateRing
+	ringStale         bool                    // whether the ring must be rebuilt
+	selectBackend     func(r *http.Request, tried backendSet) *HttpBackend
+	onDrained         func(backendId string)
+	discovered        *AddHttpServiceEvent // settings as last discovered
+	headerRules       atomic.Value         // *HeaderRules, rewriting request and response headers if not nil
+	mutex             sync.Mutex
 }
 
 func (service *HttpService) String() string {
@@ -33,13 +87,39 @@ func NewHttpService(serviceId string, Scheduler SchedulingAlgorithm, hosts []str
 	log.Printf("New service HTTP %v", serviceId)
 
 	service := &HttpService{
-		ServiceId: serviceId,
-		Scheduler: Scheduler,
-		Hosts:     hosts,
-		Backends:  make([]*HttpBackend, 0),
+		ServiceId:         serviceId,
+		Scheduler:         Scheduler,
+		Hosts:             hosts,
+		HashKey:           HashKey{Source: HashByClientIP},
+		MaxRetries:        defaultMaxRetries,
+		EjectionThreshold: defaultEjectionThreshold,
+		EjectionTime:      defaultEjectionTime,
+		Backends:          make([]*HttpBackend, 0),
+		Duration:          NewHistogram(),
+		affinity:          make(map[string]*HttpBackend),
 	}
 
-	service.selectBackend = service.RoundRobinScheduler
+	switch Scheduler {
+	case SchedulerLeastLoad:
+		service.selectBackend = service.LeastLoadScheduler
+	case SchedulerChance:
+		service.selectBackend = service.ChanceScheduler
+	case SchedulerWeightedRoundRobin:
+		service.selectBackend = service.WeightedRoundRobinScheduler
+	case SchedulerP2C:
+		service.selectBackend = service.P2CScheduler
+	case SchedulerPeakEwma:
+		service.selectBackend = service.PeakEwmaScheduler
+	case SchedulerHash:
+		service.selectBackend = service.HashScheduler
+	case SchedulerRoundRobin:
+		service.selectBackend = service.RoundRobinScheduler
+	default:
+		log.Printf("Unknown scheduler %q for service %v. Falling back to %v.",
+			Scheduler, serviceId, SchedulerRoundRobin)
+		service.Scheduler = SchedulerRoundRobin
+		service.selectBackend = service.RoundRobinScheduler
+	}
 
 	return service
 }
@@ -47,35 +127,66 @@ func NewHttpService(serviceId string, Scheduler SchedulingAlgorithm, hosts []str
 func (service *HttpService) Close() {
 }
 
+// IsEmpty tests whether the service has neither any backends nor any
+// backends still draining.
 func (service *HttpService) IsEmpty() bool {
-	return len(service.Backends) == 0
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	return len(service.Backends) == 0 && len(service.Draining) == 0
 }
 
-func (service *HttpService) AddBackend(id string, host string, port uint, capacity int, alive bool) {
+// AddBackend adds a new backend, returning false if it is already present.
+func (service *HttpService) AddBackend(id string, host string, port uint, capacity int, weight int, alive bool) bool {
+	defer service.updateRing()
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
 	// XXX only add backend if not already present
 	for _, backend := range service.Backends {
 		if backend.Id == id {
-			return
+			return false
 		}
 	}
 
-	backend := NewHttpBackend(id, host, port, capacity, alive)
+	backend := NewHttpBackend(id, host, port, capacity, weight, alive)
+	backend.affinityToken = makeAffinityToken(service.ServiceId, id)
+	backend.SetSlowStart(service.SlowStart, service.SlowStartCurve)
+	backend.SetEjection(service.EjectionThreshold, service.EjectionTime)
+	backend.onEject = func() { atomic.AddUint64(&service.Ejections, 1) }
 	service.Backends = append(service.Backends, backend)
+	service.affinity[backend.affinityToken] = backend
+	service.ringStale = true
 	log.Printf("New backend %v for %v with ID %v (%v)", backend, service.ServiceId, id, marathon.HealthStatus(alive))
+	return true
 }
 
-func (service *HttpService) RemoveBackend(id string) {
+// RemoveBackend starts draining the given backend, returning false if
+// there is no such backend.
+func (service *HttpService) RemoveBackend(id string) bool {
+	defer service.updateRing()
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
 	for i, backend := range service.Backends {
 		if id == backend.Id {
-			log.Printf("Remove backend %v from %v", backend, service)
+			log.Printf("Remove backend %v from %v, draining for up to %v", backend, service, service.DrainTimeout)
 			service.Backends = append(service.Backends[:i], service.Backends[i+1:]...)
-			return
+			delete(service.affinity, backend.affinityToken)
+			service.ringStale = true
+			service.Draining = append(service.Draining, backend)
+			backend.Drain(service.DrainTimeout, func() { service.finishDrain(backend) })
+			return true
 		}
 	}
 	log.Printf("No backend %v found in service %v", id, service)
+	return false
 }
 
 func (service *HttpService) GetBackendById(id string) *HttpBackend {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
 	for _, backend := range service.Backends {
 		if backend.Id == id {
 			return backend
@@ -84,20 +195,155 @@ func (service *HttpService) GetBackendById(id string) *HttpBackend {
 	return nil
 }
 
+// finishDrain forgets about the given backend once it has been drained.
+func (service *HttpService) finishDrain(backend *HttpBackend) {
+	service.mutex.Lock()
+	for i, b := range service.Draining {
+		if b == backend {
+			service.Draining = append(service.Draining[:i], service.Draining[i+1:]...)
+			break
+		}
+	}
+	service.mutex.Unlock()
+
+	log.Printf("Backend %v of %v drained", backend, service)
+
+	if service.onDrained != nil {
+		service.onDrained(backend.Id)
+	}
+}
+
+// SetBackendWeight changes the weight of the given backend at runtime.
+func (service *HttpService) SetBackendWeight(id string, weight int) bool {
+	defer service.updateRing()
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for _, backend := range service.Backends {
+		if backend.Id == id {
+			if backend.Weight != weight {
+				log.Printf("Changing weight of backend %v in %v from %v to %v",
+					backend, service, backend.Weight, weight)
+				backend.Weight = weight
+				service.resetWeights()
+				service.ringStale = true
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetBackendAdminState overrides the state of the given backend.
+func (service *HttpService) SetBackendAdminState(id string, state AdminState, reason string, duration time.Duration) bool {
+	backend := service.GetBackendById(id)
+	if backend == nil {
+		return false
+	}
+
+	backend.SetAdminState(state, reason, duration)
+	return true
+}
+
+// SetHeaderRules sets the rules for rewriting the headers of requests and
+// responses, or disables rewriting if nil.
+func (service *HttpService) SetHeaderRules(rules *HeaderRules) {
+	service.headerRules.Store(rules)
+}
+
+func (service *HttpService) getHeaderRules() *HeaderRules {
+	rules, _ := service.headerRules.Load().(*HeaderRules)
+	return rules
+}
+
+// ServeHTTP proxies the request to a backend chosen by the scheduler.
+// Idempotent requests without a body are retried on up to MaxRetries other
+// backends if the backend fails to respond.
 func (service *HttpService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if backend := service.selectBackend(); backend != nil {
+	start := time.Now()
+	outcome := getProxyOutcome(r)
+	if outcome == nil {
+		outcome = &proxyOutcome{}
+		r = r.WithContext(context.WithValue(r.Context(), proxyOutcomeKey{}, outcome))
+	}
+	outcome.serviceId = service.ServiceId
+
+	if rules := service.getHeaderRules(); rules != nil {
+		rules.ApplyRequest(r)
+		outcome.headerRules = rules
+	}
+
+	var tried backendSet
+	for {
+		backend, cookie, maxRetries := service.pickBackend(r, tried)
+		if backend == nil {
+			outcome.status = http.StatusServiceUnavailable
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+
+		outcome.backend = backend
+		outcome.affinityCookie = cookie
+		outcome.retryable = len(tried) < maxRetries && isRetryable(r)
 		backend.ServeHTTP(w, r)
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
+		if !outcome.failed {
+			break
+		}
+
+		tried = append(tried, backend)
+		outcome.failed = false
+		outcome.retries++
+		atomic.AddUint64(&service.Retries, 1)
+	}
+
+	service.Requests.Inc(outcome.status)
+	service.Duration.Observe(time.Since(start))
+}
+
+// pickBackend chooses the backend to serve the given request out of the
+// backends not tried yet, honoring the client's affinity cookie, if sticky
+// sessions are enabled.
+//
+// The returned cookie binds the client to the chosen backend, and is to be
+// sent along with the response, if not nil. The service's current retry
+// limit is returned as well.
+func (service *HttpService) pickBackend(r *http.Request, tried backendSet) (*HttpBackend, *http.Cookie, int) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	sticky := len(service.StickyCookie) != 0
+
+	if sticky {
+		if backend := service.getStickyBackend(r, tried); backend != nil {
+			return backend, nil, service.MaxRetries
+		}
+	}
+
+	backend := service.selectBackend(r, tried)
+	if backend != nil && sticky {
+		return backend, service.makeAffinityCookie(r, backend), service.MaxRetries
+	}
+
+	return backend, nil, service.MaxRetries
+}
+
+// isRetryable tests whether the request can be safely sent once more.
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.ContentLength == 0 && len(r.TransferEncoding) == 0
+	default:
+		return false
 	}
 }
 
-func (service *HttpService) LeastLoadScheduler() *HttpBackend {
-	i, leastLoaded := service.getFirstAvailableBackend()
+func (service *HttpService) LeastLoadScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	i, leastLoaded := service.getFirstAvailableBackend(tried)
 
 	if leastLoaded != nil {
 		for _, backend := range service.Backends[i:] {
-			if backend.IsAvailable() && backend.CurrentLoad < leastLoaded.CurrentLoad {
+			if isCandidate(backend, tried) && backend.getEffectiveLoad() < leastLoaded.getEffectiveLoad() {
 				leastLoaded = backend
 			}
 		}
@@ -106,31 +352,190 @@ func (service *HttpService) LeastLoadScheduler() *HttpBackend {
 	return leastLoaded
 }
 
-func (service *HttpService) RoundRobinScheduler() *HttpBackend {
-	if len(service.Backends) == 0 {
+func (service *HttpService) RoundRobinScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	var first *HttpBackend
+
+	// skip unavailable backends, and backends still ramping up in
+	// proportion to their slow start
+	for i := 0; i < len(service.Backends); i++ {
+		if service.lastBackendIndex+1 < len(service.Backends) {
+			service.lastBackendIndex = service.lastBackendIndex + 1
+		} else {
+			service.lastBackendIndex = 0
+		}
+
+		backend := service.Backends[service.lastBackendIndex]
+		if !isCandidate(backend, tried) {
+			continue
+		}
+		if backend.acceptRamp() {
+			return backend
+		}
+		if first == nil {
+			first = backend
+		}
+	}
+
+	return first
+}
+
+// WeightedRoundRobinScheduler implements the smooth weighted round robin
+// algorithm (as known from nginx), spreading the picks of each backend
+// evenly across a full round instead of picking it in bursts.
+func (service *HttpService) WeightedRoundRobinScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	var best *HttpBackend
+	total := 0.0
+
+	for _, backend := range service.Backends {
+		if !isCandidate(backend, tried) || backend.Weight <= 0 {
+			continue
+		}
+
+		weight := backend.GetEffectiveWeight()
+		backend.currentWeight += weight
+		total += weight
+
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+
+	if best != nil {
+		best.currentWeight -= total
+	}
+
+	return best
+}
+
+// P2CScheduler picks two random backends and chooses the one with fewer
+// requests in flight ("power of two choices").
+func (service *HttpService) P2CScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	a, b := service.pickTwoAvailableBackends(tried)
+	if b != nil && b.getEffectiveLoad() < a.getEffectiveLoad() {
+		return b
+	}
+	return a
+}
+
+// PeakEwmaScheduler picks two random backends and chooses the one with the
+// lower peak EWMA latency, weighted by its requests in flight.
+func (service *HttpService) PeakEwmaScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	a, b := service.pickTwoAvailableBackends(tried)
+	if b != nil && b.GetLatencyCost()/b.GetRampFactor() < a.GetLatencyCost()/a.GetRampFactor() {
+		return b
+	}
+	return a
+}
+
+// HashScheduler consistently maps requests to backends by the service's
+// HashKey, such that requests with the same key hit the same backend
+// while the set of backends changes.
+func (service *HttpService) HashScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	if service.ring == nil {
 		return nil
 	}
 
-	if service.lastBackendIndex+1 < len(service.Backends) {
-		service.lastBackendIndex = service.lastBackendIndex + 1
-	} else {
-		service.lastBackendIndex = 0
+	return service.ring.Get(service.HashKey.Extract(r), tried)
+}
+
+// updateRing rebuilds the hash ring after the backends or their weights
+// changed. The ring is built without holding the service's lock, so that
+// requests are not held up meanwhile. As the backends only change within
+// the event processing, so does the ring.
+func (service *HttpService) updateRing() {
+	if service.Scheduler != SchedulerHash {
+		return
+	}
+
+	service.mutex.Lock()
+	if !service.ringStale {
+		service.mutex.Unlock()
+		return
 	}
+	backends := make([]*HttpBackend, len(service.Backends))
+	copy(backends, service.Backends)
+	service.ringStale = false
+	service.mutex.Unlock()
 
-	return service.Backends[service.lastBackendIndex]
+	ring := NewHashRing(backends)
+
+	service.mutex.Lock()
+	service.ring = ring
+	service.mutex.Unlock()
 }
 
-func (service *HttpService) ChanceScheduler() *HttpBackend {
-	_, backend := service.getFirstAvailableBackend()
-	return backend
+func (service *HttpService) ChanceScheduler(r *http.Request, tried backendSet) *HttpBackend {
+	_, first := service.getFirstAvailableBackend(tried)
+
+	// skip backends still ramping up, in proportion to their slow start
+	for _, backend := range service.Backends {
+		if isCandidate(backend, tried) && backend.acceptRamp() {
+			return backend
+		}
+	}
+
+	return first
 }
 
-func (service *HttpService) getFirstAvailableBackend() (int, *HttpBackend) {
+func (service *HttpService) getFirstAvailableBackend(tried backendSet) (int, *HttpBackend) {
 	for i, backend := range service.Backends {
-		if backend.IsAvailable() {
+		if isCandidate(backend, tried) {
 			return i, backend
 		}
 	}
 
 	return len(service.Backends), nil
 }
+
+// resetWeights restarts the weighted round robin rounds, such as after
+// any backend's weight was changed.
+func (service *HttpService) resetWeights() {
+	for _, backend := range service.Backends {
+		backend.currentWeight = 0
+	}
+}
+
+// pickTwoAvailableBackends returns two distinct random available backends.
+// The second one is nil if there is only one available backend, and both
+// are nil if there is none.
+func (service *HttpService) pickTwoAvailableBackends(tried backendSet) (*HttpBackend, *HttpBackend) {
+	n := len(service.Backends)
+	if n == 0 {
+		return nil, nil
+	}
+
+	// fast path: two random picks out of all backends
+	if n > 1 {
+		i := rand.Intn(n)
+		j := rand.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		a, b := service.Backends[i], service.Backends[j]
+		if isCandidate(a, tried) && isCandidate(b, tried) {
+			return a, b
+		}
+	}
+
+	// slow path: pick out of the available backends only
+	available := make([]*HttpBackend, 0, n)
+	for _, backend := range service.Backends {
+		if isCandidate(backend, tried) {
+			available = append(available, backend)
+		}
+	}
+
+	switch len(available) {
+	case 0:
+		return nil, nil
+	case 1:
+		return available[0], nil
+	default:
+		i := rand.Intn(len(available))
+		j := rand.Intn(len(available) - 1)
+		if j >= i {
+			j++
+		}
+		return available[i], available[j]
+	}
+}
@@ -0,0 +1,170 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newSchedulerTestService creates a service of the given scheduler with n
+// alive backends of various loads and latencies.
+func newSchedulerTestService(scheduler SchedulingAlgorithm, n int) *HttpService {
+	service := NewHttpService("/test", scheduler, nil)
+	for i := 0; i < n; i++ {
+		backend := NewHttpBackend(fmt.Sprintf("task-%v", i), "127.0.0.1", uint(10000+i), 0, 1, true)
+		backend.CurrentLoad = int64(i % 7)
+		backend.Latency.Observe(time.Duration(1+i%5) * time.Millisecond)
+		service.Backends = append(service.Backends, backend)
+	}
+	return service
+}
+
+func TestP2CSchedulerSkipsUnavailableBackends(t *testing.T) {
+	for _, scheduler := range []SchedulingAlgorithm{SchedulerP2C, SchedulerPeakEwma} {
+		for _, available := range []int{1, 2} {
+			service := newSchedulerTestService(scheduler, 10)
+			for i, backend := range service.Backends[available:] {
+				switch i % 3 {
+				case 0:
+					backend.Alive = false
+				case 1:
+					backend.drainUntil = time.Now().Add(time.Hour).UnixNano()
+				case 2:
+					backend.Capacity = 1
+					backend.CurrentLoad = 1
+				}
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			for i := 0; i < 1000; i++ {
+				backend := service.selectBackend(r, nil)
+				if backend == nil || !backend.IsAvailable() {
+					t.Fatalf("%v picked unavailable backend %v out of %v available ones.", scheduler, backend, available)
+				}
+			}
+		}
+	}
+}
+
+func TestP2CSchedulerWithoutAvailableBackends(t *testing.T) {
+	service := newSchedulerTestService(SchedulerP2C, 3)
+	for _, backend := range service.Backends {
+		backend.Alive = false
+	}
+
+	if backend := service.selectBackend(httptest.NewRequest("GET", "/", nil), nil); backend != nil {
+		t.Fatalf("Unexpected backend %v.", backend)
+	}
+}
+
+func benchmarkScheduler(b *testing.B, scheduler SchedulingAlgorithm) {
+	service := newSchedulerTestService(scheduler, 32)
+	service.Backends[3].Alive = false
+	service.Backends[17].drainUntil = time.Now().Add(time.Hour).UnixNano()
+	r := httptest.NewRequest("GET", "/", nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		service.selectBackend(r, nil)
+	}
+}
+
+func BenchmarkSchedulerRoundRobin(b *testing.B) { benchmarkScheduler(b, SchedulerRoundRobin) }
+func BenchmarkSchedulerLeastLoad(b *testing.B)  { benchmarkScheduler(b, SchedulerLeastLoad) }
+func BenchmarkSchedulerP2C(b *testing.B)        { benchmarkScheduler(b, SchedulerP2C) }
+func BenchmarkSchedulerPeakEwma(b *testing.B)   { benchmarkScheduler(b, SchedulerPeakEwma) }
+
+// newRetryTestService creates a service of the given scheduler with a
+// backend refusing connections and a backend serving requests.
+func newRetryTestService(t *testing.T, scheduler SchedulingAlgorithm) (*HttpService, *HttpBackend, *HttpBackend) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	servingPort := server.Listener.Addr().(*net.TCPAddr).Port
+
+	service := NewHttpService("/test", scheduler, nil)
+	service.StickyCookie = "sticky"
+	service.AddBackend("refused", "127.0.0.1", uint(refusedPort), 0, 1, true)
+	service.AddBackend("serving", "127.0.0.1", uint(servingPort), 0, 1, true)
+
+	return service, service.GetBackendById("refused"), service.GetBackendById("serving")
+}
+
+func TestHttpServiceRetriesOnOtherBackends(t *testing.T) {
+	for _, scheduler := range []SchedulingAlgorithm{SchedulerRoundRobin, SchedulerHash} {
+		service, refused, serving := newRetryTestService(t, scheduler)
+		cookie := makeAffinityCookieValue(service.ServiceId, refused.affinityToken)
+
+		for i := 0; i < 4; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "sticky", Value: cookie})
+			w := httptest.NewRecorder()
+			service.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%v: expected the request to be retried on the serving backend, got %v.", scheduler, w.Code)
+			}
+
+			cookies := w.Result().Cookies()
+			expected := makeAffinityCookieValue(service.ServiceId, serving.affinityToken)
+			if len(cookies) != 1 || cookies[0].Value != expected {
+				t.Fatalf("%v: expected a single affinity cookie for the serving backend, got %v.", scheduler, cookies)
+			}
+		}
+	}
+}
+
+func TestHttpServiceMaxRetries(t *testing.T) {
+	service, refused, _ := newRetryTestService(t, SchedulerRoundRobin)
+	service.MaxRetries = 0
+	cookie := makeAffinityCookieValue(service.ServiceId, refused.affinityToken)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sticky", Value: cookie})
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected the request not to be retried, got %v.", w.Code)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no affinity cookie for a failed request, got %v.", cookies)
+	}
+}
+
+func TestWeightedRoundRobinSchedulerIsSmooth(t *testing.T) {
+	service := NewHttpService("/test", SchedulerWeightedRoundRobin, nil)
+	service.AddBackend("a", "127.0.0.1", 10000, 0, 5, true)
+	service.AddBackend("b", "127.0.0.1", 10001, 0, 1, true)
+	service.AddBackend("c", "127.0.0.1", 10002, 0, 1, true)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for round := 0; round < 3; round++ {
+		sequence := ""
+		for i := 0; i < 7; i++ {
+			sequence += service.selectBackend(r, nil).Id
+		}
+		if sequence != "aabacaa" {
+			t.Fatalf("Expected the smooth sequence aabacaa in round %v, got %v.", round, sequence)
+		}
+	}
+}
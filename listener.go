@@ -0,0 +1,237 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inheritedListenersEnv names the environment variable that lists the
+// addresses of the listening sockets passed on to a new sag process,
+// in the order of their file descriptors, starting at fd 3.
+const inheritedListenersEnv = "SAG_LISTENERS"
+
+// inheritedListenersTimeout is the time for claiming the inherited listening
+// sockets, including the ones of service ports still to be discovered.
+const inheritedListenersTimeout = time.Minute
+
+// readyFdEnv names the environment variable that holds the file descriptor
+// a new sag process reports its readiness to the parent process on.
+const readyFdEnv = "SAG_READY_FD"
+
+// handoverTimeout is the time for a new sag process to get ready to serve,
+// before the parent process gives up on handing over to it.
+const handoverTimeout = 30 * time.Second
+
+var (
+	listenersMutex     sync.Mutex
+	inheritedListeners = loadInheritedListeners()
+	activeListeners    = make(map[string]*net.TCPListener)
+)
+
+// Listen creates a TCP listener on the given address, reusing the listening
+// socket inherited from the parent sag process, if any.
+func Listen(addr string) (net.Listener, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	if _, ok := activeListeners[addr]; ok {
+		return nil, fmt.Errorf("Already listening on %v.", addr)
+	}
+
+	listener, ok := inheritedListeners[addr]
+	if ok {
+		log.Printf("Reusing inherited listener %v", addr)
+		delete(inheritedListeners, addr)
+	} else {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener = l.(*net.TCPListener)
+	}
+
+	activeListeners[addr] = listener
+
+	return &trackedListener{listener, addr}, nil
+}
+
+// CloseInheritedListeners closes the inherited listening sockets that have
+// not been claimed, such as of listeners removed from the configuration,
+// which would otherwise keep their ports open without accepting any
+// connections.
+func CloseInheritedListeners() {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	for addr, listener := range inheritedListeners {
+		log.Printf("Closing unused inherited listener %v", addr)
+		listener.Close()
+		delete(inheritedListeners, addr)
+	}
+}
+
+// countListeners returns the number of active listeners.
+func countListeners() int {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	return len(activeListeners)
+}
+
+// GetListenerAddrs returns the sorted addresses of all active listeners.
+func GetListenerAddrs() []string {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	addrs := make([]string, 0, len(activeListeners))
+	for addr := range activeListeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// trackedListener unregisters itself from the active listeners upon Close.
+type trackedListener struct {
+	*net.TCPListener
+	addr string
+}
+
+func (l *trackedListener) Close() error {
+	listenersMutex.Lock()
+	if activeListeners[l.addr] == l.TCPListener {
+		delete(activeListeners, l.addr)
+	}
+	listenersMutex.Unlock()
+
+	return l.TCPListener.Close()
+}
+
+func loadInheritedListeners() map[string]*net.TCPListener {
+	listeners := make(map[string]*net.TCPListener)
+
+	value := os.Getenv(inheritedListenersEnv)
+	if len(value) == 0 {
+		return listeners
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	for i, addr := range strings.Split(value, ",") {
+		file := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			log.Printf("Failed to inherit listener %v. %v", addr, err)
+			continue
+		}
+		listeners[addr] = l.(*net.TCPListener)
+	}
+
+	return listeners
+}
+
+// StartProcessWithListeners starts a new sag process with the same
+// arguments, passing on all active listening sockets to it.
+//
+// The returned pipe is written to by the new process once it is ready to
+// serve, see NotifyReady, and is to be passed on to WaitUntilReady.
+func StartProcessWithListeners() (*os.Process, *os.File, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var addrs []string
+	for addr, listener := range activeListeners {
+		file, err := listener.File()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to pass on listener %v. %v", addr, err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, addr)
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer notify.Close()
+
+	env := append(os.Environ(),
+		fmt.Sprintf("%v=%v", inheritedListenersEnv, strings.Join(addrs, ",")),
+		fmt.Sprintf("%v=%v", readyFdEnv, len(files)))
+	files = append(files, notify)
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		ready.Close()
+		return nil, nil, err
+	}
+
+	return process, ready, nil
+}
+
+// WaitUntilReady waits for the given process, as started by
+// StartProcessWithListeners, to report its readiness. The process is
+// killed if it does not get ready within the given timeout.
+func WaitUntilReady(process *os.Process, ready *os.File, timeout time.Duration) error {
+	defer ready.Close()
+
+	ready.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		process.Kill()
+		process.Wait()
+		if os.IsTimeout(err) {
+			return fmt.Errorf("Process %v did not get ready within %v.", process.Pid, timeout)
+		}
+		return fmt.Errorf("Process %v exited before getting ready.", process.Pid)
+	}
+
+	return nil
+}
+
+// NotifyReady reports to the parent sag process, if any, that this process
+// took over the listening sockets and is ready to serve.
+func NotifyReady() {
+	value := os.Getenv(readyFdEnv)
+	if len(value) == 0 {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %v %q.", readyFdEnv, value)
+		return
+	}
+
+	file := os.NewFile(uintptr(fd), "ready")
+	if _, err := file.Write([]byte{1}); err != nil {
+		log.Printf("Failed to notify parent process. %v", err)
+	}
+	file.Close()
+}
@@ -0,0 +1,106 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCloseInheritedListeners(t *testing.T) {
+	claimed, _ := net.Listen("tcp", "127.0.0.1:0")
+	unclaimed, _ := net.Listen("tcp", "127.0.0.1:0")
+	claimedAddr := claimed.Addr().String()
+
+	listenersMutex.Lock()
+	inheritedListeners[claimedAddr] = claimed.(*net.TCPListener)
+	inheritedListeners[unclaimed.Addr().String()] = unclaimed.(*net.TCPListener)
+	listenersMutex.Unlock()
+
+	listener, err := Listen(claimedAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	CloseInheritedListeners()
+
+	if _, err := net.Dial("tcp", unclaimed.Addr().String()); err == nil {
+		t.Error("Expected the unclaimed listener to be closed.")
+	}
+	if conn, err := net.Dial("tcp", claimedAddr); err != nil {
+		t.Errorf("Expected the claimed listener to be kept. %v", err)
+	} else {
+		conn.Close()
+	}
+	if len(inheritedListeners) != 0 {
+		t.Errorf("Unexpected inherited listeners %v.", inheritedListeners)
+	}
+}
+
+// startSleepingProcess starts a process that stays alive until killed.
+func startSleepingProcess(t *testing.T) *os.Process {
+	path, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("No sleep command.")
+	}
+
+	process, err := os.StartProcess(path, []string{"sleep", "60"}, &os.ProcAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return process
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	process := startSleepingProcess(t)
+	defer process.Wait()
+	defer process.Kill()
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify.Write([]byte{1})
+	notify.Close()
+
+	if err := WaitUntilReady(process, ready, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("Expected the ready process to be kept running. %v", err)
+	}
+}
+
+func TestWaitUntilReadyFails(t *testing.T) {
+	for _, exited := range []bool{true, false} {
+		process := startSleepingProcess(t)
+
+		ready, notify, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exited {
+			notify.Close()
+		} else {
+			defer notify.Close()
+		}
+
+		if err := WaitUntilReady(process, ready, 100*time.Millisecond); err == nil {
+			t.Errorf("Expected the handover to fail (exited: %v).", exited)
+		}
+		if _, err := process.Wait(); err == nil {
+			t.Errorf("Expected the process to be killed and reaped (exited: %v).", exited)
+		}
+	}
+}
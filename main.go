@@ -9,22 +9,45 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	flag "github.com/ogier/pflag"
 )
 
 type ServiceApplicationGateway struct {
-	discoveries  []Discovery
-	eventStream  chan interface{}
-	HttpServices map[string]*HttpService
-	HttpRouters  []*HttpRouter
-	ServiceIP    net.IP
+	Discoveries   []Discovery
+	eventStream   chan interface{}
+	quit          chan struct{}
+	HttpServices  map[string]*HttpService
+	TcpServices   map[string]*TcpService
+	HttpRouters   []*HttpRouter
+	TcpRouters    []*TcpRouter
+	ServiceIP     net.IP
+	DrainTimeout  time.Duration           // default time to let removed backends finish their requests
+	AccessLog     *AccessLog              // optional
+	Journal       *EventJournal           // recently processed state changes
+	config        *Config                 // currently applied configuration
+	resolveConfig func() (*Config, error) // reads the configuration for reloading
+	adminListener net.Listener
+	proxyProtocol *ProxyProtocolPolicy // for listeners accepting PROXY protocol headers
+	forwarding    *ForwardingPolicy    // for the forwarding headers passed on to HTTP backends
+	hostIndex     atomic.Value         // *HostIndex of the HTTP services' vhosts
+	hostsChanged  time.Time            // when the host index got outdated, zero if up to date
 }
 
 func (sag *ServiceApplicationGateway) FindHttpServiceById(serviceId string) *HttpService {
@@ -34,66 +57,329 @@ func (sag *ServiceApplicationGateway) FindHttpServiceById(serviceId string) *Htt
 	return nil
 }
 
+// getHttpServiceIds returns the sorted IDs of all HTTP services.
+func (sag *ServiceApplicationGateway) getHttpServiceIds() []string {
+	ids := make([]string, 0, len(sag.HttpServices))
+	for id := range sag.HttpServices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// getTcpServiceIds returns the sorted IDs of all TCP services.
+func (sag *ServiceApplicationGateway) getTcpServiceIds() []string {
+	ids := make([]string, 0, len(sag.TcpServices))
+	for id := range sag.TcpServices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// inspect runs fn within the event processing, where the gateway's state
+// can be safely accessed. It returns false if events are not processed
+// anymore.
+func (sag *ServiceApplicationGateway) inspect(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case sag.eventStream <- InspectEvent{Inspect: fn, Done: done}:
+	case <-sag.quit:
+		return false
+	}
+	<-done
+	return true
+}
+
 func (sag *ServiceApplicationGateway) getHttpServiceByHost(r *http.Request) *HttpService {
-	for _, s := range sag.HttpServices {
-		for _, shost := range s.Hosts {
-			if r.Host == shost {
-				return s
-			}
-		}
+	if index, ok := sag.hostIndex.Load().(*HostIndex); ok {
+		return index.Lookup(r.Host)
 	}
 
 	return nil
 }
 
+// invalidateHostIndex marks the host index outdated, to be called whenever
+// the vhosts of the HTTP services change.
+//
+// The index is not rebuilt right away, but once no more events are pending,
+// or hostIndexMaxDelay after it got outdated, so that a burst of events,
+// such as a snapshot of thousands of services, causes a few rebuilds only.
+func (sag *ServiceApplicationGateway) invalidateHostIndex() {
+	if sag.hostsChanged.IsZero() {
+		sag.hostsChanged = time.Now()
+	}
+}
+
+// updateHostIndex reindexes the vhosts of the HTTP services, if outdated.
+func (sag *ServiceApplicationGateway) updateHostIndex() {
+	if !sag.hostsChanged.IsZero() {
+		sag.hostIndex.Store(NewHostIndex(sag.HttpServices))
+		sag.hostsChanged = time.Time{}
+	}
+}
+
 func (sag *ServiceApplicationGateway) RegisterDiscovery(sd Discovery) {
-	sag.discoveries = append(sag.discoveries, sd)
+	sag.Discoveries = append(sag.Discoveries, sd)
 	go sd.Run()
 }
 
+// ProcessEvents processes any incoming events until Quit is called.
 func (sag *ServiceApplicationGateway) ProcessEvents() {
 	for {
-		switch v := (<-sag.eventStream).(type) {
+		var event interface{}
+		select {
+		case event = <-sag.eventStream:
+		case <-sag.quit:
+			return
+		default:
+			sag.updateHostIndex()
+			select {
+			case event = <-sag.eventStream:
+			case <-sag.quit:
+				return
+			}
+		}
+
+		switch v := event.(type) {
 		case RestoreFromSnapshotEvent:
 			log.Printf("Start restoring state from snapshot")
 		case AddHttpServiceEvent:
-			if _, ok := sag.HttpServices[v.ServiceId]; !ok {
-				service := NewHttpService(v.ServiceId, v.Scheduler, v.Hosts)
+			if service, ok := sag.HttpServices[v.ServiceId]; ok {
+				if sag.configureHttpService(service, v) {
+					sag.invalidateHostIndex()
+				}
+			} else {
+				service := NewHttpService(v.ServiceId, v.Scheduler, nil)
+				sag.configureHttpService(service, v)
+				serviceId := v.ServiceId
+				service.onDrained = func(backendId string) {
+					select {
+					case sag.eventStream <- BackendDrainedEvent{ServiceId: serviceId, BackendId: backendId}:
+					case <-sag.quit:
+					}
+				}
 				sag.HttpServices[v.ServiceId] = service
-				sag.runHttpServiceRouter(v.ServicePort, service)
+				sag.invalidateHostIndex()
+				sag.runHttpServiceRouter(v.ServicePort, service, v.AcceptProxy)
+				sag.Journal.Append(JournalServiceAdded, v.ServiceId, "", map[string]interface{}{
+					"port":      v.ServicePort,
+					"scheduler": service.Scheduler,
+					"hosts":     service.Hosts,
+				})
+			}
+		case AddTcpServiceEvent:
+			if _, ok := sag.TcpServices[v.ServiceId]; !ok {
+				service := NewTcpService(v.ServiceId, v.Scheduler, v.ProxyProtocol)
+				service.DrainTimeout = v.DrainTimeout
+				if service.DrainTimeout == 0 {
+					service.DrainTimeout = sag.DrainTimeout
+				}
+				service.SlowStart = v.SlowStart
+				service.SlowStartCurve = v.SlowStartCurve
+				if err := sag.runTcpServiceRouter(v.ServicePort, service, v.AcceptProxy); err != nil {
+					log.Printf("Failed to listen for TCP service %v. %v", v.ServiceId, err)
+				} else {
+					sag.TcpServices[v.ServiceId] = service
+				}
 			}
 		case AddBackendEvent:
 			if service, ok := sag.HttpServices[v.ServiceId]; ok {
+				if service.AddBackend(v.BackendId, v.Hostname, v.Port, v.Capacity, v.Weight, v.Alive) {
+					sag.Journal.Append(JournalBackendAdded, v.ServiceId, v.BackendId, map[string]interface{}{
+						"address": fmt.Sprintf("%v:%v", v.Hostname, v.Port),
+						"weight":  v.Weight,
+						"alive":   v.Alive,
+					})
+				}
+			} else if service, ok := sag.TcpServices[v.ServiceId]; ok {
 				service.AddBackend(v.BackendId, v.Hostname, v.Port, v.Capacity, v.Alive)
 			}
+		case BackendWeightChangedEvent:
+			if service := sag.FindHttpServiceById(v.ServiceId); service != nil {
+				backend := service.GetBackendById(v.BackendId)
+				if backend == nil {
+					log.Printf("weight changed for app %v task %v. Task not found.", v.ServiceId, v.BackendId)
+				} else if backend.Weight != v.Weight && service.SetBackendWeight(v.BackendId, v.Weight) {
+					sag.Journal.Append(JournalBackendWeight, v.ServiceId, v.BackendId, map[string]interface{}{
+						"weight": v.Weight,
+					})
+				}
+			}
 		case HealthStatusChangedEvent:
 			if service := sag.FindHttpServiceById(v.ServiceId); service != nil {
 				if backend := service.GetBackendById(v.BackendId); backend != nil {
-					backend.SetAlive(v.Alive)
+					if backend.SetAlive(v.Alive) {
+						sag.Journal.Append(JournalBackendHealth, v.ServiceId, v.BackendId, map[string]interface{}{
+							"alive": v.Alive,
+						})
+					}
 				} else {
 					log.Printf("health status changed for app %v task %v. Task not found.", v.ServiceId, v.BackendId)
 				}
+			} else if service, ok := sag.TcpServices[v.ServiceId]; ok {
+				if !service.SetBackendAlive(v.BackendId, v.Alive) {
+					log.Printf("health status changed for app %v task %v. Task not found.", v.ServiceId, v.BackendId)
+				}
 			} else {
 				log.Printf("health status changed for app %v task %v. App not found.", v.ServiceId, v.BackendId)
 			}
 		case RemoveBackendEvent:
 			if service, ok := sag.HttpServices[v.ServiceId]; ok {
-				service.RemoveBackend(v.BackendId)
+				if service.RemoveBackend(v.BackendId) {
+					sag.Journal.Append(JournalBackendRemoved, v.ServiceId, v.BackendId, nil)
+				}
 				if service.IsEmpty() {
 					log.Printf("Removing empty service %v", service)
 					service.Close()
 					delete(sag.HttpServices, v.ServiceId)
+					sag.invalidateHostIndex()
+					sag.Journal.Append(JournalServiceRemoved, v.ServiceId, "", nil)
+				}
+			} else if service, ok := sag.TcpServices[v.ServiceId]; ok {
+				service.RemoveBackend(v.BackendId)
+				if service.IsEmpty() {
+					log.Printf("Removing empty TCP service %v", v.ServiceId)
+					sag.closeTcpServiceRouter(service)
+					delete(sag.TcpServices, v.ServiceId)
 				}
 			} else {
 				log.Printf("RemoveBackendEvent: Service not found. %v %v", v.ServiceId, v.BackendId)
 			}
+		case BackendDrainedEvent:
+			sag.Journal.Append(JournalBackendDrained, v.ServiceId, v.BackendId, nil)
+			if service, ok := sag.HttpServices[v.ServiceId]; ok && service.IsEmpty() {
+				log.Printf("Removing drained empty service %v", service)
+				service.Close()
+				delete(sag.HttpServices, v.ServiceId)
+				sag.invalidateHostIndex()
+				sag.Journal.Append(JournalServiceRemoved, v.ServiceId, "", nil)
+			}
+		case SetBackendAdminStateEvent:
+			var err error
+			if service := sag.FindHttpServiceById(v.ServiceId); service == nil {
+				err = fmt.Errorf("Service %v not found.", v.ServiceId)
+			} else if !service.SetBackendAdminState(v.BackendId, v.State, v.Reason, v.Duration) {
+				err = fmt.Errorf("Backend %v not found in service %v.", v.BackendId, v.ServiceId)
+			}
+			if err == nil {
+				sag.Journal.Append(JournalBackendAdminState, v.ServiceId, v.BackendId, map[string]interface{}{
+					"state":    v.State,
+					"reason":   v.Reason,
+					"duration": v.Duration.String(),
+				})
+			}
+			if v.Result != nil {
+				v.Result <- err
+			} else if err != nil {
+				log.Printf("Failed to set admin state. %v", err)
+			}
+		case ReloadConfigEvent:
+			err := sag.applyConfig(v.Config)
+			if v.Result != nil {
+				v.Result <- err
+			} else if err != nil {
+				log.Printf("Failed to reload configuration. %v", err)
+			}
+		case InspectEvent:
+			v.Inspect()
+			close(v.Done)
 		case LogEvent:
 			log.Print(v.Message)
 		}
+
+		if !sag.hostsChanged.IsZero() && time.Since(sag.hostsChanged) >= hostIndexMaxDelay {
+			sag.updateHostIndex()
+		}
+	}
+}
+
+// configureHttpService applies the settings of the given service as
+// discovered, such as its hosts, redirects and header rules, to a new or
+// already running service. The scheduler and the service port of running
+// services are kept. It returns true if the service's hosts changed.
+func (sag *ServiceApplicationGateway) configureHttpService(service *HttpService, v AddHttpServiceEvent) bool {
+	if service.discovered != nil && reflect.DeepEqual(*service.discovered, v) {
+		return false
+	}
+	if service.discovered != nil {
+		log.Printf("Updating service %v.", v.ServiceId)
+	}
+	service.discovered = &v
+
+	hosts := mergeHosts(v.Hosts, v.SslHosts, v.Aliases)
+	for _, host := range hosts {
+		if err := ValidateVhost(host); err != nil {
+			log.Printf("Ignoring vhost of service %v. %v", v.ServiceId, err)
+		}
+	}
+
+	var canonicalHost string
+	var aliases []string
+	if canonical := mergeHosts(v.Hosts, v.SslHosts); len(canonical) != 0 {
+		canonicalHost = canonical[0]
+		aliases = v.Aliases
+	} else if len(v.Aliases) != 0 {
+		log.Printf("No canonical host for the aliases of service %v.", v.ServiceId)
+	}
+
+	redirectStatus := v.RedirectStatus
+	if !isRedirectStatus(redirectStatus) {
+		if redirectStatus != 0 {
+			log.Printf("Invalid redirect status %v for service %v.", v.RedirectStatus, v.ServiceId)
+		}
+		redirectStatus = http.StatusMovedPermanently
+	}
+
+	hashKey, err := ParseHashKey(v.HashKey)
+	if err != nil {
+		log.Printf("Invalid hash key for service %v. %v", v.ServiceId, err)
+		hashKey = service.HashKey
+	}
+
+	drainTimeout := v.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = sag.DrainTimeout
+	}
+
+	maxRetries := v.MaxRetries
+	if maxRetries < 0 {
+		log.Printf("Invalid max retries %v for service %v.", v.MaxRetries, v.ServiceId)
+		maxRetries = defaultMaxRetries
+	}
+
+	// the hosts are only read within the event processing
+	hostsChanged := !reflect.DeepEqual(service.Hosts, hosts)
+	service.Hosts = hosts
+
+	service.mutex.Lock()
+	service.CanonicalHost = canonicalHost
+	service.Aliases = aliases
+	service.SslHosts = v.SslHosts
+	service.RedirectHttps = v.RedirectHttps
+	service.RedirectStatus = redirectStatus
+	service.HashKey = hashKey
+	service.StickyCookie = v.StickyCookie
+	service.SlowStart = v.SlowStart
+	service.SlowStartCurve = v.SlowStartCurve
+	service.DrainTimeout = drainTimeout
+	service.MaxRetries = maxRetries
+	service.EjectionThreshold = v.EjectionThreshold
+	service.EjectionTime = v.EjectionTime
+	for _, backend := range service.Backends {
+		backend.SetEjection(v.EjectionThreshold, v.EjectionTime)
 	}
+	service.mutex.Unlock()
+
+	service.HeaderRuleLabels = v.HeaderRules
+	if err := sag.applyHeaderRules(service); err != nil {
+		log.Printf("Invalid header rules for service %v. %v", v.ServiceId, err)
+	}
+
+	return hostsChanged
 }
 
-func (sag *ServiceApplicationGateway) runHttpServiceRouter(port uint, service *HttpService) *HttpRouter {
+func (sag *ServiceApplicationGateway) runHttpServiceRouter(port uint, service *HttpService, acceptProxy bool) *HttpRouter {
 	for _, router := range sag.HttpRouters {
 		if router.ListenPort == port {
 			return router
@@ -102,27 +388,233 @@ func (sag *ServiceApplicationGateway) runHttpServiceRouter(port uint, service *H
 
 	getService := func(r *http.Request) *HttpService { return service }
 
-	router := NewHttpRouter(service.ServiceId, sag.ServiceIP, port, getService)
+	router := NewHttpRouter(service.ServiceId, sag.ServiceIP, port, RoutingByPort, getService)
+	router.AccessLog = sag.AccessLog
+	router.SetForwarding(sag.forwarding)
+	if sag.acceptsProxy(service.ServiceId, acceptProxy) {
+		router.SetProxyProtocol(sag.proxyProtocol)
+	}
 	sag.HttpRouters = append(sag.HttpRouters, router)
 	go router.Run()
 
 	return router
 }
 
-func (sag *ServiceApplicationGateway) RunHttpVhostRouter(addr net.IP, port uint) {
+// acceptsProxy tests whether the service port of the given service may
+// accept PROXY protocol headers, as requested by its lb-accept-proxy label,
+// which is ignored unless any trusted sources are configured.
+func (sag *ServiceApplicationGateway) acceptsProxy(serviceId string, acceptProxy bool) bool {
+	if acceptProxy && (sag.proxyProtocol == nil || len(sag.proxyProtocol.TrustedSources) == 0) {
+		log.Printf("Ignoring %v of service %v without any trusted PROXY protocol sources.", LB_ACCEPT_PROXY, serviceId)
+		return false
+	}
+
+	return acceptProxy
+}
+
+// runTcpServiceRouter accepts the connections of the given TCP service on
+// its service port, optionally expecting PROXY protocol headers.
+func (sag *ServiceApplicationGateway) runTcpServiceRouter(port uint, service *TcpService, acceptProxy bool) error {
+	addr := net.JoinHostPort(sag.ServiceIP.String(), fmt.Sprint(port))
+	router, err := NewTcpRouter(addr, func(net.Conn) *TcpService { return service })
+	if err != nil {
+		return err
+	}
+
+	if sag.acceptsProxy(service.ServiceId, acceptProxy) {
+		router.SetProxyProtocol(sag.proxyProtocol)
+	}
+
+	service.router = router
+	sag.TcpRouters = append(sag.TcpRouters, router)
+	go router.Serve()
+
+	return nil
+}
+
+// closeTcpServiceRouter stops accepting connections for the given TCP
+// service, letting its active sessions finish for up to the drain timeout.
+func (sag *ServiceApplicationGateway) closeTcpServiceRouter(service *TcpService) {
+	for i, router := range sag.TcpRouters {
+		if router == service.router {
+			sag.TcpRouters = append(sag.TcpRouters[:i], sag.TcpRouters[i+1:]...)
+			break
+		}
+	}
+
+	// stop listening right away, so the port can be reused
+	router := service.router
+	router.stopAccepting()
+
+	timeout := service.DrainTimeout
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		router.Shutdown(ctx)
+	}()
+}
+
+// newHttpVhostRouter creates an HTTP router for the given address, routing
+// requests to services by their host header.
+func (sag *ServiceApplicationGateway) newHttpVhostRouter(address string) (*HttpRouter, error) {
+	host, port, err := net.SplitHostPort(canonicalAddress(address))
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %q.", port)
+	}
+
 	id := fmt.Sprintf("http-vhost-%v", port)
-	router := NewHttpRouter(id, addr, port, sag.getHttpServiceByHost)
+	return NewHttpRouter(id, net.ParseIP(host), uint(portNumber), RoutingByVhost, sag.getHttpServiceByHost), nil
+}
+
+// RunHttpVhostRouter starts an HTTP router on the given address, routing
+// requests to services by their host header, terminating TLS if a TLS
+// configuration is given, and optionally expecting PROXY protocol headers.
+func (sag *ServiceApplicationGateway) RunHttpVhostRouter(address string, tlsConfig *tls.Config, acceptProxy bool) (*HttpRouter, error) {
+	router, err := sag.newHttpVhostRouter(address)
+	if err != nil {
+		return nil, err
+	}
+
+	router.AccessLog = sag.AccessLog
+	router.SetForwarding(sag.forwarding)
+	router.SetTLSConfig(tlsConfig)
+	if acceptProxy {
+		router.SetProxyProtocol(sag.proxyProtocol)
+	}
 	sag.HttpRouters = append(sag.HttpRouters, router)
-	router.Run()
+	go router.Run()
+
+	return router, nil
 }
 
-func (sag *ServiceApplicationGateway) Close() {
-	// XXX gracefully shutdown
-	// stop accepting new sessions, gracefully terminate active sessions
+// NewDiscovery creates a service discovery as configured.
+func (sag *ServiceApplicationGateway) NewDiscovery(cfg DiscoveryConfig, scheduler SchedulingAlgorithm) (Discovery, error) {
+	switch cfg.Type {
+	case DiscoveryTypeMarathon:
+		host, port, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port %q.", port)
+		}
+		sd, err := NewDiscoveryMarathon(net.ParseIP(host), uint(portNumber), time.Duration(cfg.ReconnectDelay), sag.eventStream)
+		if err != nil {
+			return nil, err
+		}
+		sd.SetDefaultScheduler(scheduler)
+		return sd, nil
+	default:
+		return nil, fmt.Errorf("Unknown discovery type %q.", cfg.Type)
+	}
+}
+
+// Quit makes ProcessEvents return.
+func (sag *ServiceApplicationGateway) Quit() {
+	close(sag.quit)
+}
+
+// Shutdown stops all service discoveries and routers, letting the routers'
+// active sessions finish for up to the given timeout before closing them.
+func (sag *ServiceApplicationGateway) Shutdown(timeout time.Duration) {
+	log.Printf("Shutting down, waiting up to %v for active sessions to finish.", timeout)
+
+	for _, sd := range sag.Discoveries {
+		sd.Shutdown()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, router := range sag.HttpRouters {
+		wg.Add(1)
+		go func(router *HttpRouter) {
+			defer wg.Done()
+			if err := router.Shutdown(ctx); err != nil {
+				log.Printf("Failed to gracefully shut down router %v. %v", router.Id, err)
+				router.Close()
+			}
+		}(router)
+	}
+	for _, router := range sag.TcpRouters {
+		wg.Add(1)
+		go func(router *TcpRouter) {
+			defer wg.Done()
+			if err := router.Shutdown(ctx); err != nil {
+				log.Printf("Failed to gracefully shut down router %v. %v", router.ListenAddr, err)
+			}
+		}(router)
+	}
+	wg.Wait()
+
+	if sag.AccessLog != nil {
+		sag.AccessLog.Close()
+	}
+}
 
+// Close immediately closes all routers and their active sessions.
+func (sag *ServiceApplicationGateway) Close() {
 	for _, router := range sag.HttpRouters {
 		router.Close()
 	}
+	for _, router := range sag.TcpRouters {
+		router.Close()
+	}
+
+	if sag.AccessLog != nil {
+		sag.AccessLog.Close()
+	}
+}
+
+// handleSignals gracefully shuts down sag on SIGTERM or SIGINT, and
+// hands over all listening sockets to a newly started sag process before
+// shutting down on SIGUSR2, such as for upgrading sag without dropping
+// any connections. It only shuts down once the new process is ready to
+// serve, and keeps on serving if the new process fails to get ready. SIGHUP reloads the configuration and reopens the
+// access log.
+func (sag *ServiceApplicationGateway) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Printf("Received %v. Reloading configuration.", sig)
+			if err := sag.ReloadConfig(); err != nil {
+				log.Printf("Failed to reload configuration. Keeping the running one. %v", err)
+			}
+			if sag.AccessLog != nil {
+				if err := sag.AccessLog.Reopen(); err != nil {
+					log.Printf("Failed to reopen access log. %v", err)
+				}
+			}
+			continue
+		case syscall.SIGUSR2:
+			process, ready, err := StartProcessWithListeners()
+			if err != nil {
+				log.Printf("Failed to start new process. %v", err)
+				continue
+			}
+			log.Printf("Started new process %v. Waiting for it to get ready.", process.Pid)
+			if err := WaitUntilReady(process, ready, handoverTimeout); err != nil {
+				log.Printf("Failed to hand over. Keeping on serving. %v", err)
+				continue
+			}
+			log.Printf("New process %v is ready. Handing over.", process.Pid)
+		default:
+			log.Printf("Received %v.", sig)
+		}
+
+		signal.Stop(signals)
+		sag.Quit()
+		return
+	}
 }
 
 func (sag *ServiceApplicationGateway) DumpHandler(w http.ResponseWriter, r *http.Request) {
@@ -137,37 +629,197 @@ func (sag *ServiceApplicationGateway) DumpHandler(w http.ResponseWriter, r *http
 	}
 }
 
+// WeightHandler changes the weight of a backend at runtime,
+// such as: POST /weight?service=/app-0&backend=app.1234&weight=5
+func (sag *ServiceApplicationGateway) WeightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid weight %q\n", r.FormValue("weight"))
+		return
+	}
+
+	select {
+	case sag.eventStream <- BackendWeightChangedEvent{
+		ServiceId: r.FormValue("service"),
+		BackendId: r.FormValue("backend"),
+		Weight:    weight,
+	}:
+	case <-sag.quit:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Shutting down\n")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func main() {
+	configPath := flag.String("config", "", "Path to the YAML configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print it resolved, and exit")
 	httpVhostIP := flag.IP("http-vhost-ip", net.ParseIP("0.0.0.0"), "HTTP vhost router bind IP")
 	httpVhostPort := flag.Uint("http-vhost-port", 8080, "HTTP vhost router port number")
 	marathonIP := flag.IP("marathon-ip", net.ParseIP("127.0.0.1"), "Marathon IP address")
 	marathonPort := flag.Uint("marathon-port", 8080, "Marathon port number")
 	debugPort := flag.Uint("debug-port", 0, "Enable Debugg on given TCP port")
 	serviceIP := flag.IP("service-ip", net.ParseIP("0.0.0.0"), "IP to bind to for service ports")
+	scheduler := flag.String("scheduler", string(SchedulerLeastLoad), "Default scheduler of services without lb-scheduler label")
+	stickySecret := flag.String("sticky-secret", "", "Secret to sign sticky session cookies with (random if empty)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "Default time to let removed backends finish their requests")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Time to let active sessions finish upon shutdown")
+	accessLogPath := flag.String("access-log", "", "Path to write the HTTP access log to (\"-\" for stdout, disabled if empty)")
+	accessLogFormat := flag.String("access-log-format", string(AccessLogCommon), "HTTP access log format (common, json, logfmt)")
+	accessLogSample := flag.Float64("access-log-sample", 1.0, "Fraction of requests to write to the access log (server errors are always logged)")
 	flag.Parse()
 
+	if err := applyEnvironment(); err != nil {
+		log.Fatal(err)
+	}
+
+	// resolves the configuration file, overridden by the command line
+	// options (or their environment variables)
+	resolveConfig := func() (*Config, error) {
+		cfg := DefaultConfig()
+		if len(*configPath) != 0 {
+			loaded, err := LoadConfig(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			cfg = loaded
+		}
+
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "http-vhost-ip":
+				cfg.setHttpVhostAddress(httpVhostIP.String(), "")
+			case "http-vhost-port":
+				cfg.setHttpVhostAddress("", strconv.FormatUint(uint64(*httpVhostPort), 10))
+			case "marathon-ip":
+				cfg.setMarathonAddress(marathonIP.String(), "")
+			case "marathon-port":
+				cfg.setMarathonAddress("", strconv.FormatUint(uint64(*marathonPort), 10))
+			case "debug-port":
+				cfg.Admin.Address = ""
+				if *debugPort != 0 {
+					cfg.Admin.Address = fmt.Sprintf(":%v", *debugPort)
+				}
+			case "service-ip":
+				cfg.ServiceIP = serviceIP.String()
+			case "scheduler":
+				cfg.Scheduler = SchedulingAlgorithm(*scheduler)
+			case "sticky-secret":
+				cfg.StickySecret = *stickySecret
+			case "drain-timeout":
+				cfg.Timeouts.Drain = Duration(*drainTimeout)
+			case "shutdown-timeout":
+				cfg.Timeouts.Shutdown = Duration(*shutdownTimeout)
+			case "access-log":
+				cfg.Logging.AccessLog = *accessLogPath
+			case "access-log-format":
+				cfg.Logging.AccessLogFormat = AccessLogFormat(*accessLogFormat)
+			case "access-log-sample":
+				cfg.Logging.AccessLogSample = *accessLogSample
+			}
+		})
+
+		return cfg, cfg.Validate()
+	}
+
+	cfg, err := resolveConfig()
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration. %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(cfg)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration. %v", err)
+	}
+
+	SetStickySecret(cfg.StickySecret)
+
 	sag := ServiceApplicationGateway{
 		eventStream:  make(chan interface{}),
+		quit:         make(chan struct{}),
 		HttpServices: make(map[string]*HttpService),
-		ServiceIP:    *serviceIP,
+		TcpServices:  make(map[string]*TcpService),
+		ServiceIP:    net.ParseIP(cfg.ServiceIP),
+		DrainTimeout: time.Duration(cfg.Timeouts.Drain),
+		Journal:      NewEventJournal(journalCapacity),
+	}
+
+	sag.config = cfg
+	sag.resolveConfig = resolveConfig
+
+	if sag.proxyProtocol, err = cfg.ProxyProtocol.Policy(); err != nil {
+		log.Fatalf("Invalid PROXY protocol configuration. %v", err)
+	}
+
+	if sag.forwarding, err = cfg.Forwarding.Policy(); err != nil {
+		log.Fatalf("Invalid forwarding configuration. %v", err)
 	}
 
+	accessLog, err := NewAccessLog(cfg.Logging.AccessLog, cfg.Logging.AccessLogFormat, cfg.Logging.AccessLogSample)
+	if err != nil {
+		log.Fatalf("Failed to open access log. %v", err)
+	}
+	sag.AccessLog = accessLog
+
 	// enable HTTP debugging interface
-	if *debugPort != 0 {
-		go func() {
-			http.HandleFunc("/", sag.DumpHandler)
-			http.ListenAndServe(fmt.Sprintf(":%v", *debugPort), nil)
-		}()
+	http.HandleFunc("/", sag.DumpHandler)
+	http.HandleFunc("/weight", sag.WeightHandler)
+	http.HandleFunc("/metrics", sag.MetricsHandler)
+	http.HandleFunc("/dashboard", sag.DashboardHandler)
+	http.HandleFunc(adminApiPrefix+"/", sag.AdminHandler)
+	if len(cfg.Admin.Address) != 0 {
+		if listener, err := Listen(cfg.Admin.Address); err != nil {
+			log.Printf("Failed to listen on debug port. %v", err)
+		} else {
+			sag.adminListener = listener
+			go http.Serve(listener, nil)
+		}
+	}
+
+	// add the service discovery sources
+	for _, discoveryConfig := range cfg.Discoveries {
+		sd, err := sag.NewDiscovery(discoveryConfig, cfg.Scheduler)
+		if err != nil {
+			log.Fatalf("Failed to create service discovery. %v", err)
+		}
+		sag.RegisterDiscovery(sd)
 	}
 
-	// add a service discovery source
-	sag.RegisterDiscovery(NewDiscoveryMarathon(*marathonIP, *marathonPort, time.Second*1, sag.eventStream))
+	// add routers (HTTP application by-vhost routers)
+	for _, listener := range cfg.Listeners {
+		var tlsConfig *tls.Config
+		if listener.TLS != nil {
+			if tlsConfig, err = listener.TLS.Load(); err != nil {
+				log.Fatalf("Failed to load TLS configuration for %v. %v", listener.Address, err)
+			}
+		}
+		if _, err := sag.RunHttpVhostRouter(listener.Address, tlsConfig, listener.AcceptProxy); err != nil {
+			log.Fatalf("Failed to start router on %v. %v", listener.Address, err)
+		}
+	}
+
+	// the service ports are claimed as their services are discovered
+	time.AfterFunc(inheritedListenersTimeout, CloseInheritedListeners)
+
+	// let the parent process, if any, shut down now that we are serving
+	NotifyReady()
 
-	// add router (HTTP application by-vhost router)
-	go sag.RunHttpVhostRouter(*httpVhostIP, *httpVhostPort)
+	// shut down gracefully upon termination signals
+	go sag.handleSignals()
 
 	// process any incoming service discovery events
 	sag.ProcessEvents()
 
-	sag.Close()
+	sag.Shutdown(time.Duration(sag.config.Timeouts.Shutdown))
 }
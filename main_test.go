@@ -0,0 +1,74 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigureHttpServiceUpdatesRunningService(t *testing.T) {
+	sag := &ServiceApplicationGateway{config: &Config{}, DrainTimeout: time.Minute}
+	service := NewHttpService("/web", SchedulerRoundRobin, nil)
+
+	event := AddHttpServiceEvent{
+		ServiceId: "/web",
+		Scheduler: SchedulerRoundRobin,
+		Hosts:     []string{"example.com"},
+	}
+	if !sag.configureHttpService(service, event) {
+		t.Fatal("Expected the hosts of a new service to change.")
+	}
+	if sag.configureHttpService(service, event) {
+		t.Fatal("Expected the hosts to be unchanged when discovered again.")
+	}
+
+	event.Aliases = []string{"www.example.com"}
+	event.RedirectStatus = http.StatusPermanentRedirect
+	event.StickyCookie = "sag"
+	event.HashKey = "header:X-User"
+	event.HeaderRules = map[string]string{"lb-response-header-set.X-Frame-Options": "DENY"}
+	if !sag.configureHttpService(service, event) {
+		t.Fatal("Expected the hosts to change with the aliases.")
+	}
+
+	if !reflect.DeepEqual(service.Hosts, []string{"example.com", "www.example.com"}) ||
+		service.CanonicalHost != "example.com" || service.RedirectStatus != http.StatusPermanentRedirect ||
+		service.StickyCookie != "sag" || service.HashKey != (HashKey{Source: HashByHeader, Name: "X-User"}) ||
+		service.DrainTimeout != time.Minute || service.getHeaderRules() == nil {
+		t.Fatalf("Unexpected service settings %+v.", service)
+	}
+}
+
+func TestWeightHandlerAfterQuit(t *testing.T) {
+	sag := &ServiceApplicationGateway{
+		eventStream: make(chan interface{}),
+		quit:        make(chan struct{}),
+	}
+	sag.Quit()
+
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		sag.WeightHandler(w, httptest.NewRequest("POST", "/weight?service=/web&backend=web.1&weight=5", nil))
+		done <- w.Code
+	}()
+
+	select {
+	case code := <-done:
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("Unexpected status %v.", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WeightHandler blocked after Quit.")
+	}
+}
@@ -9,23 +9,23 @@
 package marathon
 
 import (
+	"context"
 	"fmt"
-	"strings"
 	"time"
 )
 
 type PortMapping struct {
-	ContainerPort uint
-	HostPort      uint
-	ServicePort   uint
-	Protocol      string
-	Name          string
-	Labels        map[string]string
+	ContainerPort uint              `json:"containerPort"`
+	HostPort      uint              `json:"hostPort"`
+	ServicePort   uint              `json:"servicePort,omitempty"`
+	Protocol      string            `json:"protocol,omitempty"`
+	Name          string            `json:"name,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
 }
 
 type KeyValuePair struct {
-	Key   string
-	Value *string
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
 }
 
 const (
@@ -34,136 +34,145 @@ const (
 )
 
 type DockerContainer struct {
-	Image          string
-	Network        string
-	PortMappings   []PortMapping
-	Privileged     bool
-	Parameters     []KeyValuePair
-	ForcePullImage bool
+	Image          string         `json:"image"`
+	Network        string         `json:"network,omitempty"`
+	PortMappings   []PortMapping  `json:"portMappings,omitempty"`
+	Privileged     bool           `json:"privileged,omitempty"`
+	Parameters     []KeyValuePair `json:"parameters,omitempty"`
+	ForcePullImage bool           `json:"forcePullImage,omitempty"`
 }
 
 type ReadinessCheck struct {
-	Name                    string
-	Protocol                string
-	Path                    string
-	PortName                string
-	IntervalSeconds         uint
-	TimeoutSeconds          uint
-	HttpStatusCodesForReady []uint
-	PreserveLastResponse    bool
+	Name                    string `json:"name,omitempty"`
+	Protocol                string `json:"protocol,omitempty"`
+	Path                    string `json:"path,omitempty"`
+	PortName                string `json:"portName,omitempty"`
+	IntervalSeconds         uint   `json:"intervalSeconds,omitempty"`
+	TimeoutSeconds          uint   `json:"timeoutSeconds,omitempty"`
+	HttpStatusCodesForReady []uint `json:"httpStatusCodesForReady,omitempty"`
+	PreserveLastResponse    bool   `json:"preserveLastResponse,omitempty"`
 }
 
 type HealthCheck struct {
-	Protocol               string
-	Path                   string
-	PortIndex              int
-	GracePeriodSeconds     uint
-	IntervalSeconds        uint
-	TimeoutSeconds         uint
-	MaxConsecutiveFailures uint
-	IgnoreHttp1xx          bool
+	Protocol               string `json:"protocol,omitempty"`
+	Path                   string `json:"path,omitempty"`
+	PortIndex              int    `json:"portIndex"`
+	GracePeriodSeconds     uint   `json:"gracePeriodSeconds,omitempty"`
+	IntervalSeconds        uint   `json:"intervalSeconds,omitempty"`
+	TimeoutSeconds         uint   `json:"timeoutSeconds,omitempty"`
+	MaxConsecutiveFailures uint   `json:"maxConsecutiveFailures,omitempty"`
+	IgnoreHttp1xx          bool   `json:"ignoreHttp1xx,omitempty"`
 }
 
 type HealthCheckResult struct {
-	Alive               bool
-	ConsecutiveFailures uint
-	FirstSuccess        *time.Time
-	LastFailure         *time.Time
-	LastSuccess         *time.Time
-	LastFailureCause    *string
-	InstanceId          string
+	Alive               bool       `json:"alive"`
+	ConsecutiveFailures uint       `json:"consecutiveFailures"`
+	FirstSuccess        *time.Time `json:"firstSuccess"`
+	LastFailure         *time.Time `json:"lastFailure"`
+	LastSuccess         *time.Time `json:"lastSuccess"`
+	LastFailureCause    *string    `json:"lastFailureCause"`
+	InstanceId          string     `json:"instanceId"`
 }
 
 type ContainerVolume struct {
-	ContainerPath string
-	HostPath      string
-	Mode          string
+	ContainerPath string `json:"containerPath"`
+	HostPath      string `json:"hostPath,omitempty"`
+	Mode          string `json:"mode"`
 }
 
 type AppContainer struct {
-	Type    string
-	Volumes []ContainerVolume
-	Docker  *DockerContainer
+	Type    string            `json:"type,omitempty"`
+	Volumes []ContainerVolume `json:"volumes,omitempty"`
+	Docker  *DockerContainer  `json:"docker,omitempty"`
 }
 
 type UpgradeStrategy struct {
-	MinimumHealthCapacity float64
-	MaximumOverCapacity   float64
+	MinimumHealthCapacity float64 `json:"minimumHealthCapacity"`
+	MaximumOverCapacity   float64 `json:"maximumOverCapacity"`
 }
 
 type Task struct {
-	Id                 string
-	Host               string
-	Ports              []uint
-	StartedAt          *time.Time
-	StagedAt           *time.Time
-	Version            time.Time
-	SlaveId            string
-	State              *TaskStatus
-	AppId              string
-	HealthCheckResults []HealthCheckResult
+	Id                 string              `json:"id"`
+	Host               string              `json:"host"`
+	Ports              []uint              `json:"ports"`
+	IpAddresses        []IpAddr            `json:"ipAddresses,omitempty"`
+	StartedAt          *time.Time          `json:"startedAt"`
+	StagedAt           *time.Time          `json:"stagedAt"`
+	Version            time.Time           `json:"version"`
+	SlaveId            string              `json:"slaveId"`
+	State              *TaskStatus         `json:"state"`
+	AppId              string              `json:"appId"`
+	HealthCheckResults []HealthCheckResult `json:"healthCheckResults,omitempty"`
 }
 
 type FetchInfo struct {
-	Uri        string
-	Extract    bool
-	Executable bool
-	Cache      bool
+	Uri        string `json:"uri"`
+	Extract    bool   `json:"extract"`
+	Executable bool   `json:"executable"`
+	Cache      bool   `json:"cache"`
 }
 
 type PortDefinition struct {
-	Port     uint
-	Protocol string
-	Name     string
-	Labels   map[string]string
+	Port     uint              `json:"port"`
+	Protocol string            `json:"protocol,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
+// App is a Marathon application definition, optionally including its tasks.
+//
+// Fields that are left empty are omitted when sending an App to Marathon,
+// so that Marathon's defaults apply. That is why Instances, Container,
+// UpgradeStrategy, Version, Residency and VersionInfo are pointers, as
+// their zero values would otherwise be sent, such as scaling the app to no
+// instances, a zero version or an upgrade strategy of no capacity. Mem and Disk are floats, as Marathon
+// reports fractional megabytes, which failed to decode into integers.
 type App struct {
 	service                    *Service
-	Id                         string
-	Cmd                        *string
-	Args                       []string
-	User                       *string
-	Env                        map[string]string
-	PortDefinitions            []PortDefinition
-	Instances                  uint
-	Cpus                       float64
-	Mem                        uint
-	Disk                       uint
-	Gpus                       uint
-	Executor                   string
-	Constraints                [][]string
-	Uris                       []string
-	Fetch                      []FetchInfo
-	StoreUrls                  []string
-	RequirePorts               bool
-	BackoffSeconds             uint
-	BackoffFactor              float64
-	MaxLaunchDelaySeconds      uint
-	Container                  AppContainer
-	HealthChecks               []HealthCheck
-	RedinessChecks             []ReadinessCheck
-	Dependencies               *[]string
-	UpgradeStrategy            UpgradeStrategy
-	Labels                     map[string]string
-	Tasks                      []Task
-	AcceptedResourceRoles      *[]string
-	IpAddress                  *IpAddr
-	Version                    time.Time
-	Residency                  Residency
-	TaskKillGracePeriodSeconds *uint
-	VersionInfo                VersionInfo
-	Deprecated_Ports           []uint `json:"ports"`
+	Id                         string            `json:"id"`
+	Cmd                        *string           `json:"cmd,omitempty"`
+	Args                       []string          `json:"args,omitempty"`
+	User                       *string           `json:"user,omitempty"`
+	Env                        map[string]string `json:"env,omitempty"`
+	PortDefinitions            []PortDefinition  `json:"portDefinitions,omitempty"`
+	Instances                  *uint             `json:"instances,omitempty"`
+	Cpus                       float64           `json:"cpus,omitempty"`
+	Mem                        float64           `json:"mem,omitempty"`
+	Disk                       float64           `json:"disk,omitempty"`
+	Gpus                       uint              `json:"gpus,omitempty"`
+	Executor                   string            `json:"executor,omitempty"`
+	Constraints                [][]string        `json:"constraints,omitempty"`
+	Uris                       []string          `json:"uris,omitempty"`
+	Fetch                      []FetchInfo       `json:"fetch,omitempty"`
+	StoreUrls                  []string          `json:"storeUrls,omitempty"`
+	RequirePorts               bool              `json:"requirePorts,omitempty"`
+	BackoffSeconds             uint              `json:"backoffSeconds,omitempty"`
+	BackoffFactor              float64           `json:"backoffFactor,omitempty"`
+	MaxLaunchDelaySeconds      uint              `json:"maxLaunchDelaySeconds,omitempty"`
+	Container                  *AppContainer     `json:"container,omitempty"`
+	HealthChecks               []HealthCheck     `json:"healthChecks,omitempty"`
+	ReadinessChecks            []ReadinessCheck  `json:"readinessChecks,omitempty"`
+	Dependencies               *[]string         `json:"dependencies,omitempty"`
+	UpgradeStrategy            *UpgradeStrategy  `json:"upgradeStrategy,omitempty"`
+	Labels                     map[string]string `json:"labels,omitempty"`
+	Tasks                      []Task            `json:"tasks,omitempty"`
+	AcceptedResourceRoles      *[]string         `json:"acceptedResourceRoles,omitempty"`
+	IpAddress                  *IpAddr           `json:"ipAddress,omitempty"`
+	Version                    *time.Time        `json:"version,omitempty"`
+	Residency                  *Residency        `json:"residency,omitempty"`
+	TaskKillGracePeriodSeconds *uint             `json:"taskKillGracePeriodSeconds,omitempty"`
+	VersionInfo                *VersionInfo      `json:"versionInfo,omitempty"`
+	Deprecated_Ports           []uint            `json:"ports,omitempty"`
 	// "Secrets": {},
 }
 
 type Residency struct {
-	TaskLostBehavior string
+	TaskLostBehavior string `json:"taskLostBehavior"`
 }
 
 type VersionInfo struct {
-	LastScalingAt      time.Time
-	LastConfigChangeAt time.Time
+	LastScalingAt      time.Time `json:"lastScalingAt"`
+	LastConfigChangeAt time.Time `json:"lastConfigChangeAt"`
 }
 
 func (app *App) GetTaskById(id string) *Task {
@@ -188,13 +197,15 @@ func (app *App) GetTaskByInstanceId(instanceId string) *Task {
 	return nil
 }
 
-func (app *App) Scale(instance_count uint) error {
-	// TODO
-	_, err := app.service.HttpPost(
-		"/v2/apps/TODO/scale",
-		strings.NewReader(fmt.Sprintf("%v", instance_count)))
+// Scale changes the number of instances of this app.
+//
+// The app must have been retrieved from Marathon via a Service.
+func (app *App) Scale(ctx context.Context, instances uint) (*DeploymentResult, error) {
+	if app.service == nil {
+		return nil, fmt.Errorf("App %v is not bound to a Marathon service.", app.Id)
+	}
 
-	return err
+	return app.service.ScaleApp(ctx, app.Id, instances)
 }
 
 func (task *Task) IsAlive() bool {
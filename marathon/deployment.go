@@ -0,0 +1,57 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+import "time"
+
+type Deployment struct {
+	Id             string                    `json:"id"`
+	Version        time.Time                 `json:"version"`
+	AffectedApps   []string                  `json:"affectedApps"`
+	AffectedPods   []string                  `json:"affectedPods"`
+	CurrentActions []DeploymentCurrentAction `json:"currentActions"`
+	CurrentStep    int                       `json:"currentStep"`
+	TotalSteps     int                       `json:"totalSteps"`
+}
+
+type DeploymentCurrentAction struct {
+	Action                string                 `json:"action"`
+	App                   string                 `json:"app"`
+	ReadinessCheckResults []ReadinessCheckResult `json:"readinessCheckResults"`
+}
+
+type ReadinessCheckResult struct {
+	Name         string                      `json:"name"`
+	TaskId       string                      `json:"taskId"`
+	Ready        bool                        `json:"ready"`
+	LastResponse *ReadinessCheckHttpResponse `json:"lastResponse"`
+}
+
+type ReadinessCheckHttpResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        string `json:"body"`
+}
+
+// DeploymentResult is returned by any call that triggers a new deployment.
+type DeploymentResult struct {
+	DeploymentId string    `json:"deploymentId"`
+	Version      time.Time `json:"version"`
+}
+
+// IsAffectingApp tests whether the given app is part of this deployment.
+func (deployment *Deployment) IsAffectingApp(appId string) bool {
+	for _, id := range deployment.AffectedApps {
+		if id == appId {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is returned for any non-2xx response from Marathon.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string        // error message, as reported by Marathon
+	Details    []ErrorDetail // validation errors, as reported by Marathon
+	Body       []byte        // raw response body
+}
+
+type ErrorDetail struct {
+	Path   string   `json:"path"`
+	Errors []string `json:"errors"`
+}
+
+func newError(method, path string, statusCode int, body []byte) *Error {
+	e := &Error{
+		Method:     method,
+		Path:       path,
+		StatusCode: statusCode,
+		Body:       body,
+	}
+
+	var v struct {
+		Message string        `json:"message"`
+		Details []ErrorDetail `json:"details"`
+	}
+	if json.Unmarshal(body, &v) == nil {
+		e.Message = v.Message
+		e.Details = v.Details
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("Marathon %v %v failed with %v %v.",
+		e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+
+	if len(e.Message) != 0 {
+		msg += " " + e.Message
+	}
+
+	for _, detail := range e.Details {
+		msg += fmt.Sprintf(" %v: %v", detail.Path, strings.Join(detail.Errors, ", "))
+	}
+
+	return msg
+}
+
+// IsNotFound tests whether the given error is a Marathon 404 error.
+func IsNotFound(err error) bool {
+	return hasStatusCode(err, http.StatusNotFound)
+}
+
+// IsConflict tests whether the given error is a Marathon 409 error, such as
+// when an app is locked by a deployment.
+func IsConflict(err error) bool {
+	return hasStatusCode(err, http.StatusConflict)
+}
+
+func hasStatusCode(err error, statusCode int) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == statusCode
+	}
+	return false
+}
@@ -40,8 +40,8 @@ const (
 )
 
 type IpAddr struct {
-	IpAddress string
-	Protocol  string
+	IpAddress string `json:"ipAddress"`
+	Protocol  string `json:"protocol"`
 }
 
 type HealthStatus bool
@@ -142,6 +142,13 @@ type AppTerminatedEvent struct {
 	AppId string `json:"appId"`
 }
 
+type ApiPostEvent struct {
+	GenericEvent
+	ClientIp      string `json:"clientIp"`
+	Uri           string `json:"uri"`
+	AppDefinition App    `json:"appDefinition"`
+}
+
 type AddHealthCheckEvent struct {
 	GenericEvent
 	AppId       string      `json:"appId"`
@@ -0,0 +1,28 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+import "time"
+
+type Group struct {
+	Id           string     `json:"id"`
+	Apps         []*App     `json:"apps,omitempty"`
+	Groups       []*Group   `json:"groups,omitempty"`
+	Dependencies []string   `json:"dependencies,omitempty"`
+	Version      *time.Time `json:"version,omitempty"`
+}
+
+// GetAllApps returns all apps of this group and its subgroups.
+func (group *Group) GetAllApps() []*App {
+	apps := group.Apps
+	for _, subgroup := range group.Groups {
+		apps = append(apps, subgroup.GetAllApps()...)
+	}
+	return apps
+}
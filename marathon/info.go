@@ -0,0 +1,23 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+// Info describes the Marathon instance, as reported by /v2/info.
+type Info struct {
+	Name            string                 `json:"name"`
+	Version         string                 `json:"version"`
+	Buildref        string                 `json:"buildref"`
+	Elected         bool                   `json:"elected"`
+	Leader          string                 `json:"leader"`
+	FrameworkId     string                 `json:"frameworkId"`
+	MarathonConfig  map[string]interface{} `json:"marathon_config"`
+	ZookeeperConfig map[string]interface{} `json:"zookeeper_config"`
+	HttpConfig      map[string]interface{} `json:"http_config"`
+	EventSubscriber map[string]interface{} `json:"event_subscriber"`
+}
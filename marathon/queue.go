@@ -0,0 +1,23 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+import "time"
+
+type QueueItem struct {
+	Count int        `json:"count"`
+	Delay QueueDelay `json:"delay"`
+	Since time.Time  `json:"since"`
+	App   *App       `json:"app"`
+}
+
+type QueueDelay struct {
+	TimeLeftSeconds int  `json:"timeLeftSeconds"`
+	Overdue         bool `json:"overdue"`
+}
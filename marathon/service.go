@@ -9,79 +9,366 @@
 package marathon
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// Service is a client to the Marathon REST API.
+//
+// Any non-2xx response is returned as *Error.
 type Service struct {
 	BaseURL string
+	Client  *http.Client
+
+	// OnRequest, if set, is invoked after each API request with the
+	// response status code (0 if no response was received) and its latency.
+	OnRequest func(method string, statusCode int, elapsed time.Duration)
 }
 
 func NewService(host net.IP, port uint) (*Service, error) {
-	var url = fmt.Sprintf("http://%v:%v", host, port)
-	var ms = &Service{BaseURL: url}
+	return NewServiceWithURL(fmt.Sprintf("http://%v:%v", host, port))
+}
+
+func NewServiceWithURL(baseURL string) (*Service, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, err
+	}
+
+	var ms = &Service{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  http.DefaultClient,
+	}
 
 	return ms, nil
 }
 
-func (service *Service) HttpGet(path string) ([]byte, error) {
-	url := service.BaseURL + path
-	response, err := http.Get(url)
+// Do performs a request against the Marathon API.
+//
+// The given body, if not nil, is sent as JSON, and the response is decoded
+// into result, if not nil.
+func (service *Service) Do(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonBlob, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsonBlob)
+	}
+
+	output, err := service.request(ctx, method, path, reader)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer response.Body.Close()
-	output, err := ioutil.ReadAll(response.Body)
-	return output, err
+	if result != nil {
+		if err = json.Unmarshal(output, result); err != nil {
+			return fmt.Errorf("Could not unmarshal JSON response. %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) HttpGet(ctx context.Context, path string) ([]byte, error) {
+	return service.request(ctx, http.MethodGet, path, nil)
+}
+
+func (service *Service) HttpPost(ctx context.Context, path string, body io.Reader) ([]byte, error) {
+	return service.request(ctx, http.MethodPost, path, body)
 }
 
-func (service *Service) HttpPost(path string, body io.Reader) ([]byte, error) {
-	response, err := http.Post(service.BaseURL+path, "application/json", body)
+func (service *Service) request(ctx context.Context, method, path string, body io.Reader) ([]byte, error) {
+	request, err := http.NewRequest(method, service.BaseURL+path, body)
 	if err != nil {
 		return nil, err
 	}
 
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	client := service.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		service.observe(method, 0, start)
+		return nil, err
+	}
+
 	defer response.Body.Close()
 	output, err := ioutil.ReadAll(response.Body)
-	return output, err
-}
-
-func (service *Service) GetApp(path string) (*App, error) {
-	jsonBlob, err := service.HttpGet("/v2/apps" + path + "?embed=apps.tasks")
+	service.observe(method, response.StatusCode, start)
 	if err != nil {
 		return nil, err
 	}
 
-	type jsonResponse struct {
-		App *App
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, newError(method, path, response.StatusCode, output)
 	}
 
-	var v jsonResponse
-	err = json.Unmarshal(jsonBlob, &v)
+	return output, nil
+}
 
-	return v.App, err
+func (service *Service) observe(method string, statusCode int, start time.Time) {
+	if service.OnRequest != nil {
+		service.OnRequest(method, statusCode, time.Since(start))
+	}
 }
 
-func (service *Service) GetApps() ([]*App, error) {
-	jsonBlob, err := service.HttpGet("/v2/apps?embed=apps.tasks")
+// ----------------------------------------------------------------------------
+// apps
+
+func (service *Service) GetApp(ctx context.Context, appId string) (*App, error) {
+	var v struct {
+		App *App
+	}
+
+	err := service.Do(ctx, http.MethodGet, appPath(appId)+"?embed=apps.tasks", nil, &v)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to HTTP GET. %v", err)
+		return nil, err
+	}
+	if v.App == nil {
+		return nil, fmt.Errorf("No app in response for %v.", appId)
 	}
 
-	type jsonResponse struct {
+	v.App.service = service
+	return v.App, nil
+}
+
+func (service *Service) GetApps(ctx context.Context) ([]*App, error) {
+	var v struct {
 		Apps []*App
 	}
 
-	var v jsonResponse
-	err = json.Unmarshal(jsonBlob, &v)
+	err := service.Do(ctx, http.MethodGet, "/v2/apps?embed=apps.tasks", nil, &v)
 	if err != nil {
-		return v.Apps, fmt.Errorf("Could not unmarshal JSON response. %v", err)
-	} else {
-		return v.Apps, nil
+		return nil, err
+	}
+
+	for _, app := range v.Apps {
+		app.service = service
+	}
+	return v.Apps, nil
+}
+
+func (service *Service) CreateApp(ctx context.Context, app *App) (*App, error) {
+	var created App
+	if err := service.Do(ctx, http.MethodPost, "/v2/apps", app, &created); err != nil {
+		return nil, err
+	}
+
+	created.service = service
+	return &created, nil
+}
+
+// UpdateApp replaces the definition of the given app, or creates it if
+// not present yet.
+func (service *Service) UpdateApp(ctx context.Context, app *App, force bool) (*DeploymentResult, error) {
+	var result DeploymentResult
+	path := appPath(app.Id) + forceQuery(force)
+	if err := service.Do(ctx, http.MethodPut, path, app, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (service *Service) DeleteApp(ctx context.Context, appId string, force bool) (*DeploymentResult, error) {
+	var result DeploymentResult
+	path := appPath(appId) + forceQuery(force)
+	if err := service.Do(ctx, http.MethodDelete, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (service *Service) RestartApp(ctx context.Context, appId string, force bool) (*DeploymentResult, error) {
+	var result DeploymentResult
+	path := appPath(appId) + "/restart" + forceQuery(force)
+	if err := service.Do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ScaleApp changes the number of instances of the given app.
+func (service *Service) ScaleApp(ctx context.Context, appId string, instances uint) (*DeploymentResult, error) {
+	var result DeploymentResult
+	body := map[string]uint{"instances": instances}
+	if err := service.Do(ctx, http.MethodPut, appPath(appId), body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ----------------------------------------------------------------------------
+// groups
+
+// GetGroups returns the root group, including all apps and subgroups.
+func (service *Service) GetGroups(ctx context.Context) (*Group, error) {
+	return service.GetGroup(ctx, "/")
+}
+
+func (service *Service) GetGroup(ctx context.Context, groupId string) (*Group, error) {
+	var group Group
+	path := groupPath(groupId) + "?embed=group.groups&embed=group.apps"
+	if err := service.Do(ctx, http.MethodGet, path, nil, &group); err != nil {
+		return nil, err
+	}
+
+	for _, app := range group.GetAllApps() {
+		app.service = service
+	}
+	return &group, nil
+}
+
+// UpdateGroup replaces the definition of the given group, or creates it if
+// not present yet.
+func (service *Service) UpdateGroup(ctx context.Context, group *Group, force bool) (*DeploymentResult, error) {
+	var result DeploymentResult
+	path := groupPath(group.Id) + forceQuery(force)
+	if err := service.Do(ctx, http.MethodPut, path, group, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (service *Service) DeleteGroup(ctx context.Context, groupId string, force bool) (*DeploymentResult, error) {
+	var result DeploymentResult
+	path := groupPath(groupId) + forceQuery(force)
+	if err := service.Do(ctx, http.MethodDelete, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ----------------------------------------------------------------------------
+// tasks
+
+func (service *Service) GetTasks(ctx context.Context) ([]Task, error) {
+	var v struct {
+		Tasks []Task
+	}
+
+	if err := service.Do(ctx, http.MethodGet, "/v2/tasks", nil, &v); err != nil {
+		return nil, err
+	}
+	return v.Tasks, nil
+}
+
+func (service *Service) GetAppTasks(ctx context.Context, appId string) ([]Task, error) {
+	var v struct {
+		Tasks []Task
+	}
+
+	if err := service.Do(ctx, http.MethodGet, appPath(appId)+"/tasks", nil, &v); err != nil {
+		return nil, err
+	}
+	return v.Tasks, nil
+}
+
+// KillTasks kills the given tasks, and optionally scales their apps down.
+func (service *Service) KillTasks(ctx context.Context, taskIds []string, scale bool) error {
+	body := map[string][]string{"ids": taskIds}
+	path := fmt.Sprintf("/v2/tasks/delete?scale=%v", scale)
+	return service.Do(ctx, http.MethodPost, path, body, nil)
+}
+
+// ----------------------------------------------------------------------------
+// deployments
+
+func (service *Service) GetDeployments(ctx context.Context) ([]*Deployment, error) {
+	var deployments []*Deployment
+	if err := service.Do(ctx, http.MethodGet, "/v2/deployments", nil, &deployments); err != nil {
+		return nil, err
+	}
+	return deployments, nil
+}
+
+// DeleteDeployment cancels the given deployment. Unless forced, a
+// rollback deployment is started.
+func (service *Service) DeleteDeployment(ctx context.Context, deploymentId string, force bool) error {
+	path := "/v2/deployments/" + url.PathEscape(deploymentId) + forceQuery(force)
+	return service.Do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// ----------------------------------------------------------------------------
+// queue
+
+func (service *Service) GetQueue(ctx context.Context) ([]QueueItem, error) {
+	var v struct {
+		Queue []QueueItem
+	}
+
+	if err := service.Do(ctx, http.MethodGet, "/v2/queue", nil, &v); err != nil {
+		return nil, err
+	}
+	return v.Queue, nil
+}
+
+// ResetQueueDelay resets the launch delay of the given app.
+func (service *Service) ResetQueueDelay(ctx context.Context, appId string) error {
+	path := "/v2/queue/" + strings.TrimPrefix(appId, "/") + "/delay"
+	return service.Do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// ----------------------------------------------------------------------------
+// leader & info
+
+// GetLeader returns the host:port of the current Marathon leader.
+func (service *Service) GetLeader(ctx context.Context) (string, error) {
+	var v struct {
+		Leader string
+	}
+
+	if err := service.Do(ctx, http.MethodGet, "/v2/leader", nil, &v); err != nil {
+		return "", err
+	}
+	return v.Leader, nil
+}
+
+// AbdicateLeader causes the current leader to abdicate.
+func (service *Service) AbdicateLeader(ctx context.Context) error {
+	return service.Do(ctx, http.MethodDelete, "/v2/leader", nil, nil)
+}
+
+func (service *Service) GetInfo(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := service.Do(ctx, http.MethodGet, "/v2/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ----------------------------------------------------------------------------
+// helpers
+
+func appPath(appId string) string {
+	return "/v2/apps/" + strings.TrimPrefix(appId, "/")
+}
+
+func groupPath(groupId string) string {
+	return "/v2/groups/" + strings.TrimPrefix(groupId, "/")
+}
+
+func forceQuery(force bool) string {
+	if force {
+		return "?force=true"
 	}
+	return ""
 }
@@ -0,0 +1,326 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package marathon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMarathon serves canned responses by method and request URI, and
+// records the requests it received.
+type fakeMarathon struct {
+	*httptest.Server
+	responses map[string]string
+	requests  []fakeRequest
+	mutex     sync.Mutex
+}
+
+type fakeRequest struct {
+	Method string
+	URI    string
+	Body   string
+}
+
+func newFakeMarathon(t *testing.T, responses map[string]string) (*fakeMarathon, *Service) {
+	fake := &fakeMarathon{responses: responses}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, fakeRequest{r.Method, r.URL.RequestURI(), string(body)})
+		fake.mutex.Unlock()
+
+		response, ok := fake.responses[r.Method+" "+r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"App '/unknown' does not exist"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+
+	service, err := NewServiceWithURL(fake.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, service
+}
+
+func (fake *fakeMarathon) lastRequest(t *testing.T) fakeRequest {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if len(fake.requests) == 0 {
+		t.Fatal("No request received.")
+	}
+	return fake.requests[len(fake.requests)-1]
+}
+
+func TestServiceGetApps(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/apps?embed=apps.tasks": `{"apps":[{"id":"/web","instances":2,"mem":128.5,
+			"tasks":[{"id":"web.1","host":"10.0.0.1","ports":[31000],"appId":"/web"}]}]}`,
+		"GET /v2/apps/web?embed=apps.tasks": `{"app":{"id":"/web","instances":2}}`,
+	})
+	defer fake.Close()
+
+	apps, err := service.GetApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Id != "/web" || apps[0].Mem != 128.5 {
+		t.Fatalf("Unexpected apps %+v.", apps)
+	}
+	if task := apps[0].GetTaskById("web.1"); task == nil || task.Host != "10.0.0.1" {
+		t.Fatalf("Unexpected tasks %+v.", apps[0].Tasks)
+	}
+	if apps[0].service != service {
+		t.Fatal("App not bound to the service.")
+	}
+
+	app, err := service.GetApp(context.Background(), "/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Id != "/web" || app.Instances == nil || *app.Instances != 2 {
+		t.Fatalf("Unexpected app %+v.", app)
+	}
+}
+
+func TestServiceScaleApp(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"PUT /v2/apps/web": `{"deploymentId":"d1","version":"2017-01-02T03:04:05.000Z"}`,
+	})
+	defer fake.Close()
+
+	result, err := service.ScaleApp(context.Background(), "/web", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DeploymentId != "d1" {
+		t.Fatalf("Unexpected deployment result %+v.", result)
+	}
+
+	if body := fake.lastRequest(t).Body; body != `{"instances":3}` {
+		t.Fatalf("Unexpected request body %q.", body)
+	}
+}
+
+func TestServiceUpdateAppOmitsEmptyFields(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"PUT /v2/apps/web?force=true": `{"deploymentId":"d2"}`,
+	})
+	defer fake.Close()
+
+	labels := map[string]string{"lb-weight": "2"}
+	if _, err := service.UpdateApp(context.Background(), &App{Id: "/web", Labels: labels}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(fake.lastRequest(t).Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"instances", "container", "upgradeStrategy", "version", "residency", "versionInfo", "mem"} {
+		if _, ok := body[field]; ok {
+			t.Errorf("Empty field %q sent to Marathon.", field)
+		}
+	}
+	if _, ok := body["labels"]; !ok {
+		t.Error("Labels not sent to Marathon.")
+	}
+}
+
+func TestServiceGetGroups(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/groups/?embed=group.groups&embed=group.apps": `{"id":"/","apps":[{"id":"/a"}],
+			"groups":[{"id":"/sub","apps":[{"id":"/sub/b"}]}]}`,
+	})
+	defer fake.Close()
+
+	group, err := service.GetGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apps := group.GetAllApps()
+	if len(apps) != 2 || apps[0].Id != "/a" || apps[1].Id != "/sub/b" {
+		t.Fatalf("Unexpected apps %+v.", apps)
+	}
+}
+
+func TestServiceTasks(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/tasks":                    `{"tasks":[{"id":"a.1","state":"TASK_RUNNING"},{"id":"b.1"}]}`,
+		"GET /v2/apps/a/tasks":             `{"tasks":[{"id":"a.1"}]}`,
+		"POST /v2/tasks/delete?scale=true": `{"tasks":[]}`,
+	})
+	defer fake.Close()
+
+	tasks, err := service.GetTasks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 || tasks[0].State == nil || *tasks[0].State != TaskRunning {
+		t.Fatalf("Unexpected tasks %+v.", tasks)
+	}
+
+	tasks, err = service.GetAppTasks(context.Background(), "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != "a.1" {
+		t.Fatalf("Unexpected app tasks %+v.", tasks)
+	}
+
+	if err := service.KillTasks(context.Background(), []string{"a.1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if body := fake.lastRequest(t).Body; body != `{"ids":["a.1"]}` {
+		t.Fatalf("Unexpected request body %q.", body)
+	}
+}
+
+func TestServiceDeployments(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/deployments":                  `[{"id":"d1","affectedApps":["/web"],"currentStep":1,"totalSteps":2}]`,
+		"DELETE /v2/deployments/d1?force=true": `{}`,
+	})
+	defer fake.Close()
+
+	deployments, err := service.GetDeployments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments) != 1 || !deployments[0].IsAffectingApp("/web") {
+		t.Fatalf("Unexpected deployments %+v.", deployments)
+	}
+
+	if err := service.DeleteDeployment(context.Background(), "d1", true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceQueue(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/queue":              `{"queue":[{"count":1,"delay":{"timeLeftSeconds":5,"overdue":false},"app":{"id":"/web"}}]}`,
+		"DELETE /v2/queue/web/delay": ``,
+	})
+	defer fake.Close()
+
+	queue, err := service.GetQueue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 || queue[0].Delay.TimeLeftSeconds != 5 || queue[0].App.Id != "/web" {
+		t.Fatalf("Unexpected queue %+v.", queue)
+	}
+
+	if err := service.ResetQueueDelay(context.Background(), "/web"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceLeaderAndInfo(t *testing.T) {
+	fake, service := newFakeMarathon(t, map[string]string{
+		"GET /v2/leader": `{"leader":"marathon-1:8080"}`,
+		"GET /v2/info":   `{"name":"marathon","version":"1.4.2","elected":true,"leader":"marathon-1:8080"}`,
+	})
+	defer fake.Close()
+
+	leader, err := service.GetLeader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader != "marathon-1:8080" {
+		t.Fatalf("Unexpected leader %q.", leader)
+	}
+
+	info, err := service.GetInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.4.2" || !info.Elected {
+		t.Fatalf("Unexpected info %+v.", info)
+	}
+}
+
+func TestServiceError(t *testing.T) {
+	fake, service := newFakeMarathon(t, nil)
+	defer fake.Close()
+
+	_, err := service.GetApp(context.Background(), "/unknown")
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %T: %v", err, err)
+	}
+	if e.StatusCode != http.StatusNotFound || e.Message != "App '/unknown' does not exist" {
+		t.Fatalf("Unexpected error %+v.", e)
+	}
+	if !IsNotFound(err) || IsConflict(err) {
+		t.Fatalf("Error %v not classified as 404.", err)
+	}
+}
+
+func TestServiceErrorDetails(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message":"Object is not valid","details":[{"path":"/instances","errors":["must be positive"]}]}`))
+	}))
+	defer fake.Close()
+
+	service, _ := NewServiceWithURL(fake.URL)
+	_, err := service.ScaleApp(context.Background(), "/web", 0)
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %T: %v", err, err)
+	}
+	if len(e.Details) != 1 || e.Details[0].Path != "/instances" || e.Details[0].Errors[0] != "must be positive" {
+		t.Fatalf("Unexpected error details %+v.", e.Details)
+	}
+}
+
+func TestServiceContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer fake.Close()
+	defer close(release)
+
+	service, _ := NewServiceWithURL(fake.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.GetApps(ctx)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected the cancelled call to fail.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelled call did not abort.")
+	}
+}
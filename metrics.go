@@ -0,0 +1,343 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the latency histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	// discoveryEvents counts the received service discovery events by type.
+	discoveryEvents = NewCounterVec()
+
+	// discoveryReconnects counts the reconnects to service discovery event streams.
+	discoveryReconnects uint64
+
+	// marathonLatency measures the Marathon API request latency by method.
+	marathonLatency = NewHistogramVec()
+)
+
+// Histogram counts observed durations into latencyBuckets.
+type Histogram struct {
+	counts []uint64 // per bucket, plus one for +Inf
+	count  uint64
+	sum    int64 // in nanoseconds
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"count": atomic.LoadUint64(&h.count),
+		"sum":   time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	})
+}
+
+// StatusCounters counts responses by their status class (1xx to 5xx).
+type StatusCounters [5]uint64
+
+func (c *StatusCounters) Inc(statusCode int) {
+	if i := statusCode/100 - 1; i >= 0 && i < len(c) {
+		atomic.AddUint64(&c[i], 1)
+	}
+}
+
+func (c *StatusCounters) MarshalJSON() ([]byte, error) {
+	m := make(map[string]uint64)
+	for i := range c {
+		m[statusClass(i)] = atomic.LoadUint64(&c[i])
+	}
+	return json.Marshal(m)
+}
+
+func statusClass(i int) string {
+	return fmt.Sprintf("%vxx", i+1)
+}
+
+// CounterVec is a set of counters by label value.
+type CounterVec struct {
+	mutex  sync.Mutex
+	values map[string]*uint64
+}
+
+func NewCounterVec() *CounterVec {
+	return &CounterVec{values: make(map[string]*uint64)}
+}
+
+func (vec *CounterVec) Inc(label string) {
+	vec.mutex.Lock()
+	value, ok := vec.values[label]
+	if !ok {
+		value = new(uint64)
+		vec.values[label] = value
+	}
+	vec.mutex.Unlock()
+
+	atomic.AddUint64(value, 1)
+}
+
+func (vec *CounterVec) each(fn func(label string, value uint64)) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	labels := make([]string, 0, len(vec.values))
+	for label := range vec.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fn(label, atomic.LoadUint64(vec.values[label]))
+	}
+}
+
+// HistogramVec is a set of histograms by label value.
+type HistogramVec struct {
+	mutex  sync.Mutex
+	values map[string]*Histogram
+}
+
+func NewHistogramVec() *HistogramVec {
+	return &HistogramVec{values: make(map[string]*Histogram)}
+}
+
+func (vec *HistogramVec) Observe(label string, d time.Duration) {
+	vec.mutex.Lock()
+	h, ok := vec.values[label]
+	if !ok {
+		h = NewHistogram()
+		vec.values[label] = h
+	}
+	vec.mutex.Unlock()
+
+	h.Observe(d)
+}
+
+func (vec *HistogramVec) each(fn func(label string, h *Histogram)) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	labels := make([]string, 0, len(vec.values))
+	for label := range vec.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fn(label, vec.values[label])
+	}
+}
+
+// observeMarathonRequest is installed as the Marathon API client's
+// request observer.
+func observeMarathonRequest(method string, statusCode int, elapsed time.Duration) {
+	marathonLatency.Observe(method, elapsed)
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// sample writes a single sample, with labels given as name/value pairs.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(m.w, "%v%v %v\n", name, formatLabels(labels), formatValue(value))
+}
+
+func (m metricsWriter) histogram(name string, h *Histogram, labels ...string) {
+	cumulative := uint64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		m.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatValue(bound))...)
+	}
+	m.sample(name+"_bucket", float64(atomic.LoadUint64(&h.count)), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", time.Duration(atomic.LoadInt64(&h.sum)).Seconds(), labels...)
+	m.sample(name+"_count", float64(atomic.LoadUint64(&h.count)), labels...)
+}
+
+func (m metricsWriter) statusCounters(name string, c *StatusCounters, labels ...string) {
+	for i := range c {
+		m.sample(name, float64(atomic.LoadUint64(&c[i])), append(labels, "class", statusClass(i))...)
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// httpServiceMetrics is a consistent snapshot of a service's backends,
+// taken for writing its metrics.
+type httpServiceMetrics struct {
+	service  *HttpService
+	backends []*HttpBackend // including the draining ones
+}
+
+// MetricsHandler serves the metrics of all services, backends, service
+// discoveries and routers in the Prometheus text exposition format.
+//
+// Backends are only exported as long as they are part of their service
+// (including while draining), keeping the number of series bounded when
+// tasks churn. Service level metrics are retained across backend changes.
+func (sag *ServiceApplicationGateway) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	var services []httpServiceMetrics
+	var httpRouters, tcpRouters int
+
+	ok := sag.inspect(func() {
+		for _, serviceId := range sag.getHttpServiceIds() {
+			service := sag.HttpServices[serviceId]
+			service.mutex.Lock()
+			backends := append(append([]*HttpBackend{}, service.Backends...), service.Draining...)
+			service.mutex.Unlock()
+			services = append(services, httpServiceMetrics{service, backends})
+		}
+		httpRouters = len(sag.HttpRouters)
+		tcpRouters = len(sag.TcpRouters)
+	})
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var buf bytes.Buffer
+	m := metricsWriter{&buf}
+
+	m.header("sag_http_requests_total", "counter", "HTTP requests served by service and status class.")
+	for _, s := range services {
+		m.statusCounters("sag_http_requests_total", &s.service.Requests, "service", s.service.ServiceId)
+	}
+
+	m.header("sag_http_request_duration_seconds", "histogram", "HTTP request latency by service.")
+	for _, s := range services {
+		m.histogram("sag_http_request_duration_seconds", s.service.Duration, "service", s.service.ServiceId)
+	}
+
+	m.header("sag_http_retries_total", "counter", "HTTP requests retried on another backend by service.")
+	for _, s := range services {
+		m.sample("sag_http_retries_total", float64(atomic.LoadUint64(&s.service.Retries)), "service", s.service.ServiceId)
+	}
+
+	m.header("sag_http_ejections_total", "counter", "Backends passively ejected after consecutive failures by service.")
+	for _, s := range services {
+		m.sample("sag_http_ejections_total", float64(atomic.LoadUint64(&s.service.Ejections)), "service", s.service.ServiceId)
+	}
+
+	m.header("sag_http_backend_requests_total", "counter", "HTTP requests proxied by backend and status class.")
+	for _, s := range services {
+		for _, backend := range s.backends {
+			m.statusCounters("sag_http_backend_requests_total", &backend.Requests,
+				"service", s.service.ServiceId, "backend", backend.Id)
+		}
+	}
+
+	m.header("sag_http_backend_duration_seconds", "histogram", "HTTP backend time to first response byte by backend.")
+	for _, s := range services {
+		for _, backend := range s.backends {
+			m.histogram("sag_http_backend_duration_seconds", backend.Duration,
+				"service", s.service.ServiceId, "backend", backend.Id)
+		}
+	}
+
+	m.header("sag_http_backend_in_flight", "gauge", "HTTP requests currently in flight by backend.")
+	for _, s := range services {
+		for _, backend := range s.backends {
+			m.sample("sag_http_backend_in_flight", float64(backend.GetCurrentLoad()),
+				"service", s.service.ServiceId, "backend", backend.Id)
+		}
+	}
+
+	m.header("sag_http_backend_ejected", "gauge", "Whether the backend is currently passively ejected.")
+	for _, s := range services {
+		for _, backend := range s.backends {
+			m.sample("sag_http_backend_ejected", boolValue(backend.IsEjected()),
+				"service", s.service.ServiceId, "backend", backend.Id)
+		}
+	}
+
+	m.header("sag_discovery_events_total", "counter", "Service discovery events received by type.")
+	discoveryEvents.each(func(eventType string, value uint64) {
+		m.sample("sag_discovery_events_total", float64(value), "type", eventType)
+	})
+
+	m.header("sag_discovery_reconnects_total", "counter", "Reconnects to service discovery event streams.")
+	m.sample("sag_discovery_reconnects_total", float64(atomic.LoadUint64(&discoveryReconnects)))
+
+	m.header("sag_marathon_request_duration_seconds", "histogram", "Marathon API request latency by method.")
+	marathonLatency.each(func(method string, h *Histogram) {
+		m.histogram("sag_marathon_request_duration_seconds", h, "method", method)
+	})
+
+	m.header("sag_routers", "gauge", "Number of routers by kind.")
+	m.sample("sag_routers", float64(httpRouters), "kind", "http")
+	m.sample("sag_routers", float64(tcpRouters), "kind", "tcp")
+
+	m.header("sag_listeners", "gauge", "Number of listening sockets.")
+	m.sample("sag_listeners", float64(countListeners()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
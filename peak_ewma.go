@@ -0,0 +1,70 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// PeakEwma is an exponentially weighted moving average of latencies that
+// immediately jumps up to any observed peak, and only slowly decays
+// back towards lower latencies.
+type PeakEwma struct {
+	decay time.Duration
+	mutex sync.Mutex
+	value float64 // in nanoseconds
+	stamp time.Time
+}
+
+func NewPeakEwma(decay time.Duration) *PeakEwma {
+	return &PeakEwma{
+		decay: decay,
+		stamp: time.Now(),
+	}
+}
+
+// Observe adds the given latency sample.
+func (ewma *PeakEwma) Observe(rtt time.Duration) {
+	ewma.mutex.Lock()
+	defer ewma.mutex.Unlock()
+
+	ewma.update(time.Now(), float64(rtt))
+}
+
+// Value returns the current average, decayed up to now.
+func (ewma *PeakEwma) Value() time.Duration {
+	ewma.mutex.Lock()
+	defer ewma.mutex.Unlock()
+
+	return time.Duration(ewma.update(time.Now(), 0))
+}
+
+func (ewma *PeakEwma) update(now time.Time, rtt float64) float64 {
+	elapsed := now.Sub(ewma.stamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	ewma.stamp = now
+
+	if rtt > ewma.value {
+		ewma.value = rtt
+	} else {
+		w := math.Exp(-float64(elapsed) / float64(ewma.decay))
+		ewma.value = ewma.value*w + rtt*(1-w)
+	}
+
+	return ewma.value
+}
+
+func (ewma *PeakEwma) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ewma.Value().String())
+}
@@ -0,0 +1,438 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions, as configured by the lb-proxy-protocol label.
+const (
+	ProxyProtocolDisabled = 0
+	ProxyProtocolV1       = 1
+	ProxyProtocolV2       = 2
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands, address families and TLV types.
+const (
+	proxyV2CommandLocal = 0x20 // version 2, LOCAL
+	proxyV2CommandProxy = 0x21 // version 2, PROXY
+
+	proxyV2FamilyUnspec = 0x00
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyUDP4   = 0x12
+	proxyV2FamilyTCP6   = 0x21
+	proxyV2FamilyUDP6   = 0x22
+
+	proxyV2TypeALPN      = 0x01
+	proxyV2TypeAuthority = 0x02 // such as the TLS SNI host name
+)
+
+// proxyProtocolV1MaxLength is the maximum length of a v1 header line.
+const proxyProtocolV1MaxLength = 107
+
+// ProxyHeader describes a client connection, as passed on to backends
+// by the PROXY protocol.
+type ProxyHeader struct {
+	Source      net.Addr
+	Destination net.Addr
+	ServerName  string // TLS server name (SNI) requested by the client, if known
+	ALPN        string // negotiated TLS application protocol, if known
+}
+
+// NewProxyHeader describes the given client connection. As sag does not
+// terminate TLS on TCP services, the server name and application protocol
+// are only known if passed on by a trusted proxy in front of sag.
+func NewProxyHeader(conn net.Conn) *ProxyHeader {
+	header := &ProxyHeader{
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
+	}
+
+	if pc, ok := conn.(*proxyProtocolConn); ok && pc.readHeader() == nil {
+		header.ServerName = pc.header.ServerName
+		header.ALPN = pc.header.ALPN
+	}
+
+	return header
+}
+
+// tcpAddrs returns the source and destination TCP addresses, and whether
+// they are of the same address family.
+func (header *ProxyHeader) tcpAddrs() (*net.TCPAddr, *net.TCPAddr, bool) {
+	src, ok1 := header.Source.(*net.TCPAddr)
+	dst, ok2 := header.Destination.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, nil, false
+	}
+
+	return src, dst, (src.IP.To4() == nil) == (dst.IP.To4() == nil)
+}
+
+// Marshal encodes the header in the given PROXY protocol version.
+func (header *ProxyHeader) Marshal(version int) ([]byte, error) {
+	switch version {
+	case ProxyProtocolV1:
+		return header.marshalV1(), nil
+	case ProxyProtocolV2:
+		return header.marshalV2(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %v.", version)
+	}
+}
+
+// WriteTo writes the header in the given PROXY protocol version.
+func (header *ProxyHeader) WriteTo(w io.Writer, version int) error {
+	data, err := header.Marshal(version)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// marshalV1 encodes the header in the human-readable v1 format, such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func (header *ProxyHeader) marshalV1() []byte {
+	src, dst, ok := header.tcpAddrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if src.IP.To4() != nil {
+		family = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %v %v %v %v %v\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+// marshalV2 encodes the header in the binary v2 format, including the
+// server name and application protocol as TLVs, if known.
+func (header *ProxyHeader) marshalV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+
+	src, dst, ok := header.tcpAddrs()
+	if !ok {
+		buf.Write([]byte{proxyV2CommandLocal, proxyV2FamilyUnspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	var addrs bytes.Buffer
+	family := byte(proxyV2FamilyTCP6)
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil {
+		family = proxyV2FamilyTCP4
+		addrs.Write(src4)
+		addrs.Write(dst4)
+	} else {
+		addrs.Write(src.IP.To16())
+		addrs.Write(dst.IP.To16())
+	}
+	binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+	binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+
+	writeProxyV2TLV(&addrs, proxyV2TypeAuthority, header.ServerName)
+	writeProxyV2TLV(&addrs, proxyV2TypeALPN, header.ALPN)
+
+	buf.Write([]byte{proxyV2CommandProxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(addrs.Len()))
+	buf.Write(addrs.Bytes())
+
+	return buf.Bytes()
+}
+
+// writeProxyV2TLV appends the given TLV, unless its value is empty.
+func writeProxyV2TLV(buf *bytes.Buffer, kind byte, value string) {
+	if len(value) == 0 {
+		return
+	}
+
+	buf.WriteByte(kind)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header. The returned
+// header has no addresses if the proxy sent it on its own behalf, such as
+// for health checks.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	prefix, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch prefix[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyProtocolV2Signature[0]:
+		return readProxyHeaderV2(r)
+	default:
+		return nil, fmt.Errorf("No PROXY protocol header.")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("PROXY protocol v1 header too long.")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header.")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header.")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return &ProxyHeader{}, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Invalid PROXY protocol v1 header.")
+		}
+		source, err := parseProxyAddr(fields[2], fields[4])
+		if err != nil {
+			return nil, err
+		}
+		destination, err := parseProxyAddr(fields[3], fields[5])
+		if err != nil {
+			return nil, err
+		}
+		return &ProxyHeader{Source: source, Destination: destination}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol v1 protocol %q.", fields[1])
+	}
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol address %q.", host)
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol port %q.", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var prefix [16]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(prefix[:12], proxyProtocolV2Signature) {
+		return nil, fmt.Errorf("Invalid PROXY protocol v2 signature.")
+	}
+
+	if prefix[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %v.", prefix[12]>>4)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(prefix[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{}
+	switch prefix[12] {
+	case proxyV2CommandLocal:
+		return header, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol v2 command %v.", prefix[12]&0x0F)
+	}
+
+	var addrLen int
+	switch prefix[13] {
+	case proxyV2FamilyTCP4, proxyV2FamilyUDP4:
+		addrLen = 4
+	case proxyV2FamilyTCP6, proxyV2FamilyUDP6:
+		addrLen = 16
+	default:
+		// no IP addresses, such as for unix sockets
+		return header, nil
+	}
+
+	if len(data) < 2*addrLen+4 {
+		return nil, fmt.Errorf("PROXY protocol v2 addresses truncated.")
+	}
+
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(data[:addrLen]),
+		Port: int(binary.BigEndian.Uint16(data[2*addrLen:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(data[addrLen : 2*addrLen]),
+		Port: int(binary.BigEndian.Uint16(data[2*addrLen+2:])),
+	}
+
+	for tlvs := data[2*addrLen+4:]; len(tlvs) >= 3; {
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, fmt.Errorf("PROXY protocol v2 TLV truncated.")
+		}
+		switch tlvs[0] {
+		case proxyV2TypeAuthority:
+			header.ServerName = string(tlvs[3 : 3+length])
+		case proxyV2TypeALPN:
+			header.ALPN = string(tlvs[3 : 3+length])
+		}
+		tlvs = tlvs[3+length:]
+	}
+
+	return header, nil
+}
+
+// ProxyProtocolPolicy decides from which clients PROXY protocol headers
+// are accepted, such as from the load balancers in front of sag.
+type ProxyProtocolPolicy struct {
+	TrustedSources []*net.IPNet  // no source if empty
+	ReadTimeout    time.Duration // limits the time for clients to send the header
+}
+
+func NewProxyProtocolPolicy(trustedSources []string, readTimeout time.Duration) (*ProxyProtocolPolicy, error) {
+	policy := &ProxyProtocolPolicy{ReadTimeout: readTimeout}
+
+	for _, source := range trustedSources {
+		network, err := ParseNetwork(source)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted source %q. %v", source, err)
+		}
+		policy.TrustedSources = append(policy.TrustedSources, network)
+	}
+
+	return policy, nil
+}
+
+// Trusts tests whether PROXY protocol headers are accepted from the given
+// client address. Without any trusted sources, no client is trusted, as
+// anyone could spoof their address otherwise.
+func (policy *ProxyProtocolPolicy) Trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return ContainsIP(policy.TrustedSources, tcpAddr.IP)
+}
+
+// Wrap makes the given connection expect a PROXY protocol header if the
+// client is trusted, reporting the client address from the header as its
+// remote address. Connections of untrusted clients are left untouched.
+func (policy *ProxyProtocolPolicy) Wrap(conn net.Conn) net.Conn {
+	if !policy.Trusts(conn.RemoteAddr()) {
+		return conn
+	}
+
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: policy.ReadTimeout,
+	}
+}
+
+// proxyProtocolConn reads the PROXY protocol header upon first use, rather
+// than upon accepting the connection, so a slow client cannot hold up
+// accepting others.
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	header  *ProxyHeader
+	err     error
+}
+
+// readHeader reads the PROXY protocol header, if not done yet.
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout != 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+
+		c.header, c.err = ReadProxyHeader(c.reader)
+
+		if c.timeout != 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+
+		if c.err != nil {
+			log.Printf("Failed to read PROXY protocol header from %v. %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection, if supported.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return conn.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
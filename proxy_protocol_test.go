@@ -0,0 +1,236 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addrConn reports the given addresses instead of the connection's.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		header  ProxyHeader
+		encoded string // v1 only
+	}{
+		{
+			name:    "v1 tcp4",
+			version: ProxyProtocolV1,
+			header:  ProxyHeader{Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")},
+			encoded: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		},
+		{
+			name:    "v1 tcp6",
+			version: ProxyProtocolV1,
+			header:  ProxyHeader{Source: tcpAddr("[2001:db8::1]:56324"), Destination: tcpAddr("[2001:db8::2]:443")},
+			encoded: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:    "v1 unknown",
+			version: ProxyProtocolV1,
+			header:  ProxyHeader{},
+			encoded: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "v2 tcp4",
+			version: ProxyProtocolV2,
+			header:  ProxyHeader{Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")},
+		},
+		{
+			name:    "v2 tcp6 with tlvs",
+			version: ProxyProtocolV2,
+			header: ProxyHeader{
+				Source:      tcpAddr("[2001:db8::1]:56324"),
+				Destination: tcpAddr("[2001:db8::2]:443"),
+				ServerName:  "example.com",
+				ALPN:        "h2",
+			},
+		},
+		{
+			name:    "v2 local",
+			version: ProxyProtocolV2,
+			header:  ProxyHeader{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			go func() {
+				test.header.WriteTo(client, test.version)
+				client.Write([]byte("payload"))
+				client.Close()
+			}()
+
+			reader := bufio.NewReader(server)
+			if len(test.encoded) != 0 {
+				line, err := reader.Peek(len(test.encoded))
+				if err != nil || string(line) != test.encoded {
+					t.Fatalf("Expected %q, got %q. %v", test.encoded, line, err)
+				}
+			}
+
+			header, err := ReadProxyHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertProxyHeader(t, &test.header, header)
+
+			payload, _ := ioutil.ReadAll(reader)
+			if string(payload) != "payload" {
+				t.Fatalf("Expected payload after header, got %q.", payload)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+		"PROXY TCP4 nohost 192.0.2.2 56324 443\r\n",
+		"PROXY SCTP 192.0.2.1 192.0.2.2 56324 443\r\n",
+		"PROXY " + strings.Repeat("X", proxyProtocolV1MaxLength) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00",
+	} {
+		if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Errorf("Expected %q to be rejected.", data)
+		}
+	}
+}
+
+func TestProxyProtocolPolicyTrusts(t *testing.T) {
+	tests := []struct {
+		trustedSources []string
+		addr           net.Addr
+		trusted        bool
+	}{
+		{nil, tcpAddr("10.0.0.1:40000"), false},
+		{[]string{"10.0.0.0/8"}, tcpAddr("10.0.0.1:40000"), true},
+		{[]string{"10.0.0.0/8"}, tcpAddr("192.0.2.1:40000"), false},
+		{[]string{"192.0.2.1", "2001:db8::/32"}, tcpAddr("[2001:db8::1]:40000"), true},
+		{[]string{"10.0.0.0/8"}, &net.UnixAddr{Name: "/tmp/sag.sock", Net: "unix"}, false},
+	}
+
+	for _, test := range tests {
+		policy, err := NewProxyProtocolPolicy(test.trustedSources, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trusted := policy.Trusts(test.addr); trusted != test.trusted {
+			t.Errorf("Expected %v to be trusted by %v: %v, got %v.", test.addr, test.trustedSources, test.trusted, trusted)
+		}
+	}
+}
+
+// TestTcpProxyPassesProxyHeader proxies a client connection, accepted with
+// a PROXY protocol header of a trusted load balancer, to a fake backend
+// that parses the header passed on to it.
+func TestTcpProxyPassesProxyHeader(t *testing.T) {
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan *ProxyHeader, 1)
+		go func() {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			header, err := ReadProxyHeader(reader)
+			if err != nil {
+				t.Error(err)
+			}
+			received <- header
+
+			line, _ := reader.ReadString('\n')
+			conn.Write([]byte("echo " + line))
+		}()
+
+		client, server := net.Pipe()
+		balancer := &addrConn{Conn: server, remote: tcpAddr("10.0.0.1:40000"), local: tcpAddr("10.0.0.2:443")}
+		policy, _ := NewProxyProtocolPolicy([]string{"10.0.0.0/8"}, time.Second)
+
+		proxy := NewTcpProxy("127.0.0.1", uint(backend.Addr().(*net.TCPAddr).Port), version)
+		done := make(chan error, 1)
+		go func() { done <- proxy.ServeTCP(policy.Wrap(balancer)) }()
+
+		inbound := ProxyHeader{
+			Source:      tcpAddr("[2001:db8::1]:56324"),
+			Destination: tcpAddr("[2001:db8::2]:443"),
+			ServerName:  "example.com",
+			ALPN:        "h2",
+		}
+		inbound.WriteTo(client, ProxyProtocolV2)
+		client.Write([]byte("hello\n"))
+
+		expected := inbound
+		if version == ProxyProtocolV1 {
+			expected.ServerName, expected.ALPN = "", ""
+		}
+		assertProxyHeader(t, &expected, <-received)
+
+		reply, _ := bufio.NewReader(client).ReadString('\n')
+		if reply != "echo hello\n" {
+			t.Errorf("Unexpected reply %q.", reply)
+		}
+
+		client.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		backend.Close()
+	}
+}
+
+func assertProxyHeader(t *testing.T, expected, actual *ProxyHeader) {
+	if addrString(expected.Source) != addrString(actual.Source) ||
+		addrString(expected.Destination) != addrString(actual.Destination) ||
+		expected.ServerName != actual.ServerName || expected.ALPN != actual.ALPN {
+		t.Fatalf("Expected header %+v, got %+v.", expected, actual)
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
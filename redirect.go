@@ -0,0 +1,89 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isRedirectStatus tests whether the given status can be used for
+// redirecting clients to HTTPS or to the canonical host.
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// Redirect redirects requests to host aliases to the canonical host, and
+// plain HTTP requests to SSL hosts to HTTPS, if enabled, keeping the path
+// and query. The scheme is the one used by the client, which differs from
+// the request's behind TLS terminating proxies. It returns true if the
+// request has been redirected.
+func (service *HttpService) Redirect(w http.ResponseWriter, r *http.Request, scheme string) bool {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if name, err := NormalizeHost(host); err == nil {
+		host = name
+	}
+
+	// the settings may be updated by service discovery at any time
+	service.mutex.Lock()
+	canonicalHost, aliases, sslHosts := service.CanonicalHost, service.Aliases, service.SslHosts
+	redirectHttps, status := service.RedirectHttps, service.RedirectStatus
+	service.mutex.Unlock()
+
+	target := host
+	if len(canonicalHost) != 0 && containsHost(aliases, host) {
+		target = canonicalHost
+	}
+
+	if scheme != "https" && redirectHttps && containsHost(sslHosts, target) {
+		// the HTTPS port is unknown to the plain HTTP router
+		scheme, port = "https", ""
+	} else if target == host {
+		return false
+	}
+
+	if len(port) != 0 {
+		target = net.JoinHostPort(target, port)
+	}
+
+	http.Redirect(w, r, scheme+"://"+target+r.URL.RequestURI(), status)
+	return true
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeHosts returns the hosts of all given lists, without duplicates.
+func mergeHosts(lists ...[]string) []string {
+	hosts := []string{}
+	for _, list := range lists {
+		for _, host := range list {
+			if !containsHost(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,69 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectBehindTrustedProxy(t *testing.T) {
+	service := &HttpService{
+		ServiceId:      "/web",
+		CanonicalHost:  "example.com",
+		Aliases:        []string{"www.example.com"},
+		SslHosts:       []string{"example.com"},
+		RedirectHttps:  true,
+		RedirectStatus: http.StatusMovedPermanently,
+	}
+
+	appendMode, _ := NewForwardingPolicy(ForwardingAppend, []string{"10.0.0.0/8"}, false)
+	replaceMode, _ := NewForwardingPolicy(ForwardingReplace, []string{"10.0.0.0/8"}, false)
+
+	tests := []struct {
+		name       string
+		policy     *ForwardingPolicy
+		remoteAddr string
+		host       string
+		proto      string
+		tls        bool
+		location   string
+	}{
+		{"plain http", appendMode, "192.0.2.1:1234", "example.com", "", false, "https://example.com/a?b=c"},
+		{"https", appendMode, "192.0.2.1:1234", "example.com", "", true, ""},
+		{"untrusted proto", appendMode, "192.0.2.1:1234", "example.com", "https", false, "https://example.com/a?b=c"},
+		{"trusted https proto", appendMode, "10.0.0.1:1234", "example.com", "https", false, ""},
+		{"trusted https proto in replace mode", replaceMode, "10.0.0.1:1234", "example.com", "https", false, ""},
+		{"trusted http proto", appendMode, "10.0.0.1:1234", "example.com", "http", true, "https://example.com/a?b=c"},
+		{"outermost trusted proto", appendMode, "10.0.0.1:1234", "example.com", "HTTPS, http", false, ""},
+		{"trusted alias", appendMode, "10.0.0.1:1234", "www.example.com:8443", "https", false, "https://example.com:8443/a?b=c"},
+		{"no policy", nil, "10.0.0.1:1234", "example.com", "https", false, "https://example.com/a?b=c"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://"+test.host+"/a?b=c", nil)
+		r.RemoteAddr = test.remoteAddr
+		if len(test.proto) != 0 {
+			r.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		} else {
+			r.TLS = nil
+		}
+
+		w := httptest.NewRecorder()
+		redirected := service.Redirect(w, r, test.policy.Scheme(r))
+		if location := w.Header().Get("Location"); redirected != (len(test.location) != 0) || location != test.location {
+			t.Errorf("%v: Expected redirect to %q, got %q (%v).", test.name, test.location, location, redirected)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ReloadConfig re-reads the configuration and applies it to the running
+// gateway, keeping the running configuration if it fails.
+func (sag *ServiceApplicationGateway) ReloadConfig() error {
+	next, err := sag.resolveConfig()
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	select {
+	case sag.eventStream <- ReloadConfigEvent{Config: next, Result: result}:
+	case <-sag.quit:
+		return fmt.Errorf("Shutting down.")
+	}
+
+	return <-result
+}
+
+// applyConfig changes the listeners, service discoveries, TLS certificates,
+// PROXY protocol and forwarding policies, header rules, access log and
+// defaults of the running gateway in place. Active sessions on unchanged
+// listeners are not affected, while the routers of removed listeners are
+// shut down gracefully.
+//
+// Anything that may fail is prepared first, leaving the gateway untouched
+// if any change cannot be applied. Changed defaults only apply to services
+// discovered afterwards.
+func (sag *ServiceApplicationGateway) applyConfig(next *Config) error {
+	current := sag.config
+
+	var opened []*HttpRouter
+	var created []Discovery
+	var adminListener net.Listener
+	rollback := func() {
+		for _, router := range opened {
+			router.listener.Close()
+		}
+		for _, sd := range created {
+			sd.Shutdown()
+		}
+		if adminListener != nil {
+			adminListener.Close()
+		}
+	}
+
+	proxyProtocol, err := next.ProxyProtocol.Policy()
+	if err != nil {
+		return err
+	}
+
+	forwarding, err := next.Forwarding.Policy()
+	if err != nil {
+		return err
+	}
+
+	tlsConfigs := make(map[string]*tls.Config)
+	acceptProxy := make(map[string]bool)
+	for _, listener := range next.Listeners {
+		acceptProxy[canonicalAddress(listener.Address)] = listener.AcceptProxy
+		if listener.TLS != nil {
+			config, err := listener.TLS.Load()
+			if err != nil {
+				return fmt.Errorf("Failed to load TLS configuration for %v. %v", listener.Address, err)
+			}
+			tlsConfigs[canonicalAddress(listener.Address)] = config
+		}
+	}
+
+	routers := make(map[string]*HttpRouter)
+	for _, router := range sag.HttpRouters {
+		if router.Routing == RoutingByVhost {
+			routers[router.Address()] = router
+		}
+	}
+
+	listeners := make(map[string]bool)
+	for _, listener := range next.Listeners {
+		address := canonicalAddress(listener.Address)
+		listeners[address] = true
+		if _, ok := routers[address]; ok {
+			continue
+		}
+
+		router, err := sag.newHttpVhostRouter(address)
+		if err == nil {
+			err = router.Listen()
+		}
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Failed to listen on %v. %v", address, err)
+		}
+		opened = append(opened, router)
+	}
+
+	if next.Admin.Address != current.Admin.Address && len(next.Admin.Address) != 0 {
+		listener, err := Listen(next.Admin.Address)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Failed to listen on admin address %v. %v", next.Admin.Address, err)
+		}
+		adminListener = listener
+	}
+
+	// sag.Discoveries are in the order of their configuration
+	discoveries := make(map[DiscoveryConfig]Discovery)
+	for i, discoveryConfig := range current.Discoveries {
+		discoveries[discoveryConfig] = sag.Discoveries[i]
+	}
+
+	nextDiscoveries := make([]Discovery, 0, len(next.Discoveries))
+	for _, discoveryConfig := range next.Discoveries {
+		sd, ok := discoveries[discoveryConfig]
+		if !ok {
+			var err error
+			if sd, err = sag.NewDiscovery(discoveryConfig, next.Scheduler); err != nil {
+				rollback()
+				return fmt.Errorf("Failed to create service discovery. %v", err)
+			}
+			created = append(created, sd)
+		}
+		nextDiscoveries = append(nextDiscoveries, sd)
+	}
+
+	if next.Logging != current.Logging {
+		if err := sag.AccessLog.Reconfigure(next.Logging.AccessLog, next.Logging.AccessLogFormat, next.Logging.AccessLogSample); err != nil {
+			rollback()
+			return fmt.Errorf("Failed to reconfigure access log. %v", err)
+		}
+	}
+
+	// from here on, nothing can fail anymore
+
+	httpRouters := make([]*HttpRouter, 0, len(sag.HttpRouters)+len(opened))
+	for _, router := range sag.HttpRouters {
+		if router.Routing == RoutingByVhost && !listeners[router.Address()] {
+			log.Printf("Shutting down router %v on %v.", router.Id, router.Address())
+			go shutdownHttpRouter(router, time.Duration(next.Timeouts.Shutdown))
+			continue
+		}
+		httpRouters = append(httpRouters, router)
+	}
+	for _, router := range opened {
+		log.Printf("Starting router %v on %v.", router.Id, router.Address())
+		router.AccessLog = sag.AccessLog
+		httpRouters = append(httpRouters, router)
+		go router.Serve()
+	}
+	for _, router := range httpRouters {
+		router.SetForwarding(forwarding)
+		if router.Routing == RoutingByVhost {
+			router.SetTLSConfig(tlsConfigs[router.Address()])
+			if acceptProxy[router.Address()] {
+				router.SetProxyProtocol(proxyProtocol)
+			} else {
+				router.SetProxyProtocol(nil)
+			}
+		} else if router.getProxyProtocol() != nil {
+			router.SetProxyProtocol(proxyProtocol)
+		}
+	}
+	sag.HttpRouters = httpRouters
+
+	for _, router := range sag.TcpRouters {
+		if router.getProxyProtocol() != nil {
+			router.SetProxyProtocol(proxyProtocol)
+		}
+	}
+	sag.proxyProtocol = proxyProtocol
+	sag.forwarding = forwarding
+
+	if next.Admin.Address != current.Admin.Address {
+		log.Printf("Moving admin API from %q to %q.", current.Admin.Address, next.Admin.Address)
+		if sag.adminListener != nil {
+			sag.adminListener.Close()
+		}
+		sag.adminListener = adminListener
+		if adminListener != nil {
+			go http.Serve(adminListener, nil)
+		}
+	}
+
+	for i, discoveryConfig := range current.Discoveries {
+		if !containsDiscoveryConfig(next.Discoveries, discoveryConfig) {
+			log.Printf("Stopping service discovery %v.", sag.Discoveries[i])
+			sag.Discoveries[i].Shutdown()
+		}
+	}
+	sag.Discoveries = nextDiscoveries
+	for _, sd := range created {
+		log.Printf("Starting service discovery %v.", sd)
+		go sd.Run()
+	}
+	for _, sd := range sag.Discoveries {
+		if marathon, ok := sd.(*DiscoveryMarathon); ok {
+			marathon.SetDefaultScheduler(next.Scheduler)
+		}
+	}
+
+	sag.ServiceIP = net.ParseIP(next.ServiceIP)
+	sag.DrainTimeout = time.Duration(next.Timeouts.Drain)
+	SetStickySecret(next.StickySecret)
+	sag.config = next
+
+	for _, service := range sag.HttpServices {
+		if err := sag.applyHeaderRules(service); err != nil {
+			log.Printf("Invalid header rules for service %v. %v", service.ServiceId, err)
+		}
+	}
+
+	log.Printf("Reloaded configuration.")
+
+	return nil
+}
+
+// shutdownHttpRouter gracefully shuts down the given router, closing it
+// if its active requests do not finish within the given timeout.
+func shutdownHttpRouter(router *HttpRouter, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := router.Shutdown(ctx); err != nil {
+		log.Printf("Failed to gracefully shut down router %v. %v", router.Id, err)
+		router.Close()
+	}
+}
+
+func containsDiscoveryConfig(configs []DiscoveryConfig, config DiscoveryConfig) bool {
+	for _, c := range configs {
+		if c == config {
+			return true
+		}
+	}
+	return false
+}
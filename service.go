@@ -34,7 +34,7 @@ func (p Protocol) String() string {
 // Service is an interface, generic enough to cover any kind of network service,
 // providing the ability to add and remove backends.
 type Service interface {
-	AddBackend(id string, host string, port uint, capacity int, alive bool)
+	AddBackend(id string, host string, port uint, capacity int, weight int, alive bool)
 	RemoveBackend(id string)
 }
 
@@ -46,6 +46,7 @@ type Backend interface {
 
 	GetCurrentLoad() int
 	GetCapacity() int
+	GetWeight() int
 
 	Alive() bool
 }
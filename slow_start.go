@@ -0,0 +1,127 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// minRampFactor is the share of traffic a backend gets right at the
+// beginning of its slow start window.
+const minRampFactor = 0.1
+
+// SetSlowStart configures the backend to ramp up its share of traffic over
+// the given window after being added or becoming alive.
+//
+// The aggression defines the curve of the ramp: 1.0 ramps up linearly,
+// greater values ramp up faster in the beginning, and lower values
+// ramp up slower in the beginning.
+func (backend *HttpBackend) SetSlowStart(window time.Duration, aggression float64) {
+	if aggression <= 0 {
+		aggression = 1.0
+	}
+
+	backend.SlowStart = window
+	backend.slowStartAggression = aggression
+}
+
+// GetRampFactor returns the share (0.1 up to 1.0) of the backend's weight
+// and capacity currently in effect.
+func (backend *HttpBackend) GetRampFactor() float64 {
+	return getRampFactor(backend.SlowStart, backend.slowStartAggression, backend.AliveSince)
+}
+
+// getRampFactor returns the share of traffic of a backend alive since the
+// given time, ramping up over the given slow start window.
+func getRampFactor(window time.Duration, aggression float64, aliveSince time.Time) float64 {
+	if window <= 0 || aliveSince.IsZero() {
+		return 1.0
+	}
+
+	elapsed := time.Since(aliveSince)
+	if elapsed >= window {
+		return 1.0
+	}
+
+	f := math.Pow(float64(elapsed)/float64(window), 1.0/aggression)
+	return math.Max(f, minRampFactor)
+}
+
+// GetEffectiveWeight returns the backend's weight, honoring its slow start.
+func (backend *HttpBackend) GetEffectiveWeight() float64 {
+	return float64(backend.Weight) * backend.GetRampFactor()
+}
+
+// GetEffectiveCapacity returns the backend's capacity, honoring its slow
+// start, or 0 if unlimited.
+func (backend *HttpBackend) GetEffectiveCapacity() int {
+	if backend.Capacity == 0 {
+		return 0
+	}
+
+	return int(math.Ceil(float64(backend.Capacity) * backend.GetRampFactor()))
+}
+
+// getEffectiveLoad returns the load of the backend, including the request to
+// be scheduled, scaled up while the backend is still ramping up.
+func (backend *HttpBackend) getEffectiveLoad() float64 {
+	return float64(backend.GetCurrentLoad()+1) / backend.GetRampFactor()
+}
+
+// acceptRamp randomly decides whether or not a request may be sent to the
+// backend, in proportion to its ramp factor. This is used by the schedulers
+// that are not weight or load based.
+func (backend *HttpBackend) acceptRamp() bool {
+	return acceptRamp(backend.GetRampFactor())
+}
+
+func acceptRamp(f float64) bool {
+	return f >= 1.0 || rand.Float64() < f
+}
+
+// SetSlowStart configures the TCP backend to ramp up its share of sessions
+// over the given window, like HttpBackend.SetSlowStart.
+func (backend *TcpBackend) SetSlowStart(window time.Duration, aggression float64) {
+	if aggression <= 0 {
+		aggression = 1.0
+	}
+
+	backend.SlowStart = window
+	backend.slowStartAggression = aggression
+}
+
+// GetRampFactor returns the share (0.1 up to 1.0) of the TCP backend's
+// capacity currently in effect.
+func (backend *TcpBackend) GetRampFactor() float64 {
+	return getRampFactor(backend.SlowStart, backend.slowStartAggression, backend.AliveSince)
+}
+
+// GetEffectiveCapacity returns the TCP backend's capacity, honoring its
+// slow start, or 0 if unlimited.
+func (backend *TcpBackend) GetEffectiveCapacity() int {
+	if backend.Capacity == 0 {
+		return 0
+	}
+
+	return int(math.Ceil(float64(backend.Capacity) * backend.GetRampFactor()))
+}
+
+// getEffectiveLoad returns the sessions of the TCP backend, including the
+// one to be scheduled, scaled up while the backend is still ramping up.
+func (backend *TcpBackend) getEffectiveLoad() float64 {
+	return float64(backend.GetCurrentLoad()+1) / backend.GetRampFactor()
+}
+
+// acceptRamp randomly decides whether or not a session may be sent to the
+// TCP backend, in proportion to its ramp factor.
+func (backend *TcpBackend) acceptRamp() bool {
+	return acceptRamp(backend.GetRampFactor())
+}
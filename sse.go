@@ -10,11 +10,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -49,38 +54,94 @@ const (
 
 type EventSource struct {
 	Url            string
-	ReadyState     int
 	Handlers       map[string]EventHandler
 	OnOpen         func()
 	OnMessage      EventHandler
 	OnError        func(string)
-	ReconnectDelay time.Duration
-	LastEventID    string
+	Reconnects     uint64
+	lastEventAt    int64 // in unix nanoseconds
+	readyState     int
+	reconnectDelay time.Duration
+	lastEventID    string
+	mutex          sync.Mutex // guards readyState, reconnectDelay, lastEventID and cancel
+	cancel         context.CancelFunc
 }
 
 func NewEventSource(url string, reconnectDelay time.Duration) *EventSource {
 	var sse = &EventSource{Url: url,
-		ReadyState:     CONNECTING,
-		ReconnectDelay: reconnectDelay,
+		readyState:     CONNECTING,
+		reconnectDelay: reconnectDelay,
 		Handlers:       make(map[string]EventHandler)}
 
 	return sse
 }
 
+// ReadyState returns whether the event source is CONNECTING, OPEN, or
+// CLOSED.
+func (sse *EventSource) ReadyState() int {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	return sse.readyState
+}
+
+// LastEventID returns the ID of the last event received, sent along when
+// reconnecting.
+func (sse *EventSource) LastEventID() string {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	return sse.lastEventID
+}
+
+// ReconnectDelay returns the time to wait before reconnecting, as
+// possibly changed by the server.
+func (sse *EventSource) ReconnectDelay() time.Duration {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	return sse.reconnectDelay
+}
+
+func (sse *EventSource) setLastEventID(id string) {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	sse.lastEventID = id
+}
+
+func (sse *EventSource) setReconnectDelay(delay time.Duration) {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	sse.reconnectDelay = delay
+}
+
+// setReadyState changes the ready state, unless the event source has been
+// closed already, returning false in that case.
+func (sse *EventSource) setReadyState(state int) bool {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	if sse.readyState == CLOSED {
+		return false
+	}
+	sse.readyState = state
+	return true
+}
+
 func (sse *EventSource) AddEventListener(eventType string, cb func(string)) {
 	sse.Handlers[eventType] = func(_, data string) { cb(data) }
 }
 
 func (sse *EventSource) dispatchEvent(event, data string) {
-	switch sse.ReadyState {
-	case CLOSED:
+	if sse.ReadyState() == CLOSED {
 		return
-	case OPEN:
-		break
-	default:
-		sse.ReadyState = OPEN
 	}
 
+	discoveryEvents.Inc(event)
+	atomic.StoreInt64(&sse.lastEventAt, time.Now().UnixNano())
+
 	if sse.Handlers[event] != nil {
 		sse.Handlers[event](event, data)
 	} else if sse.OnMessage != nil {
@@ -88,12 +149,20 @@ func (sse *EventSource) dispatchEvent(event, data string) {
 	}
 }
 
+// LastEventAt returns the time the last event was received, if any.
+func (sse *EventSource) LastEventAt() time.Time {
+	if t := atomic.LoadInt64(&sse.lastEventAt); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
 func (sse *EventSource) Run() {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 
-	var client = &http.Client{tr, nil, nil, 0 * time.Second}
+	var client = &http.Client{Transport: tr}
 	req, err := http.NewRequest("GET", sse.Url, nil)
 	if err != nil {
 		if sse.OnError != nil {
@@ -102,8 +171,21 @@ func (sse *EventSource) Run() {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	if !sse.setCancel(cancel) {
+		return
+	}
+	defer sse.setCancel(nil)
+
 	req.Header.Add("Accept", "text/event-stream")
 	req.Header.Add("Cache-Control", "no-cache")
+	lastEventID := sse.LastEventID()
+	if len(lastEventID) != 0 {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -115,6 +197,15 @@ func (sse *EventSource) Run() {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNoContent {
+		// the server asks us to not reconnect anymore
+		sse.Close()
+		if sse.OnError != nil {
+			sse.OnError("SSE: server closed the event stream")
+		}
+		return
+	}
+
 	if resp.StatusCode != 200 {
 		err := fmt.Errorf("SSE: unexpected response status code: %v\n", resp.StatusCode)
 		if sse.OnError != nil {
@@ -123,19 +214,28 @@ func (sse *EventSource) Run() {
 		return
 	}
 
-	reader := bufio.NewReader(resp.Body)
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		err := fmt.Errorf("SSE: unexpected response content type: %q", mediaType)
+		if sse.OnError != nil {
+			sse.OnError(err.Error())
+		}
+		return
+	}
+
+	parser := NewEventStreamParser(resp.Body, lastEventID)
+	parser.OnRetry = sse.setReconnectDelay
 
-	var (
-		eventType  string // "event"
-		dataBuffer []byte // "data"
-	)
+	if !sse.setReadyState(OPEN) {
+		return
+	}
 
 	if sse.OnOpen != nil {
 		sse.OnOpen()
 	}
 
 	for {
-		line, err := reader.ReadString('\n')
+		event, err := parser.Next()
+		sse.setLastEventID(parser.LastEventID())
 		if err != nil {
 			if sse.OnError != nil {
 				sse.OnError(err.Error())
@@ -143,64 +243,215 @@ func (sse *EventSource) Run() {
 			return
 		}
 
-		line = strings.Trim(line, "\n\r")
+		sse.dispatchEvent(event.Type, event.Data)
+	}
+}
+
+func (sse *EventSource) RunForever() {
+	sse.Run()
+
+	for sse.setReadyState(CONNECTING) {
+		atomic.AddUint64(&discoveryReconnects, 1)
+		atomic.AddUint64(&sse.Reconnects, 1)
+
+		if sse.OnError != nil {
+			sse.OnError("Reconnecting")
+		}
+
+		if delay := sse.ReconnectDelay(); delay != 0 {
+			time.Sleep(delay)
+		}
+
+		sse.Run()
+	}
+}
+
+// Close stops the event source, and aborts the active connection, if any.
+func (sse *EventSource) Close() {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	sse.readyState = CLOSED
+	if sse.cancel != nil {
+		sse.cancel()
+	}
+}
+
+// setCancel registers the cancel function of the active connection,
+// returning false if the event source has been closed already.
+func (sse *EventSource) setCancel(cancel context.CancelFunc) bool {
+	sse.mutex.Lock()
+	defer sse.mutex.Unlock()
+
+	sse.cancel = cancel
+	return sse.readyState != CLOSED
+}
+
+// ----------------------------------------------------------------------------
+// event stream parser
+
+// Event is a single event as dispatched from an event stream.
+type Event struct {
+	Type        string
+	Data        string
+	LastEventID string
+}
+
+// EventStreamParser parses a text/event-stream as specified by the
+// WHATWG HTML Living Standard, section "Server-sent events".
+type EventStreamParser struct {
+	OnRetry           func(time.Duration) // invoked upon a valid retry field
+	reader            *bufio.Reader
+	started           bool // whether or not the first line has been read already
+	skipLF            bool // whether the previous line was terminated by a single CR
+	eventType         []byte
+	data              []byte
+	lastEventIDBuffer string
+	lastEventID       string
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// NewEventStreamParser creates a parser for the given stream, with the
+// last event ID initialized to lastEventID (such as when resuming).
+func NewEventStreamParser(r io.Reader, lastEventID string) *EventStreamParser {
+	return &EventStreamParser{
+		reader:            bufio.NewReader(r),
+		lastEventIDBuffer: lastEventID,
+		lastEventID:       lastEventID,
+	}
+}
+
+// LastEventID returns the ID of the most recently dispatched event.
+func (p *EventStreamParser) LastEventID() string {
+	return p.lastEventID
+}
+
+// Next parses the stream up to the next event to be dispatched and
+// returns it. Any incomplete event at the end of the stream is discarded.
+func (p *EventStreamParser) Next() (*Event, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
 
 		if len(line) == 0 {
-			if len(eventType) != 0 || len(dataBuffer) != 0 {
-				sse.dispatchEvent(eventType, string(dataBuffer))
-				dataBuffer = dataBuffer[0:0]
-				eventType = ""
+			if event := p.dispatch(); event != nil {
+				return event, nil
 			}
-		} else if line[0] != ':' {
-			var (
-				name  string
-				value string
-			)
-			if strings.Contains(line, ":") {
-				args := strings.SplitN(line, ": ", 2)
-				name = args[0]
-				value = args[1]
-			} else {
-				name = line
+			continue
+		}
+
+		if line[0] == ':' {
+			continue // comment
+		}
+
+		var name, value []byte
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			name = line[:i]
+			value = line[i+1:]
+			if len(value) != 0 && value[0] == ' ' {
+				value = value[1:]
 			}
+		} else {
+			name = line
+		}
 
-			switch name {
-			case "event":
-				eventType = value
-			case "data":
-				dataBuffer = append(dataBuffer, []byte(value)...)
-				dataBuffer = append(dataBuffer, 0x0D)
-			case "id":
-				sse.LastEventID = value
-			case "retry":
-				if number, err := strconv.Atoi(value); err == nil {
-					sse.ReconnectDelay = time.Millisecond * time.Duration(number)
-				}
+		p.processField(string(name), value)
+	}
+}
+
+func (p *EventStreamParser) processField(name string, value []byte) {
+	switch name {
+	case "event":
+		p.eventType = append(p.eventType[:0], value...)
+	case "data":
+		p.data = append(p.data, value...)
+		p.data = append(p.data, '\n')
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 {
+			p.lastEventIDBuffer = string(value)
+		}
+	case "retry":
+		if isASCIIDigits(value) {
+			if number, err := strconv.ParseInt(string(value), 10, 64); err == nil && p.OnRetry != nil {
+				p.OnRetry(time.Millisecond * time.Duration(number))
 			}
 		}
 	}
 }
 
-func (sse *EventSource) RunForever() {
-	sse.Run()
+func (p *EventStreamParser) dispatch() *Event {
+	p.lastEventID = p.lastEventIDBuffer
+
+	if len(p.data) == 0 {
+		p.eventType = p.eventType[:0]
+		return nil
+	}
 
-	for sse.ReadyState != CLOSED {
-		sse.ReadyState = CONNECTING
+	event := &Event{
+		Type:        string(p.eventType),
+		Data:        string(p.data[:len(p.data)-1]),
+		LastEventID: p.lastEventID,
+	}
+	if len(event.Type) == 0 {
+		event.Type = "message"
+	}
 
-		if sse.OnError != nil {
-			sse.OnError("Reconnecting")
+	p.data = p.data[:0]
+	p.eventType = p.eventType[:0]
+
+	return event
+}
+
+// readLine reads the next line, terminated by either CRLF, LF, or CR,
+// without the line terminator.
+func (p *EventStreamParser) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := p.reader.ReadByte()
+		if err != nil {
+			return nil, err
 		}
 
-		if sse.ReconnectDelay != 0 {
-			time.Sleep(sse.ReconnectDelay)
+		if p.skipLF {
+			p.skipLF = false
+			if b == '\n' {
+				continue
+			}
 		}
 
-		sse.Run()
+		switch b {
+		case '\r':
+			p.skipLF = true
+			return p.stripBOM(line), nil
+		case '\n':
+			return p.stripBOM(line), nil
+		default:
+			line = append(line, b)
+		}
 	}
 }
 
-func (sse *EventSource) Close() {
-	sse.ReadyState = CLOSED
+func (p *EventStreamParser) stripBOM(line []byte) []byte {
+	if !p.started {
+		p.started = true
+		return bytes.TrimPrefix(line, utf8BOM)
+	}
+	return line
+}
+
+func isASCIIDigits(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
 
-	// TODO: wakeup run-loop if active
+	return true
 }
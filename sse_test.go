@@ -0,0 +1,208 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		events  []Event
+		retries []time.Duration
+	}{
+		{
+			name:   "lf",
+			stream: "data: a\n\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:   "crlf",
+			stream: "data: a\r\n\r\ndata: b\r\n\r\n",
+			events: []Event{{Type: "message", Data: "a"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:   "cr",
+			stream: "data: a\r\rdata: b\r\r",
+			events: []Event{{Type: "message", Data: "a"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "data: a\r\ndata: b\rdata: c\n\r\n",
+			events: []Event{{Type: "message", Data: "a\nb\nc"}},
+		},
+		{
+			name:   "bom",
+			stream: "\xEF\xBB\xBFdata: a\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "bom only at the start",
+			stream: "data: a\n\n\xEF\xBB\xBFdata: b\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata: second\ndata\n\n",
+			events: []Event{{Type: "message", Data: "first\nsecond\n"}},
+		},
+		{
+			name:   "no space after colon",
+			stream: "data:x\ndata:  y\n\n",
+			events: []Event{{Type: "message", Data: "x\n y"}},
+		},
+		{
+			name:   "comments",
+			stream: ": keep-alive\ndata: a\n:another\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "event type",
+			stream: "event: status_update_event\ndata: {}\n\ndata: plain\n\n",
+			events: []Event{{Type: "status_update_event", Data: "{}"}, {Type: "message", Data: "plain"}},
+		},
+		{
+			name:   "id",
+			stream: "id: 1\ndata: a\n\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a", LastEventID: "1"}, {Type: "message", Data: "b", LastEventID: "1"}},
+		},
+		{
+			name:   "id with nul is ignored",
+			stream: "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a", LastEventID: "1"}, {Type: "message", Data: "b", LastEventID: "1"}},
+		},
+		{
+			name:   "empty id resets",
+			stream: "id: 1\ndata: a\n\nid\ndata: b\n\n",
+			events: []Event{{Type: "message", Data: "a", LastEventID: "1"}, {Type: "message", Data: "b"}},
+		},
+		{
+			name:    "retry",
+			stream:  "retry: 1500\n\nretry: 1.5\nretry: 12x\nretry: -1\nretry:\ndata: a\n\n",
+			events:  []Event{{Type: "message", Data: "a"}},
+			retries: []time.Duration{1500 * time.Millisecond},
+		},
+		{
+			name:   "empty event is not dispatched",
+			stream: "\n\nevent: foo\n\ndata: a\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "empty event updates the last event id",
+			stream: "id: 7\n\ndata: a\n\n",
+			events: []Event{{Type: "message", Data: "a", LastEventID: "7"}},
+		},
+		{
+			name:   "unknown fields",
+			stream: "foo: bar\ndata: a\nDATA: b\n\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+		{
+			name:   "incomplete event at the end",
+			stream: "data: a\n\ndata: b\n",
+			events: []Event{{Type: "message", Data: "a"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var retries []time.Duration
+			parser := NewEventStreamParser(strings.NewReader(test.stream), "")
+			parser.OnRetry = func(delay time.Duration) { retries = append(retries, delay) }
+
+			var events []Event
+			for {
+				event, err := parser.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, *event)
+			}
+
+			if !reflect.DeepEqual(events, test.events) {
+				t.Errorf("Expected events %+v, got %+v.", test.events, events)
+			}
+			if !reflect.DeepEqual(retries, test.retries) {
+				t.Errorf("Expected retries %v, got %v.", test.retries, retries)
+			}
+		})
+	}
+}
+
+func TestEventStreamParserResumes(t *testing.T) {
+	parser := NewEventStreamParser(strings.NewReader("data: a\n\n"), "41")
+
+	event, err := parser.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.LastEventID != "41" || parser.LastEventID() != "41" {
+		t.Fatalf("Expected last event ID 41, got %q.", event.LastEventID)
+	}
+}
+
+func TestEventSourceReconnectsWithLastEventID(t *testing.T) {
+	lastEventIDs := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEventIDs <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		if len(r.Header.Get("Last-Event-ID")) == 0 {
+			fmt.Fprint(w, "retry: 10\nid: 42\ndata: first\n\n")
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	sse := NewEventSource(server.URL, time.Hour)
+	received := make(chan string, 1)
+	sse.OnMessage = func(_, data string) { received <- data }
+
+	done := make(chan struct{})
+	go func() {
+		sse.RunForever()
+		close(done)
+	}()
+
+	for i, expected := range []string{"", "42"} {
+		select {
+		case id := <-lastEventIDs:
+			if id != expected {
+				t.Fatalf("Expected Last-Event-ID %q on connect %v, got %q.", expected, i, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No connect %v.", i)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event source not closed by 204 response.")
+	}
+
+	if data := <-received; data != "first" {
+		t.Fatalf("Expected event data %q, got %q.", "first", data)
+	}
+	if sse.ReadyState() != CLOSED || sse.LastEventID() != "42" || sse.ReconnectDelay() != 10*time.Millisecond {
+		t.Fatalf("Unexpected state %v, last event ID %q, reconnect delay %v.",
+			sse.ReadyState(), sse.LastEventID(), sse.ReconnectDelay())
+	}
+}
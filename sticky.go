@@ -0,0 +1,111 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// stickySecret holds the key ([]byte) used to sign affinity cookies.
+var stickySecret atomic.Value
+
+func init() {
+	stickySecret.Store(generateStickySecret())
+}
+
+func generateStickySecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate sticky session secret. %v", err)
+	}
+	return secret
+}
+
+// SetStickySecret sets the key used to sign affinity cookies. Without
+// an explicitly configured secret, a random one is generated on startup,
+// invalidating all affinity cookies upon restart.
+func SetStickySecret(secret string) {
+	if len(secret) != 0 {
+		stickySecret.Store([]byte(secret))
+	}
+}
+
+// makeAffinityToken returns the opaque token identifying a backend of the
+// given service in affinity cookies, never revealing the backend itself.
+func makeAffinityToken(serviceId, backendId string) string {
+	sum := sha256.Sum256([]byte(serviceId + "\x00" + backendId))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signAffinityToken(serviceId, token string) string {
+	mac := hmac.New(sha256.New, stickySecret.Load().([]byte))
+	mac.Write([]byte(serviceId + "\x00" + token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// makeAffinityCookieValue returns the signed affinity cookie value.
+func makeAffinityCookieValue(serviceId, token string) string {
+	return token + "." + signAffinityToken(serviceId, token)
+}
+
+// parseAffinityCookieValue verifies the given affinity cookie value and
+// returns its backend token.
+func parseAffinityCookieValue(serviceId, value string) (string, bool) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	token, signature := value[:i], value[i+1:]
+	expected := signAffinityToken(serviceId, token)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false
+	}
+
+	return token, true
+}
+
+// getStickyBackend returns the available backend the request is bound
+// to via its affinity cookie, if any, unless it has been tried already.
+func (service *HttpService) getStickyBackend(r *http.Request, tried backendSet) *HttpBackend {
+	cookie, err := r.Cookie(service.StickyCookie)
+	if err != nil {
+		return nil
+	}
+
+	token, ok := parseAffinityCookieValue(service.ServiceId, cookie.Value)
+	if !ok {
+		return nil
+	}
+
+	if backend, ok := service.affinity[token]; ok && backend.acceptsSticky() && !tried.contains(backend) {
+		return backend
+	}
+
+	return nil
+}
+
+// makeAffinityCookie returns the cookie binding the client to the given backend.
+func (service *HttpService) makeAffinityCookie(r *http.Request, backend *HttpBackend) *http.Cookie {
+	return &http.Cookie{
+		Name:     service.StickyCookie,
+		Value:    makeAffinityCookieValue(service.ServiceId, backend.affinityToken),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+}
@@ -0,0 +1,89 @@
+// This file is part of the "sag" project
+//   <http://github.com/christianparpart/sag>
+//   (c) 2017 Christian Parpart <christian@parpart.family>
+//
+// Licensed under the MIT License (the "License"); you may not use this
+// file except in compliance with the License. You may obtain a copy of
+// the License at: http://opensource.org/licenses/MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAffinityCookieValue(t *testing.T) {
+	token := makeAffinityToken("/web", "web.1")
+	other := makeAffinityToken("/web", "web.2")
+	value := makeAffinityCookieValue("/web", token)
+	signature := value[len(token)+1:]
+
+	tests := []struct {
+		name      string
+		serviceId string
+		value     string
+		valid     bool
+	}{
+		{"valid", "/web", value, true},
+		{"tampered signature", "/web", token + "." + signature[1:] + "A", false},
+		{"tampered token", "/web", other + "." + signature, false},
+		{"unsigned", "/web", token, false},
+		{"empty signature", "/web", token + ".", false},
+		{"other service", "/api", value, false},
+		{"empty", "/web", "", false},
+	}
+
+	for _, test := range tests {
+		parsed, ok := parseAffinityCookieValue(test.serviceId, test.value)
+		if ok != test.valid || (ok && parsed != token) {
+			t.Errorf("%v: expected valid: %v, got %q (valid: %v).", test.name, test.valid, parsed, ok)
+		}
+	}
+}
+
+func TestParseAffinityCookieValueWithOtherSecret(t *testing.T) {
+	previous := stickySecret.Load()
+	defer stickySecret.Store(previous)
+
+	token := makeAffinityToken("/web", "web.1")
+	value := makeAffinityCookieValue("/web", token)
+
+	SetStickySecret("rotated")
+	if _, ok := parseAffinityCookieValue("/web", value); ok {
+		t.Error("Expected cookie signed with another secret to be rejected.")
+	}
+}
+
+func TestGetStickyBackend(t *testing.T) {
+	service := NewHttpService("/web", SchedulerRoundRobin, nil)
+	service.StickyCookie = "sticky"
+	service.AddBackend("web.1", "127.0.0.1", 10001, 0, 1, true)
+	backend := service.GetBackendById("web.1")
+
+	tests := []struct {
+		name     string
+		cookie   string
+		expected *HttpBackend
+	}{
+		{"bound", makeAffinityCookieValue("/web", backend.affinityToken), backend},
+		{"unknown backend", makeAffinityCookieValue("/web", makeAffinityToken("/web", "web.gone")), nil},
+		{"forged token", makeAffinityToken("/web", "web.1") + ".forged", nil},
+		{"garbage", "garbage", nil},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sticky", Value: test.cookie})
+		if actual := service.getStickyBackend(r, nil); actual != test.expected {
+			t.Errorf("%v: expected backend %v, got %v.", test.name, test.expected, actual)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sticky", Value: tests[0].cookie})
+	if actual := service.getStickyBackend(r, backendSet{backend}); actual != nil {
+		t.Errorf("Expected backend tried already not to be picked again, got %v.", actual)
+	}
+}
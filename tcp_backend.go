@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TcpBackend struct {
@@ -9,26 +14,109 @@ type TcpBackend struct {
 	Host        string
 	Port        uint
 	Capacity    int
-	CurrentLoad int
+	CurrentLoad int32
 	Alive       bool
+	AliveSince  time.Time
+	SlowStart   time.Duration
 	proxy       *TcpProxy
+	mutex       sync.Mutex
+	sessions    map[net.Conn]bool // active client connections
+
+	slowStartAggression float64
+	drainUntil          int64 // in unix nanoseconds, zero unless draining
 }
 
-func NewTcpBackend(id string, ip net.IP, port uint, capacity int) *TcpBackend {
-	return &TcpBackend{
+func NewTcpBackend(id string, host string, port uint, capacity int, alive bool, proxyProtocol int) *TcpBackend {
+	backend := &TcpBackend{
 		Id:          id,
-		Host:        ip.String(),
+		Host:        host,
 		Port:        port,
 		Capacity:    capacity,
 		CurrentLoad: 0,
-		proxy:       NewTcpProxy(ip, port),
+		Alive:       alive,
+		proxy:       NewTcpProxy(host, port, proxyProtocol),
+		sessions:    make(map[net.Conn]bool),
+	}
+
+	if alive {
+		backend.AliveSince = time.Now()
 	}
+
+	return backend
+}
+
+func (backend *TcpBackend) String() string {
+	return fmt.Sprintf("%v (%v)", backend.Id, backend.proxy)
+}
+
+func (backend *TcpBackend) GetCurrentLoad() int {
+	return int(atomic.LoadInt32(&backend.CurrentLoad))
+}
+
+// IsAvailable tests whether the backend is able to take another session.
+func (backend *TcpBackend) IsAvailable() bool {
+	capacity := backend.GetEffectiveCapacity()
+	return backend.Alive && !backend.IsDraining() && (capacity == 0 || backend.GetCurrentLoad() < capacity)
 }
 
 func (backend *TcpBackend) ServeTCP(conn net.Conn) {
-	backend.CurrentLoad++
+	atomic.AddInt32(&backend.CurrentLoad, 1)
+	defer atomic.AddInt32(&backend.CurrentLoad, -1)
+
+	backend.mutex.Lock()
+	backend.sessions[conn] = true
+	backend.mutex.Unlock()
+
+	defer func() {
+		backend.mutex.Lock()
+		delete(backend.sessions, conn)
+		backend.mutex.Unlock()
+	}()
 
-	conn.Close()
+	if err := backend.proxy.ServeTCP(conn); err != nil {
+		log.Printf("Failed to proxy TCP connection %v to backend %v. %v", conn.RemoteAddr(), backend, err)
+	}
+}
+
+// IsDraining tests whether the backend has been removed and is finishing
+// its active sessions.
+func (backend *TcpBackend) IsDraining() bool {
+	return atomic.LoadInt64(&backend.drainUntil) != 0
+}
+
+// Drain lets the active sessions finish for up to the given timeout, and
+// then closes the remaining ones. The backend must not receive any new
+// sessions. done is invoked once the backend has no active sessions anymore.
+func (backend *TcpBackend) Drain(timeout time.Duration, done func()) {
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt64(&backend.drainUntil, deadline.UnixNano())
+
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
 
-	backend.CurrentLoad--
+		closed := false
+		for backend.GetCurrentLoad() > 0 {
+			if !closed && time.Now().After(deadline) {
+				backend.closeSessions(timeout)
+				closed = true
+			}
+			<-ticker.C
+		}
+
+		done()
+	}()
+}
+
+func (backend *TcpBackend) closeSessions(timeout time.Duration) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if len(backend.sessions) != 0 {
+		log.Printf("TCP backend %v did not drain within %v. Closing %v active sessions.",
+			backend, timeout, len(backend.sessions))
+	}
+	for conn := range backend.sessions {
+		conn.Close()
+	}
 }
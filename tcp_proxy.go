@@ -2,27 +2,73 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"time"
 )
 
+// tcpConnectTimeout limits the time to connect to a TCP backend.
+const tcpConnectTimeout = 5 * time.Second
+
 type TcpProxy struct {
-	IP   net.IP
-	Port uint
+	Host          string
+	Port          uint
+	ProxyProtocol int // PROXY protocol version to pass to upstream (0=disabled, 1=v1, 2=v2)
 }
 
-func NewTcpProxy(ip net.IP, port uint) *TcpProxy {
+func NewTcpProxy(host string, port uint, proxyProtocol int) *TcpProxy {
 	return &TcpProxy{
-		IP:   ip,
-		Port: port,
+		Host:          host,
+		Port:          port,
+		ProxyProtocol: proxyProtocol,
 	}
 }
 
-func (proxy *TcpProxy) ServeTCP(conn net.Conn) {
-	log.Printf("TODO: TcpProxy(%v).ServeTCP()", proxy)
-	conn.Close()
+// ServeTCP connects the client to the upstream, passing on the client's
+// address by the PROXY protocol if enabled, and forwards all data in both
+// directions until both sides are done.
+func (proxy *TcpProxy) ServeTCP(conn net.Conn) error {
+	upstream, err := net.DialTimeout("tcp", proxy.String(), tcpConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	if proxy.ProxyProtocol != ProxyProtocolDisabled {
+		if err := NewProxyHeader(conn).WriteTo(upstream, proxy.ProxyProtocol); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		forwardTCP(upstream, conn)
+		close(done)
+	}()
+	forwardTCP(conn, upstream)
+	<-done
+
+	return nil
+}
+
+// forwardTCP copies from src to dst until src is done, then half-closes
+// dst, or closes both if forwarding failed.
+func forwardTCP(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+
+	if conn, ok := dst.(interface {
+		CloseWrite() error
+	}); ok {
+		conn.CloseWrite()
+	} else {
+		dst.Close()
+	}
 }
 
 func (proxy *TcpProxy) String() string {
-	return fmt.Sprintf("%v:%v", proxy.IP, proxy.Port)
+	return net.JoinHostPort(proxy.Host, fmt.Sprint(proxy.Port))
 }
@@ -1,29 +1,86 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type TcpRouter struct {
-	ListenAddr string
-	listener   net.Listener
-	getService func(net.Conn) *TcpService
+	ListenAddr    string
+	listener      net.Listener
+	getService    func(net.Conn) *TcpService
+	mutex         sync.Mutex
+	sessions      map[net.Conn]bool // active client connections
+	closing       bool
+	wg            sync.WaitGroup
+	proxyProtocol atomic.Value // *ProxyProtocolPolicy, accepting PROXY protocol headers if not nil
 }
 
-func NewTcpRouter(laddr string) (*TcpRouter, error) {
-	listener, err := net.Listen("tcp", ":8080")
+func NewTcpRouter(laddr string, getService func(net.Conn) *TcpService) (*TcpRouter, error) {
+	listener, err := Listen(laddr)
 	if err != nil {
 		return nil, err
 	}
 	router := &TcpRouter{
 		ListenAddr: laddr,
 		listener:   listener,
+		getService: getService,
+		sessions:   make(map[net.Conn]bool),
 	}
 	return router, nil
 }
 
+// SetProxyProtocol makes new connections accept PROXY protocol headers as
+// of the given policy, or disables it if nil.
+func (router *TcpRouter) SetProxyProtocol(policy *ProxyProtocolPolicy) {
+	router.proxyProtocol.Store(policy)
+}
+
+func (router *TcpRouter) getProxyProtocol() *ProxyProtocolPolicy {
+	policy, _ := router.proxyProtocol.Load().(*ProxyProtocolPolicy)
+	return policy
+}
+
+// Close immediately closes the listener and all active sessions.
 func (router *TcpRouter) Close() {
+	router.stopAccepting()
+
+	router.mutex.Lock()
+	for conn := range router.sessions {
+		conn.Close()
+	}
+	router.mutex.Unlock()
+}
+
+// Shutdown stops accepting new connections and waits for all active
+// sessions to finish, or until the context is done, in which case the
+// remaining sessions are closed.
+func (router *TcpRouter) Shutdown(ctx context.Context) error {
+	router.stopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		router.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		router.Close()
+		return ctx.Err()
+	}
+}
+
+func (router *TcpRouter) stopAccepting() {
+	router.mutex.Lock()
+	router.closing = true
+	router.mutex.Unlock()
+
 	router.listener.Close()
 }
 
@@ -31,16 +88,42 @@ func (router *TcpRouter) Serve() {
 	for {
 		conn, err := router.listener.Accept()
 		if err != nil {
+			router.mutex.Lock()
+			closing := router.closing
+			router.mutex.Unlock()
+			if closing {
+				return
+			}
 			log.Printf("Failed to accept TCP listener %v. %v", router.ListenAddr, err)
 			continue
 		}
+		if policy := router.getProxyProtocol(); policy != nil {
+			conn = policy.Wrap(conn)
+		}
 		service := router.getService(conn)
-		if service != nil {
+		if service == nil {
 			log.Printf("Router %v failed to route TCP connection %v to service.",
 				router.ListenAddr, conn.RemoteAddr())
 			conn.Close()
 			continue
 		}
-		go service.ServeTCP(conn)
+
+		router.mutex.Lock()
+		router.sessions[conn] = true
+		router.wg.Add(1)
+		router.mutex.Unlock()
+
+		go func() {
+			defer router.wg.Done()
+			if pc, ok := conn.(*proxyProtocolConn); ok && pc.readHeader() != nil {
+				conn.Close()
+			} else {
+				service.ServeTCP(conn)
+			}
+
+			router.mutex.Lock()
+			delete(router.sessions, conn)
+			router.mutex.Unlock()
+		}()
 	}
 }
@@ -1,18 +1,188 @@
 package main
 
 import (
+	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 type TcpService struct {
 	ServiceId        string
 	Scheduler        SchedulingAlgorithm
+	ProxyProtocol    int           // PROXY protocol version to pass to upstream (0=disabled, 1=v1, 2=v2)
+	DrainTimeout     time.Duration // time to let removed backends finish their sessions
+	SlowStart        time.Duration // time to ramp up new backends' share of sessions (0=disabled)
+	SlowStartCurve   float64       // aggression of the slow start ramp (1.0 = linear)
 	Backends         []*TcpBackend
+	Draining         []*TcpBackend // removed backends still finishing their sessions
 	lastBackendIndex int
+	mutex            sync.Mutex
 	selectBackend    func() *TcpBackend
+	router           *TcpRouter // accepting the service's connections
+}
+
+func NewTcpService(serviceId string, scheduler SchedulingAlgorithm, proxyProtocol int) *TcpService {
+	log.Printf("New service TCP %v", serviceId)
+
+	service := &TcpService{
+		ServiceId:     serviceId,
+		Scheduler:     scheduler,
+		ProxyProtocol: proxyProtocol,
+		Backends:      make([]*TcpBackend, 0),
+	}
+
+	switch scheduler {
+	case SchedulerLeastLoad:
+		service.selectBackend = service.LeastLoadScheduler
+	case SchedulerRoundRobin:
+		service.selectBackend = service.RoundRobinScheduler
+	default:
+		log.Printf("Unsupported scheduler %q for TCP service %v. Falling back to %v.",
+			scheduler, serviceId, SchedulerRoundRobin)
+		service.Scheduler = SchedulerRoundRobin
+		service.selectBackend = service.RoundRobinScheduler
+	}
+
+	switch proxyProtocol {
+	case ProxyProtocolDisabled, ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		log.Printf("Unsupported PROXY protocol version %v for TCP service %v. Disabling it.",
+			proxyProtocol, serviceId)
+		service.ProxyProtocol = ProxyProtocolDisabled
+	}
+
+	return service
+}
+
+// IsEmpty tests whether the service has neither any backends nor any
+// backends still draining.
+func (service *TcpService) IsEmpty() bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	return len(service.Backends) == 0 && len(service.Draining) == 0
+}
+
+// AddBackend adds a new backend, returning false if it is already present.
+func (service *TcpService) AddBackend(id string, host string, port uint, capacity int, alive bool) bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for _, backend := range service.Backends {
+		if backend.Id == id {
+			return false
+		}
+	}
+
+	backend := NewTcpBackend(id, host, port, capacity, alive, service.ProxyProtocol)
+	backend.SetSlowStart(service.SlowStart, service.SlowStartCurve)
+	service.Backends = append(service.Backends, backend)
+	log.Printf("Added backend to TCP service %v. %v", service.ServiceId, backend)
+
+	return true
+}
+
+// RemoveBackend removes the given backend, letting its active sessions
+// finish for up to the drain timeout. It returns false if the backend was
+// not found.
+func (service *TcpService) RemoveBackend(id string) bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for i, backend := range service.Backends {
+		if backend.Id == id {
+			service.Backends = append(service.Backends[:i], service.Backends[i+1:]...)
+			log.Printf("Removed backend from TCP service %v, draining for up to %v. %v",
+				service.ServiceId, service.DrainTimeout, backend)
+			service.Draining = append(service.Draining, backend)
+			backend.Drain(service.DrainTimeout, func() { service.finishDrain(backend) })
+			return true
+		}
+	}
+
+	return false
+}
+
+// finishDrain forgets about the given backend once it has been drained.
+func (service *TcpService) finishDrain(backend *TcpBackend) {
+	service.mutex.Lock()
+	for i, b := range service.Draining {
+		if b == backend {
+			service.Draining = append(service.Draining[:i], service.Draining[i+1:]...)
+			break
+		}
+	}
+	service.mutex.Unlock()
+
+	log.Printf("Backend %v of TCP service %v drained", backend, service.ServiceId)
+}
+
+// SetBackendAlive changes the health of the given backend, returning
+// false if the backend was not found.
+func (service *TcpService) SetBackendAlive(id string, alive bool) bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	for _, backend := range service.Backends {
+		if backend.Id == id {
+			if backend.Alive != alive {
+				backend.Alive = alive
+				if alive {
+					backend.AliveSince = time.Now()
+				}
+				log.Printf("TCP backend %v is alive: %v.", backend, alive)
+			}
+			return true
+		}
+	}
+
+	return false
 }
 
 func (service *TcpService) ServeTCP(conn net.Conn) {
-	// TODO: selectBackend()
 	defer conn.Close()
+
+	service.mutex.Lock()
+	backend := service.selectBackend()
+	service.mutex.Unlock()
+
+	if backend == nil {
+		log.Printf("No backend available for TCP service %v. Closing connection from %v.",
+			service.ServiceId, conn.RemoteAddr())
+		return
+	}
+
+	backend.ServeTCP(conn)
+}
+
+func (service *TcpService) LeastLoadScheduler() *TcpBackend {
+	var best *TcpBackend
+	for _, backend := range service.Backends {
+		if backend.IsAvailable() && (best == nil || backend.getEffectiveLoad() < best.getEffectiveLoad()) {
+			best = backend
+		}
+	}
+	return best
+}
+
+func (service *TcpService) RoundRobinScheduler() *TcpBackend {
+	var first *TcpBackend
+
+	// skip unavailable backends, and backends still ramping up in
+	// proportion to their slow start
+	for i := 0; i < len(service.Backends); i++ {
+		service.lastBackendIndex = (service.lastBackendIndex + 1) % len(service.Backends)
+		backend := service.Backends[service.lastBackendIndex]
+		if !backend.IsAvailable() {
+			continue
+		}
+		if backend.acceptRamp() {
+			return backend
+		}
+		if first == nil {
+			first = backend
+		}
+	}
+	return first
 }
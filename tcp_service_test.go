@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpServiceClosesSessionsOfRemovedBackends(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+
+	service := NewTcpService("/tcp", SchedulerRoundRobin, ProxyProtocolDisabled)
+	service.DrainTimeout = 50 * time.Millisecond
+	service.AddBackend("tcp.1", "127.0.0.1", uint(upstream.Addr().(*net.TCPAddr).Port), 0, true)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		service.ServeTCP(server)
+		close(done)
+	}()
+
+	client.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("Unexpected reply %q. %v", line, err)
+	}
+
+	if !service.RemoveBackend("tcp.1") {
+		t.Fatal("Backend not found.")
+	}
+
+	view := newTcpServiceView(service)
+	if len(view.Backends) != 1 || !view.Backends[0].Removed || view.Backends[0].Available {
+		t.Errorf("Expected the draining backend to be reported as removed, got %+v.", view.Backends)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session of removed backend not closed after the drain timeout.")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !service.IsEmpty(); time.Sleep(drainPollInterval) {
+		if time.Now().After(deadline) {
+			t.Fatal("Drained backend not forgotten.")
+		}
+	}
+}
+
+func TestTcpSchedulersHonorSlowStart(t *testing.T) {
+	for _, scheduler := range []SchedulingAlgorithm{SchedulerLeastLoad, SchedulerRoundRobin} {
+		service := NewTcpService("/tcp", scheduler, ProxyProtocolDisabled)
+		service.AddBackend("warm", "127.0.0.1", 10000, 0, true)
+		service.SlowStart = time.Hour
+		service.AddBackend("ramping", "127.0.0.1", 10001, 0, true)
+
+		picks := 0
+		for i := 0; i < 1000; i++ {
+			if service.selectBackend().Id == "ramping" {
+				picks++
+			}
+		}
+		if picks > 300 {
+			t.Errorf("%v picked the backend ramping up %v out of 1000 times.", scheduler, picks)
+		}
+	}
+}